@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
@@ -8,6 +9,7 @@ import (
 	cli "github.com/urfave/cli/v2"
 
 	"github.com/jswank/murmur/internal/cmd"
+	"github.com/jswank/murmur/pkg/murmur"
 )
 
 var (
@@ -20,13 +22,12 @@ func main() {
 
 	log := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{}))
 
+	// the hierarchy flags of the commands are generated from the config
+	cmd.Setup(os.Args[1:])
+
 	app := &cli.App{
-		Usage: "Murmur configuration management commands",
-		Commands: []*cli.Command{
-			cmd.GenerateCommand,
-			cmd.ReposCommand,
-			cmd.JsonnetCommand,
-		},
+		Usage:    "Murmur configuration management commands",
+		Commands: cmd.Commands,
 		// parse --version flag
 		Flags: []cli.Flag{
 			&cli.BoolFlag{
@@ -47,11 +48,34 @@ func main() {
 			return nil
 		},
 		EnableBashCompletion: true,
+		// errors that carry an exit code are handled below, with the others
+		ExitErrHandler: func(*cli.Context, error) {},
+	}
+
+	// the metrics and spans of the run are exported, its summary sent to the
+	// notification sinks and its audit records to the audit endpoint, before
+	// exiting
+	err := app.Run(os.Args)
+	if terr := cmd.ExportTelemetry(err); terr != nil {
+		log.Warn(murmur.Scrub(terr.Error()))
+	}
+	if nerr := cmd.Notify(err); nerr != nil {
+		log.Warn(murmur.Scrub(nerr.Error()))
+	}
+	if jerr := cmd.CloseJournal(); jerr != nil {
+		log.Warn(murmur.Scrub(jerr.Error()))
 	}
 
-	if err := app.Run(os.Args); err != nil {
-		log.Error(err.Error())
-		os.Exit(1)
+	// failures are printed grouped by phase, and the exit code is that of
+	// the earliest phase that failed
+	if err != nil {
+		var failures *murmur.Failures
+		if errors.As(err, &failures) {
+			fmt.Fprint(os.Stderr, murmur.Scrub(failures.Summary()))
+		} else {
+			log.Error(murmur.Scrub(err.Error()))
+		}
+		os.Exit(murmur.ExitCode(err))
 	}
 
 }
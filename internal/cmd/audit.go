@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jswank/murmur/pkg/murmur"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+const auditDesc = `Query the audit journal of the files murmur wrote and the commits it made.
+
+Each record of the journal is an operation: a file written to a clone
+(write), a file deleted by a commit (delete), a commit (commit) or a push
+(push). Records are selected by --repo, --path (a file, a directory or a
+glob, relative to the repo), --op and the time range --since / --until.
+Times are RFC 3339 timestamps, dates (2006-01-02) or durations before now
+(24h).
+
+The journal is the 'file' of the 'audit' section of the configuration file,
+or --file.
+`
+
+var AuditCommand = &cli.Command{
+	Name:            "audit",
+	Usage:           "query the audit journal of writes and commits",
+	UsageText:       "murmur audit [options]",
+	HideHelpCommand: true,
+	Action:          queryAudit,
+	Description:     auditDesc,
+	Before:          BeforeFunc,
+	Flags: append(DefaultFlags,
+		&cli.StringFlag{
+			Name:  "file",
+			Usage: "Journal file [default: the file of the audit section of the config file]",
+		},
+		&cli.StringFlag{
+			Name:  "repo",
+			Usage: "Select the records of a repo, i.e. org/name",
+		},
+		&cli.StringFlag{
+			Name:  "path",
+			Usage: "Select the records of a file, directory or glob of the repo",
+		},
+		&cli.StringFlag{
+			Name:  "op",
+			Usage: "Select the records of an operation: write, delete, commit or push",
+		},
+		&cli.StringFlag{
+			Name:  "since",
+			Usage: "Select the records at or after a time, date or duration before now",
+		},
+		&cli.StringFlag{
+			Name:  "until",
+			Usage: "Select the records before a time, date or duration before now",
+		},
+		formatFlag,
+		templateFlag,
+	),
+}
+
+// journal records the writes and commits of the command, set up by
+// BeforeFunc if the configuration declares an audit journal
+var journal *murmur.Journal
+
+// setupJournal enables the audit journal of the configuration
+func setupJournal(ctx *cli.Context) {
+	url := config.Audit.URL
+	if config.Audit.URLEnv != "" {
+		url = os.Getenv(config.Audit.URLEnv)
+		if url == "" {
+			log.Warn("audit records are not sent: $" + config.Audit.URLEnv + " is not set")
+		}
+	}
+	if config.Audit.File == "" && url == "" {
+		return
+	}
+	journal = &murmur.Journal{
+		File:    config.Path(config.Audit.File),
+		URL:     url,
+		Command: commandName(ctx),
+		DataDir: ctx.String("datadir"),
+	}
+}
+
+// CloseJournal sends the records of the audit journal to its endpoint. It
+// does nothing if the journal is disabled.
+func CloseJournal() error {
+	if journal == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return journal.Close(ctx)
+}
+
+// queryAudit prints the records of the audit journal selected by the flags
+func queryAudit(ctx *cli.Context) error {
+	if _, err := formatTemplate(ctx); err != nil {
+		return murmur.Fail(murmur.PhaseConfig, "format", err)
+	}
+
+	file := ctx.String("file")
+	if file == "" {
+		file = config.Path(config.Audit.File)
+	}
+	if file == "" {
+		return murmur.Fail(murmur.PhaseConfig, "audit", errors.New("no journal: set --file or the file of the audit section of the config file"))
+	}
+
+	q := murmur.AuditQuery{Repo: ctx.String("repo"), Path: ctx.String("path"), Op: ctx.String("op")}
+	var err error
+	if q.Since, err = parseAuditTime(ctx.String("since")); err != nil {
+		return murmur.Fail(murmur.PhaseConfig, "since", err)
+	}
+	if q.Until, err = parseAuditTime(ctx.String("until")); err != nil {
+		return murmur.Fail(murmur.PhaseConfig, "until", err)
+	}
+
+	records, err := murmur.ReadJournal(murmur.ExpandHome(file), q)
+	if err != nil {
+		return murmur.Fail(murmur.PhaseConfig, "audit", err)
+	}
+
+	return printList(ctx, records, nil, "TIME\tOP\tREPO\tBRANCH\tPATH\tSHA256\tCOMMIT\tUSER\tDATADIR", func(r murmur.AuditRecord) []string {
+		p := r.Path
+		if p == "" {
+			p = strings.Join(r.Files, ",")
+		}
+		datadir := shortSHA(r.DataDirCommit)
+		if r.DataDirDirty {
+			datadir += "+"
+		}
+		return []string{r.Time.Local().Format(time.RFC3339), r.Op, r.Repo, r.Branch, p,
+			shortSHA(r.SHA256), shortSHA(r.Commit), r.User + "@" + r.Host, datadir}
+	})
+}
+
+// parseAuditTime parses an RFC 3339 time, a date, or a duration before now.
+// An empty string is the zero time.
+func parseAuditTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q: must be an RFC 3339 time, a date (2006-01-02) or a duration (24h)", s)
+}
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jswank/murmur/pkg/murmur"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+// config is loaded by Setup before the command line is parsed: the hierarchy
+// selection flags are generated from it. Errors are returned by BeforeFunc.
+var (
+	config    = murmur.DefaultConfig()
+	configErr error
+)
+
+// Commands are the murmur commands
+var Commands = []*cli.Command{
+	GenerateCommand,
+	ReposCommand,
+	JsonnetCommand,
+	PromoteCommand,
+	ServeCommand,
+	AuditCommand,
+	DriftCommand,
+}
+
+// Setup loads the configuration file from the raw commandline arguments, and
+// adds the hierarchy flags to the Commands. It is called once, before the
+// commandline is parsed.
+func Setup(args []string) {
+	config, configErr = loadConfig(args)
+	if configErr == nil {
+		if configErr = checkHierarchy(config, Commands); configErr != nil {
+			config = murmur.DefaultConfig()
+		}
+	}
+	addHierarchyFlags(Commands)
+}
+
+// checkHierarchy returns an error if a hierarchy level has the name of a flag
+// of any command, which the flag package would reject as redefined
+func checkHierarchy(c *murmur.Config, cmds []*cli.Command) error {
+	reserved := reservedFlags(cmds)
+	for _, level := range c.Hierarchy {
+		if reserved[level] {
+			return fmt.Errorf("invalid config file %s, hierarchy level %q conflicts with a flag", c.Filename, level)
+		}
+	}
+	return nil
+}
+
+// reservedFlags returns the names (and aliases) of the flags of the commands
+// and their subcommands, including the help flag
+func reservedFlags(cmds []*cli.Command) map[string]bool {
+	reserved := make(map[string]bool)
+	for _, name := range cli.HelpFlag.Names() {
+		reserved[name] = true
+	}
+	for _, cmd := range cmds {
+		for _, f := range cmd.Flags {
+			for _, name := range f.Names() {
+				reserved[name] = true
+			}
+		}
+		for name := range reservedFlags(cmd.Subcommands) {
+			reserved[name] = true
+		}
+	}
+	return reserved
+}
+
+// loadConfig reads the configuration file named by --config or $MURMUR_CONFIG.
+// If neither is set, murmur.json is read from the datadir (--datadir,
+// $DATADIR or '.') if it exists.  Otherwise the default configuration is used.
+func loadConfig(args []string) (*murmur.Config, error) {
+
+	filename := argValue(args, "config")
+	if filename == "" {
+		filename = os.Getenv("MURMUR_CONFIG")
+	}
+
+	if filename == "" {
+		datadir := argValue(args, "datadir")
+		if datadir == "" {
+			datadir = os.Getenv("DATADIR")
+		}
+		if datadir == "" {
+			datadir = "."
+		}
+		candidate := filepath.Join(datadir, murmur.ConfigFilename)
+		if _, err := os.Stat(candidate); err != nil {
+			return murmur.DefaultConfig(), nil
+		}
+		filename = candidate
+	}
+
+	c, err := murmur.NewConfigFromFile(filename)
+	if err != nil {
+		return murmur.DefaultConfig(), err
+	}
+	return c, nil
+}
+
+// argValue returns the value of a flag from raw commandline arguments, which
+// is needed before the arguments are parsed.
+func argValue(args []string, name string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		for _, prefix := range []string{"--" + name, "-" + name} {
+			if arg == prefix && i+1 < len(args) {
+				return args[i+1]
+			}
+			if strings.HasPrefix(arg, prefix+"=") {
+				return strings.TrimPrefix(arg, prefix+"=")
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jswank/murmur/pkg/murmur"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+func TestArgValue(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{name: "unset", args: []string{"generate", "--team", "ops"}},
+		{name: "separate value", args: []string{"generate", "--config", "a.json"}, want: "a.json"},
+		{name: "single dash", args: []string{"generate", "-config", "a.json"}, want: "a.json"},
+		{name: "equals", args: []string{"generate", "--config=a.json"}, want: "a.json"},
+		{name: "single dash equals", args: []string{"-config=a.json"}, want: "a.json"},
+		{name: "first wins", args: []string{"--config", "a.json", "--config", "b.json"}, want: "a.json"},
+		{name: "missing value", args: []string{"generate", "--config"}},
+		{name: "longer flag name", args: []string{"--config-file", "a.json", "--configs=b.json"}},
+		{name: "after --", args: []string{"jsonnet", "render", "--", "--config", "a.json"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := argValue(tt.args, "config"); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckHierarchy(t *testing.T) {
+	cmds := []*cli.Command{
+		{Name: "generate", Flags: []cli.Flag{&cli.StringFlag{Name: "datadir"}, &cli.BoolFlag{Name: "dry-run", Aliases: []string{"n"}}}},
+		{Name: "repos", Subcommands: []*cli.Command{
+			{Name: "status", Flags: []cli.Flag{&cli.BoolFlag{Name: "fetch"}}},
+		}},
+	}
+	tests := []struct {
+		name      string
+		hierarchy murmur.Hierarchy
+		wantErr   string
+	}{
+		{name: "default", hierarchy: murmur.DefaultHierarchy()},
+		{name: "custom", hierarchy: murmur.Hierarchy{"team", "app", "region", "env"}},
+		{name: "flag of a command", hierarchy: murmur.Hierarchy{"team", "datadir"}, wantErr: `hierarchy level "datadir" conflicts with a flag`},
+		{name: "alias", hierarchy: murmur.Hierarchy{"n", "env"}, wantErr: `"n" conflicts`},
+		{name: "flag of a subcommand", hierarchy: murmur.Hierarchy{"fetch"}, wantErr: `"fetch" conflicts`},
+		{name: "help flag", hierarchy: murmur.Hierarchy{"team", "help"}, wantErr: `"help" conflicts`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := murmur.DefaultConfig()
+			c.Filename, c.Hierarchy = "murmur.json", tt.hierarchy
+			err := checkHierarchy(c, cmds)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// every flag of the murmur commands is reserved
+	reserved := reservedFlags(Commands)
+	for _, name := range []string{"datadir", "filter", "config", "output", "h", "help", "commit-script", "max-depth", "webhook-branch"} {
+		if !reserved[name] {
+			t.Errorf("flag %q not reserved", name)
+		}
+	}
+	if err := checkHierarchy(&murmur.Config{Hierarchy: murmur.Hierarchy{"team", "output"}}, Commands); err == nil {
+		t.Error("level named after the output flag: no error")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	datadir, other := t.TempDir(), t.TempDir()
+	for dir, content := range map[string]string{
+		datadir: `{"hierarchy": ["team", "env"], "template_level": "team"}`,
+		other:   `{"hierarchy": ["app", "env"], "template_level": "app"}`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, murmur.ConfigFilename), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	invalid := filepath.Join(other, "invalid.json")
+	if err := os.WriteFile(invalid, []byte(`{"hierarchy": []`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		want    string // the hierarchy
+		wantErr string
+	}{
+		{name: "default", args: []string{"generate", "--datadir", t.TempDir()}, want: "team/app/env"},
+		{name: "datadir flag", args: []string{"generate", "--datadir", datadir}, want: "team/env"},
+		{name: "datadir variable", args: []string{"generate"}, env: map[string]string{"DATADIR": datadir}, want: "team/env"},
+		{name: "config flag", args: []string{"generate", "--datadir", datadir, "--config=" + filepath.Join(other, murmur.ConfigFilename)}, want: "app/env"},
+		{name: "config variable", args: []string{"generate", "--datadir", datadir}, env: map[string]string{"MURMUR_CONFIG": filepath.Join(other, murmur.ConfigFilename)}, want: "app/env"},
+		{name: "invalid", args: []string{"generate", "--config", invalid}, want: "team/app/env", wantErr: "unable to parse config file"},
+		{name: "missing", args: []string{"generate", "--config", filepath.Join(other, "missing.json")}, want: "team/app/env", wantErr: "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DATADIR", "")
+			t.Setenv("MURMUR_CONFIG", "")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			c, err := loadConfig(tt.args)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.Hierarchy.String(); got != tt.want {
+				t.Errorf("hierarchy %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
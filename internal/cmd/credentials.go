@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/jswank/murmur/pkg/murmur"
+)
+
+// auth authenticates the git commands run by murmur, created on first use
+var auth *murmur.GitAuth
+
+// gitAuth returns the authentication of git commands to the remotes of
+// targets, shared by all commands
+func gitAuth() *murmur.GitAuth {
+	if auth == nil {
+		auth = &murmur.GitAuth{Config: config, Logger: log}
+	}
+	return auth
+}
+
+// scrubHandler is a slog.Handler that scrubs the message and attributes of
+// records
+type scrubHandler struct {
+	slog.Handler
+}
+
+func (h scrubHandler) Handle(ctx context.Context, r slog.Record) error {
+	scrubbed := slog.NewRecord(r.Time, r.Level, murmur.Scrub(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		scrubbed.AddAttrs(scrubAttr(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, scrubbed)
+}
+
+func (h scrubHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	for i, a := range attrs {
+		attrs[i] = scrubAttr(a)
+	}
+	return scrubHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h scrubHandler) WithGroup(name string) slog.Handler {
+	return scrubHandler{h.Handler.WithGroup(name)}
+}
+
+func scrubAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString, slog.KindAny:
+		// other values keep their type unless they contain a secret
+		if s := v.String(); murmur.Scrub(s) != s {
+			return slog.String(a.Key, murmur.Scrub(s))
+		}
+	case slog.KindGroup:
+		attrs := v.Group()
+		scrubbed := make([]any, len(attrs))
+		for i, ga := range attrs {
+			scrubbed[i] = scrubAttr(ga)
+		}
+		return slog.Group(a.Key, scrubbed...)
+	}
+	return a
+}
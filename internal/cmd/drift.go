@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jswank/murmur/pkg/murmur"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+const driftDesc = `Report the managed files of clones that were changed since murmur wrote them.
+
+murmur records the SHA-256 of each file it writes, with its source and the
+commit of the datadir, in a manifest (.murmur-manifest.json) next to the
+files of each target. A file drifted if its content no longer matches its
+manifest entry (modified), or if it no longer exists (deleted).
+
+The clones in --repodir (directories named <name>:<branch>) are checked, or
+the clones given as arguments. Clone the repos again (repos clone
+--overwrite) to check the files on the remote branches.
+
+Specify --exit-code to exit with 1 if any file drifted. generate and repos
+write --refuse-drift fail the targets that would overwrite a modified file.
+`
+
+var DriftCommand = &cli.Command{
+	Name:            "drift",
+	Usage:           "report managed files changed since murmur wrote them",
+	UsageText:       "murmur drift [options] [clone_dirs...]",
+	HideHelpCommand: true,
+	Args:            true,
+	ArgsUsage:       "clone_dirs...",
+	Action:          reportDrift,
+	Description:     driftDesc,
+	Before:          BeforeFunc,
+	Flags: append(DefaultFlags,
+		repoDirFlag,
+		formatFlag,
+		templateFlag,
+		&cli.BoolFlag{
+			Name:  "exit-code",
+			Usage: "Exit with 1 if any file drifted",
+		},
+	),
+}
+
+// cloneDrift is a drifted file of a clone
+type cloneDrift struct {
+	Clone string `json:"clone"` // <name>:<branch>
+	Dir   string `json:"dir"`
+	murmur.Drift
+}
+
+// reportDrift prints the drifted files of the clones
+func reportDrift(ctx *cli.Context) error {
+	if _, err := formatTemplate(ctx); err != nil {
+		return murmur.Fail(murmur.PhaseConfig, "format", err)
+	}
+
+	dirs := ctx.Args().Slice()
+	if len(dirs) == 0 {
+		repoDir := ctx.String("repodir")
+		entries, err := os.ReadDir(dirOrCwd(repoDir))
+		if err != nil {
+			return murmur.Fail(murmur.PhaseConfig, "repodir", fmt.Errorf("unable to read repodir, %w", err))
+		}
+		for _, entry := range entries {
+			if entry.IsDir() && strings.Contains(entry.Name(), ":") {
+				dirs = append(dirs, filepath.Join(repoDir, entry.Name()))
+			}
+		}
+	}
+
+	drifts := []cloneDrift{}
+	for _, dir := range dirs {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err != nil {
+			log.Warn("not a clone, skipping", "dir", dir)
+			continue
+		}
+		found, err := murmur.FindDrift(dir)
+		if err != nil {
+			log.Error("unable to check drift", "dir", dir, "error", err)
+			if err = fail(murmur.PhaseGit, filepath.Base(dir), err); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, d := range found {
+			drifts = append(drifts, cloneDrift{Clone: filepath.Base(dir), Dir: dir, Drift: d})
+		}
+	}
+
+	err := printList(ctx, drifts, nil, "CLONE\tFILE\tSTATUS\tSOURCE\tDATADIR\tEXPECTED\tACTUAL", func(d cloneDrift) []string {
+		return []string{d.Clone, d.File, d.Status, d.Source, shortSHA(d.DataDirCommit), shortSHA(d.Expected), shortSHA(d.Actual)}
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := failures.Err(); err != nil {
+		return err
+	}
+	if ctx.Bool("exit-code") && len(drifts) > 0 {
+		return fmt.Errorf("%d file(s) drifted", len(drifts))
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package cmd
+
+import (
+	"github.com/jswank/murmur/pkg/murmur"
+)
+
+// failures collects the failures of a command. Commands record failures and
+// carry on, and return the failures at the end: main prints them grouped by
+// phase and exits with the code of the earliest phase that failed. The budget
+// (Max) is set by BeforeFunc from --max-failures, or 1 with --errexit.
+var failures = &murmur.Failures{}
+
+// fail records the failure of an item in a phase, and returns an error if the
+// command should stop
+func fail(phase murmur.Phase, item string, err error) error {
+	return failures.Add(murmur.Fail(phase, item, err))
+}
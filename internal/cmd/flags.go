@@ -2,12 +2,17 @@ package cmd
 
 // shared flags for all subcommands
 import (
+	"fmt"
 	"os"
+	"slices"
 
 	cli "github.com/urfave/cli/v2"
 )
 
-var DefaultFlags = []cli.Flag{
+// DefaultFlags is clipped so that commands appending their own flags do not
+// share a backing array. The hierarchy flags are added to the commands once
+// they are all defined (see addHierarchyFlags).
+var DefaultFlags = slices.Clip([]cli.Flag{
 	&cli.StringFlag{
 		Name:  "loglevel",
 		Usage: "Set the log level (debug, info, warn, error, fatal, panic)",
@@ -23,27 +28,56 @@ var DefaultFlags = []cli.Flag{
 		Usage: "Search path for files. Defaults to '.', can be set using $DATADIR",
 		Value: os.Getenv("DATADIR"),
 	},
-	&cli.StringFlag{
-		Name:  "team",
-		Usage: "Limit processing to team",
-		Value: "*",
-	},
-	&cli.StringFlag{
-		Name:  "app",
-		Usage: "Limit processing to app",
-		Value: "*",
-	},
-	&cli.StringFlag{
-		Name:  "env",
-		Usage: "Limit processing to env",
-		Value: "*",
-	},
-	&cli.StringFlag{
-		Name:  "filter",
-		Usage: "Limit processing based on a 'team/app/env' string. Overrides team, app, env flag.",
-	},
+	configFlag,
+	filterFlag,
 	&cli.BoolFlag{
 		Name:  "errexit",
-		Usage: "Exit on errors",
+		Usage: "Exit on the first failure",
 	},
+	&cli.IntFlag{
+		Name:  "max-failures",
+		Usage: "Stop after N failures, 0 for no limit. All failures are reported at exit.",
+	},
+	metricsFileFlag,
+	otlpEndpointFlag,
+})
+
+// filterFlag marks the commands that select targets by hierarchy: its usage
+// is set with their hierarchy flags
+var filterFlag = &cli.StringFlag{
+	Name: "filter",
+}
+
+// configFlag is only used for help output: the config file is read before the
+// commandline is parsed
+var configFlag = &cli.StringFlag{
+	Name:  "config",
+	Usage: "Configuration file. Defaults to $DATADIR/murmur.json, can be set using $MURMUR_CONFIG",
+	Value: os.Getenv("MURMUR_CONFIG"),
+}
+
+// addHierarchyFlags adds the hierarchy flags to the commands (and their
+// subcommands) with the default flags
+func addHierarchyFlags(cmds []*cli.Command) {
+	filterFlag.Usage = fmt.Sprintf("Limit processing based on a '%s' string. Overrides %s flags.", config.Hierarchy, config.Hierarchy)
+	for _, cmd := range cmds {
+		if slices.Contains(cmd.Flags, cli.Flag(filterFlag)) {
+			cmd.Flags = append(cmd.Flags, hierarchyFlags()...)
+		}
+		addHierarchyFlags(cmd.Subcommands)
+	}
+}
+
+// hierarchyFlags returns a selection flag for each configured hierarchy level,
+// i.e. --team, --app, --env
+func hierarchyFlags() []cli.Flag {
+	var flags []cli.Flag
+	for _, level := range config.Hierarchy {
+		flags = append(flags, &cli.StringFlag{
+			Name:  level,
+			Usage: fmt.Sprintf("Limit processing to %s", level),
+			Value: "*",
+		})
+	}
+	return flags
 }
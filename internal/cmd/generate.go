@@ -59,6 +59,12 @@ var GenerateCommand = &cli.Command{
 			Usage: "Commit message",
 			Value: "murmur commit",
 		},
+		strictFlag,
+		refuseDriftFlag,
+		noNotifyFlag,
+		sparseFlag,
+		retriesFlag,
+		retryDelayFlag,
 		&cli.StringFlag{
 			Name:  "jsonnet-args",
 			Usage: "Arguments to pass to the jsonnet application.",
@@ -69,12 +75,14 @@ var GenerateCommand = &cli.Command{
 			Usage:  "Delete the dest dir",
 			Hidden: true,
 		},
+		&cli.StringFlag{
+			Name:   "sourcedir",
+			Usage:  "The datadir of the sources, for the commit recorded in manifests",
+			Hidden: true,
+		},
 	),
 	Before: func(c *cli.Context) error {
 
-		// override to exit on error for this command
-		c.Set("errexit", "true")
-
 		// this will be set to true if the destdir is created later:
 		c.Set("delete-destdir", "false")
 
@@ -115,6 +123,7 @@ func GenerateFunc(c *cli.Context) error {
 	// commands use the rendered files: override datadir to point to the destdir
 	// so that these files are used.
 
+	c.Set("sourcedir", c.String("datadir"))
 	c.Set("datadir", c.String("destdir"))
 
 	// set filter to * to avoid filtering out any files in the destdir: filters
@@ -1,14 +1,15 @@
 package cmd
 
 import (
-	"bytes"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"text/template"
 
+	"github.com/jswank/murmur/pkg/murmur"
+
 	cli "github.com/urfave/cli/v2"
 )
 
@@ -23,13 +24,28 @@ The jsonnet application is invoked to render files.  The JSONNET_PATH variable
 should be set appropriately.  Commandline arguments can be passed to jsonnet
 using the 'jsonnet-args' flag.
 
+The hierarchy values of each file (i.e. TEAM, APP, ENV) and its path relative
+to the datadir (PATH) are passed to jsonnet as ext-vars, or top-level
+arguments, as set in the 'render' section of the configuration file. Variables
+from the 'var_files' found in the datadir and in each directory down to the
+file are passed as well; files in lower directories take precedence.
+
+Other kinds of source files are rendered by the renderer registered for their
+extension in the 'render.renderers' section of the configuration file: Go
+text/template files, JSON / YAML passthrough, or an external command. Sources
+of every registered extension are rendered, so an env directory may mix them.
+
 `
 
 const jsonnetCreateDesc = `Create a new Jsonnet file.
 
 App specific files located in $DATADIR/tmpl/<app>.jsonnet.tmpl are copied to the team/app/env directory specified.
 
-Variables that can be used in templates include TEAM, ENV, and APP.
+The directory levels are set by the 'hierarchy' in the configuration file, and
+the level used to choose the template by 'template_level' (default: app).
+
+Variables that can be used in templates are the upper-cased hierarchy levels,
+i.e. TEAM, ENV, and APP.
 
 `
 
@@ -48,7 +64,7 @@ var JsonnetCommand = &cli.Command{
 			Action:      createJsonnet,
 			Description: jsonnetCreateDesc,
 			Args:        true,
-			ArgsUsage:   "team/app/env",
+			ArgsUsage:   config.Hierarchy.String(),
 			Before:      BeforeFunc,
 			Flags: []cli.Flag{
 				&cli.StringFlag{
@@ -56,6 +72,7 @@ var JsonnetCommand = &cli.Command{
 					Usage: "Search path for files. Defaults to '.', can be set using $DATADIR",
 					Value: os.Getenv("DATADIR"),
 				},
+				configFlag,
 				&cli.StringFlag{
 					Name:  "loglevel",
 					Usage: "Set the log level (debug, info, warn, error, fatal, panic)",
@@ -67,7 +84,7 @@ var JsonnetCommand = &cli.Command{
 			Name:   "list",
 			Usage:  "list jsonnet files",
 			Action: listJsonnet,
-			Flags:  DefaultFlags,
+			Flags:  append(DefaultFlags, formatFlag, templateFlag),
 			Before: BeforeFunc,
 		},
 		{
@@ -93,54 +110,101 @@ var JsonnetCommand = &cli.Command{
 	},
 }
 
+// sourceListing is a source file, as listed by jsonnet list
+type sourceListing struct {
+	File        string            `json:"file"`
+	Source      string            `json:"source,omitempty"` // i.e. team/app/env
+	Selection   map[string]string `json:"selection,omitempty"`
+	TargetsFile string            `json:"targets_file,omitempty"` // rendered from the file
+}
+
+// listJsonnet prints the source files, with their hierarchy values and their
+// targets file
 func listJsonnet(ctx *cli.Context) error {
 
-	files, err := getFiles(ctx, ctx.String("datadir"), ".jsonnet")
-	if err != nil && ctx.Bool("errexit") {
+	if _, err := formatTemplate(ctx); err != nil {
+		return murmur.Fail(murmur.PhaseConfig, "format", err)
+	}
+
+	files, err := getFiles(ctx, ctx.String("datadir"), newRenderer(ctx).Extensions()...)
+	if err = fail(murmur.PhaseConfig, "files", err); err != nil {
 		return err
 	}
 
+	sources := []sourceListing{}
 	for _, file := range files {
-		fmt.Println(file)
+		src := config.Hierarchy.Source(ctx.String("datadir"), file)
+		s := sourceListing{File: file, TargetsFile: targetsFile(src)}
+		if src.Selection != nil {
+			s.Source, s.Selection = config.Hierarchy.Pattern(src.Selection), src.Selection
+		}
+		sources = append(sources, s)
 	}
 
-	return nil
+	text := func(s sourceListing) string { return s.File }
+	err = printList(ctx, sources, text, "FILE\tSOURCE\tTARGETS_FILE", func(s sourceListing) []string {
+		return []string{s.File, s.Source, s.TargetsFile}
+	})
+	if err != nil {
+		return err
+	}
+	return failures.Err()
+
+}
 
+// targetsFile returns the targets file rendered from a source file: the
+// targets file of the render index of its directory, or the targets file next
+// to it if it was not rendered in place. "" is returned if there is none.
+func targetsFile(src murmur.Source) string {
+	dir := filepath.Dir(src.File)
+	idx, _ := murmur.ReadRenderIndex(dir)
+	var names []string
+	for name, origin := range idx {
+		if strings.HasSuffix(name, "targets.json") && origin.Source == src.Path {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		matches, _ := filepath.Glob(filepath.Join(dir, "*targets.json"))
+		for _, m := range matches {
+			names = append(names, filepath.Base(m))
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	slices.Sort(names)
+	return filepath.Join(dir, names[0])
 }
 
 // create a jsonnet file from a simple template
 func createJsonnet(ctx *cli.Context) error {
 
-	var err error
-
 	// parse team/app/env from args
-	elem := strings.SplitN(ctx.Args().First(), "/", 3)
-	if len(elem) != 3 {
-		return fmt.Errorf("team/app/env must be specified")
-	}
-
-	input := map[string]string{
-		"TEAM": elem[0],
-		"APP":  elem[1],
-		"ENV":  elem[2],
+	sel, err := config.Hierarchy.Parse(ctx.Args().First())
+	if err != nil {
+		return fmt.Errorf("%s must be specified, %w", config.Hierarchy, err)
 	}
+	input := config.Hierarchy.Vars(sel)
+	tmplName := sel[config.TemplateLevel]
 
 	// parse template for app
-	log.Debug("parsing template", "file", filepath.Join(ctx.String("datadir"), "tmpl", input["APP"]+"jsonnet.tmpl"))
-	tmpl, err := template.ParseFiles(filepath.Join(ctx.String("datadir"), "tmpl", fmt.Sprintf("%s.jsonnet.tmpl", input["APP"])))
+	tmplFile := filepath.Join(ctx.String("datadir"), "tmpl", fmt.Sprintf("%s.jsonnet.tmpl", tmplName))
+	log.Debug("parsing template", "file", tmplFile)
+	tmpl, err := template.ParseFiles(tmplFile)
 	if err != nil {
 		return err
 	}
 
 	// create the directory structure
-	dir := filepath.Join(ctx.String("datadir"), input["TEAM"], input["APP"], input["ENV"])
+	dir := filepath.Join(append([]string{ctx.String("datadir")}, strings.Split(config.Hierarchy.Pattern(sel), "/")...)...)
 	if err = os.MkdirAll(dir, 0750); err != nil {
 		return err
 	}
 	log.Info("creating directory", "dir", dir)
 
 	// create the app.jsonnet file
-	dst := filepath.Join(dir, input["APP"]+".jsonnet")
+	dst := filepath.Join(dir, tmplName+".jsonnet")
 	log.Info("creating file", "file", dst)
 	f, err := os.Create(dst)
 	if err != nil {
@@ -157,47 +221,15 @@ func createJsonnet(ctx *cli.Context) error {
 // renderJsonnet renders files from the specified jsonnet files to destdir/
 func renderJsonnet(ctx *cli.Context) error {
 
-	files, err := getFiles(ctx, ctx.String("datadir"), ".jsonnet")
-	if err != nil && ctx.Bool("errexit") {
+	files, err := getFiles(ctx, ctx.String("datadir"), newRenderer(ctx).Extensions()...)
+	if err = fail(murmur.PhaseConfig, "files", err); err != nil {
 		return err
 	}
 
-	renderDir := ctx.String("destdir")
-	if renderDir == "" {
-		renderDir = "."
-	}
-	log.Debug("rendering jsonnet files", "files", files, "destdir", renderDir)
-
-	if ctx.String("jsonnet-args") == "-m" {
-		ctx.Set("jsonnet-args", "-m "+renderDir)
-	}
-	jsonnetArgs := strings.Fields(ctx.String("jsonnet-args"))
+	log.Debug("rendering source files", "files", files, "destdir", ctx.String("destdir"))
 
-	for _, file := range files {
-		log.Info("jsonnet", "file", file)
-		cmd := exec.Command("jsonnet", append(jsonnetArgs, filepath.Base(file))...)
-		cmd.Dir = filepath.Dir(file)
-
-		var stderr bytes.Buffer
-		cmd.Stderr = &stderr
-
-		// ignore stdout
-		// cmd.Stdout = os.Stdout
-		cmd.Stdout = nil
-
-		log.Info("jsonnet", "cmd", cmd.String(), "dir", cmd.Dir)
-
-		err = cmd.Run()
-		if err != nil {
-			if ctx.Bool("errexit") {
-				log.Error("jsonnet", "cmd", cmd.String(), "file", file, "msg", err, "stderr", stderr.String())
-				err = fmt.Errorf("error processing file %s", file)
-				return err
-			} else {
-				log.Warn("jsonnet", "cmd", cmd.String(), "file", file, "msg", err, "stderr", stderr.String())
-			}
-		}
+	if err = newPipeline(ctx).Render(ctx.Context, files); err != nil {
+		return err
 	}
-
-	return nil
+	return failures.Err()
 }
@@ -16,13 +16,14 @@ func createLogger(lvl, output_type string) (*slog.Logger, error) {
 		return nil, fmt.Errorf("invalid log level, %w", err)
 	}
 
+	// secrets are scrubbed from all records
 	if output_type == "json" {
-		return slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
+		return slog.New(scrubHandler{slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{
 			Level: level,
-		})), nil
+		})}), nil
 	}
 
-	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+	return slog.New(scrubHandler{slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
 		Level: level,
 		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
 			if a.Key == slog.TimeKey {
@@ -30,5 +31,5 @@ func createLogger(lvl, output_type string) (*slog.Logger, error) {
 			}
 			return a
 		},
-	})), nil
+	})}), nil
 }
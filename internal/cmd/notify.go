@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/jswank/murmur/pkg/murmur"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+// noNotifyFlag disables the notifications of the commands that publish
+var noNotifyFlag = &cli.BoolFlag{
+	Name:  "no-notify",
+	Usage: "Do not send the summary of the run to the notification sinks of the config file",
+}
+
+// notifier collects the outcome of a command that publishes repos, set up by
+// BeforeFunc if the configuration declares notification sinks
+var notifier *murmur.Notifier
+
+// setupNotifications enables notifications for generate --commit and repos
+// commit
+func setupNotifications(ctx *cli.Context) {
+	if len(config.Notifications) == 0 || ctx.Bool("no-notify") {
+		return
+	}
+	switch commandName(ctx) {
+	case "generate":
+		if !ctx.Bool("commit") {
+			return
+		}
+	case "repos commit":
+	default:
+		return
+	}
+	notifier = &murmur.Notifier{Config: config, DataDir: ctx.String("datadir")}
+}
+
+// Notify sends the summary of the command run, which ended with err, to the
+// notification sinks. It does nothing if notifications are disabled.
+func Notify(err error) error {
+	if notifier == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return notifier.Notify(ctx, strings.TrimPrefix(telemetry.command, "murmur "), telemetry.start, err)
+}
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+
+	cli "github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// formatFlag selects the output format of the commands that list or report
+var formatFlag = &cli.StringFlag{
+	Name:  "format",
+	Usage: "Output format: text, table, json, yaml or template (see --template)",
+	Value: "text",
+}
+
+// templateFlag is the Go template of --format template
+var templateFlag = &cli.StringFlag{
+	Name:  "template",
+	Usage: "Go template applied to each item with --format template, i.e. '{{.Repo}}:{{.Branch}}'",
+}
+
+// formatTemplate validates --format, and returns the template of --format
+// template, nil for the other formats
+func formatTemplate(ctx *cli.Context) (*template.Template, error) {
+	switch ctx.String("format") {
+	case "text", "table", "json", "yaml":
+		return nil, nil
+	case "template":
+	default:
+		return nil, fmt.Errorf("invalid format %q: must be text, table, json, yaml or template", ctx.String("format"))
+	}
+	if ctx.String("template") == "" {
+		return nil, fmt.Errorf("--format template requires --template")
+	}
+	return template.New("item").Funcs(template.FuncMap{
+		"join": strings.Join,
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(ctx.String("template"))
+}
+
+// printList prints items in the format of --format: the line of text of each
+// item (the table if text is nil), a table of the header and a row for each
+// item, JSON, YAML, or the template of --template executed for each item, one
+// per line
+func printList[T any](ctx *cli.Context, items []T, text func(T) string, header string, row func(T) []string) error {
+	tmpl, err := formatTemplate(ctx)
+	if err != nil {
+		return err
+	}
+	if items == nil {
+		items = []T{}
+	}
+
+	switch ctx.String("format") {
+	case "text":
+		if text == nil {
+			break
+		}
+		for _, item := range items {
+			fmt.Println(text(item))
+		}
+		return nil
+	case "json":
+		return printJSON(items)
+	case "yaml":
+		return printYAML(items)
+	case "template":
+		for _, item := range items {
+			if err = tmpl.Execute(os.Stdout, item); err != nil {
+				return err
+			}
+			fmt.Println()
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	for _, item := range items {
+		fmt.Fprintln(w, strings.Join(row(item), "\t"))
+	}
+	return w.Flush()
+}
+
+// printYAML prints v as YAML, with the field names and order of its JSON
+// encoding
+func printYAML(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// JSON is YAML: decoding it into a node keeps the order of the fields
+	var node yaml.Node
+	if err = yaml.Unmarshal(b, &node); err != nil {
+		return err
+	}
+	blockStyle(&node)
+
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err = enc.Encode(&node); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// blockStyle resets the flow and quoting styles of the JSON a node was
+// decoded from
+func blockStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		blockStyle(c)
+	}
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"flag"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+// formatContext returns a context with the --format and --template flags set
+func formatContext(format, tmpl string) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("format", format, "")
+	set.String("template", tmpl, "")
+	return cli.NewContext(nil, set, nil)
+}
+
+// captureStdout returns what f prints to stdout
+func captureStdout(t *testing.T, f func() error) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	err = f()
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestPrintList(t *testing.T) {
+	type item struct {
+		Repo   string `json:"repo"`
+		Branch string `json:"branch"`
+	}
+	items := []item{{"o/x", "main"}, {"o/longer", "dev"}}
+	text := func(i item) string { return i.Repo + ":" + i.Branch }
+	row := func(i item) []string { return []string{i.Repo, i.Branch} }
+
+	tests := []struct {
+		name   string
+		format string
+		tmpl   string
+		text   func(item) string
+		items  []item
+		want   string
+	}{
+		{name: "text", format: "text", text: text, items: items, want: "o/x:main\no/longer:dev\n"},
+		{name: "text without lines is the table", format: "text", items: items, want: "REPO      BRANCH\no/x       main\no/longer  dev\n"},
+		{name: "table", format: "table", text: text, items: items, want: "REPO      BRANCH\no/x       main\no/longer  dev\n"},
+		{name: "json", format: "json", items: items, want: "[\n  {\n    \"repo\": \"o/x\",\n    \"branch\": \"main\"\n  },\n  {\n    \"repo\": \"o/longer\",\n    \"branch\": \"dev\"\n  }\n]\n"},
+		{name: "json of nothing", format: "json", want: "[]\n"},
+		{name: "yaml", format: "yaml", items: items[:1], want: "- repo: o/x\n  branch: main\n"},
+		{name: "template", format: "template", tmpl: "{{.Branch}} {{json .}}", items: items[:1], want: "main {\"repo\":\"o/x\",\"branch\":\"main\"}\n"},
+		{name: "text of nothing", format: "text", text: text},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := captureStdout(t, func() error {
+				return printList(formatContext(tt.format, tt.tmpl), tt.items, tt.text, "REPO\tBRANCH", row)
+			})
+			if out != tt.want {
+				t.Errorf("got %q, want %q", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatTemplate(t *testing.T) {
+	tests := []struct {
+		format, tmpl string
+		err          string // a substring of the error, "" for none
+	}{
+		{format: "text"},
+		{format: "table"},
+		{format: "json"},
+		{format: "yaml"},
+		{format: "template", tmpl: "{{.Repo}}"},
+		{format: "csv", err: `invalid format "csv": must be text, table, json, yaml or template`},
+		{format: "template", err: "--format template requires --template"},
+		{format: "template", tmpl: "{{.Repo", err: "unclosed action"},
+	}
+	for _, tt := range tests {
+		_, err := formatTemplate(formatContext(tt.format, tt.tmpl))
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s %q: unexpected error %v", tt.format, tt.tmpl, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s %q: error %v, want %q", tt.format, tt.tmpl, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"strings"
+
+	"github.com/jswank/murmur/pkg/murmur"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+// newRenderer returns the renderers of the configuration, with the command
+// line flags
+func newRenderer(ctx *cli.Context) murmur.RendererRegistry {
+	return murmur.NewRendererRegistry(config, murmur.RenderOptions{
+		DataDir:     ctx.String("datadir"),
+		OutDir:      ctx.String("destdir"),
+		JsonnetArgs: strings.Fields(ctx.String("jsonnet-args")),
+		Logger:      log,
+	})
+}
+
+// newWriter returns the writer of the command line flags
+func newWriter(ctx *cli.Context) *murmur.GitWriter {
+	return &murmur.GitWriter{
+		Config:    config,
+		RepoDir:   ctx.String("repodir"),
+		DataDir:   ctx.String("datadir"),
+		Overwrite: ctx.Bool("overwrite"),
+		Sparse:    ctx.Bool("sparse"),
+		Retry:     retryOptions(ctx),
+		Auth:      gitAuth(),
+		Observer:  observer(),
+		Logger:    log,
+
+		SourceDir:   ctx.String("sourcedir"),
+		RefuseDrift: ctx.Bool("refuse-drift"),
+	}
+}
+
+// newPublisher returns the publisher of the command line flags
+func newPublisher(ctx *cli.Context) *murmur.GitPublisher {
+	return &murmur.GitPublisher{
+		Config:       config,
+		RepoDir:      ctx.String("repodir"),
+		DataDir:      ctx.String("datadir"),
+		CommitMsg:    ctx.String("commit-msg"),
+		CommitScript: ctx.String("commit-script"),
+		Strict:       ctx.Bool("strict"),
+		Retry:        retryOptions(ctx),
+		Auth:         gitAuth(),
+		Writer:       newWriter(ctx),
+		Observer:     observer(),
+		Logger:       log,
+	}
+}
+
+// newPipeline returns a pipeline of the components of the command line flags.
+// Its failures are collected with those of the command.
+func newPipeline(ctx *cli.Context) *murmur.Pipeline {
+	return &murmur.Pipeline{
+		Config:    config,
+		Renderer:  newRenderer(ctx),
+		Writer:    newWriter(ctx),
+		Publisher: newPublisher(ctx),
+		Observer:  observer(),
+		Options: murmur.PipelineOptions{
+			DataDir:  ctx.String("datadir"),
+			Failures: failures,
+			Logger:   log,
+		},
+	}
+}
+
+// loadTargets reads target files, applying the branch overrides of the
+// command line. Files that cannot be read are recorded as failures and
+// skipped: an error is only returned if the command should stop.
+func loadTargets(ctx *cli.Context, files []string) ([]murmur.Target, error) {
+	loader := murmur.FileTargetLoader{
+		Files:           files,
+		BranchOverrides: ctx.StringSlice("override-branch"),
+		Logger:          log,
+	}
+	targets, err := loader.LoadTargets(ctx.Context)
+	return targets, fail(murmur.PhaseConfig, "targets", err)
+}
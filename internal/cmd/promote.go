@@ -0,0 +1,612 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/jswank/murmur/pkg/murmur"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+const promoteDesc = `Promote the sources of an env directory to another env.
+
+The sources (jsonnet, variable and target files) of <team/app/from-env> are
+compared with the <to-env> directory of the same team/app.  The differences
+between the sources are printed, followed by the differences between the
+rendered output of <to-env> as it is and as it would be after promotion.
+Specify --apply to write the changes to <to-env>.
+
+Files and fields that are specific to an env are not promoted.  These rules are
+set in the 'promote' section of the configuration file:
+
+  - files matching 'env_specific_files' are left untouched
+  - JSON files matching a key of 'env_specific_fields' keep the value of the
+    listed fields from <to-env>. By default 'branch' and 'path' are kept in
+    *targets.json files.
+  - jsonnet lines containing the 'env_specific_marker' comment (by default
+    'murmur:env-specific'), in <from-env> or <to-env>, keep the line with the
+    same key in <to-env>
+
+The last level of the hierarchy is the env.
+`
+
+var PromoteCommand = &cli.Command{
+	Name:            "promote",
+	Usage:           "promote an env directory to another env",
+	UsageText:       "murmur promote [options] " + config.Hierarchy.String() + " to-" + config.Hierarchy[len(config.Hierarchy)-1],
+	HideHelpCommand: true,
+	Args:            true,
+	ArgsUsage:       config.Hierarchy.String() + " to-" + config.Hierarchy[len(config.Hierarchy)-1],
+	Action:          promoteEnv,
+	Description:     promoteDesc,
+	Before:          BeforeFunc,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "loglevel",
+			Usage: "Set the log level (debug, info, warn, error, fatal, panic)",
+			Value: "error",
+		},
+		&cli.StringFlag{
+			Name:  "output",
+			Usage: "Set the (log) output to 'json' or 'text'",
+			Value: "text",
+		},
+		&cli.StringFlag{
+			Name:  "datadir",
+			Usage: "Search path for files. Defaults to '.', can be set using $DATADIR",
+			Value: os.Getenv("DATADIR"),
+		},
+		configFlag,
+		&cli.StringFlag{
+			Name:  "jsonnet-args",
+			Usage: "Arguments to pass to the jsonnet application.",
+			Value: "-m",
+		},
+		&cli.BoolFlag{
+			Name:  "apply",
+			Usage: "Write the promoted sources to the destination env",
+		},
+		&cli.BoolFlag{
+			Name:  "delete",
+			Usage: "Delete files that only exist in the destination env",
+		},
+	},
+}
+
+// promoteChange is a single file change made by a promotion
+type promoteChange struct {
+	rel    string // path relative to the env directory
+	action string // add, update, delete
+}
+
+// promoteEnv compares, renders and (optionally) promotes an env directory
+func promoteEnv(ctx *cli.Context) error {
+
+	envLevel := config.Hierarchy[len(config.Hierarchy)-1]
+
+	if ctx.NArg() != 2 {
+		return fmt.Errorf("%s and to-%s must be specified", config.Hierarchy, envLevel)
+	}
+
+	sel, err := config.Hierarchy.Parse(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	toEnv := ctx.Args().Get(1)
+	if toEnv == "" || toEnv == "." || toEnv == ".." || strings.ContainsAny(toEnv, `/\*`) {
+		return fmt.Errorf("invalid %s %q", envLevel, toEnv)
+	}
+	if toEnv == sel[envLevel] {
+		return fmt.Errorf("cannot promote %s %q to itself", envLevel, toEnv)
+	}
+
+	fromDir := filepath.Join(ctx.String("datadir"), filepath.FromSlash(config.Hierarchy.Pattern(sel)))
+	parentDir := filepath.Dir(fromDir)
+	toDir := filepath.Join(parentDir, toEnv)
+
+	for _, dir := range []string{fromDir, toDir} {
+		if _, err := os.Stat(dir); err != nil {
+			return fmt.Errorf("unable to read env directory, %w", err)
+		}
+	}
+
+	// the promoted sources are staged next to the destination so that
+	// relative imports resolve the same way when they are rendered
+	stageName := "." + toEnv + ".promote"
+	stageDir := filepath.Join(parentDir, stageName)
+	if err = os.RemoveAll(stageDir); err != nil {
+		return err
+	}
+	defer os.RemoveAll(stageDir)
+
+	log.Info("staging promotion", "from", fromDir, "to", toDir, "stage", stageDir)
+	if err = copyDir(toDir, stageDir); err != nil {
+		return fmt.Errorf("unable to stage promotion, %w", err)
+	}
+
+	changes, err := stagePromotion(fromDir, toDir, stageDir, ctx.Bool("delete"))
+	if err != nil {
+		return fmt.Errorf("unable to stage promotion, %w", err)
+	}
+
+	if len(changes) == 0 {
+		fmt.Printf("%s is up to date with %s\n", toDir, fromDir)
+		return nil
+	}
+
+	fmt.Println("# source changes")
+	for _, c := range changes {
+		fmt.Printf("%s %s\n", c.action, filepath.Join(toDir, c.rel))
+	}
+	fmt.Println()
+	if err = printDiff(parentDir, toEnv, stageName); err != nil {
+		return err
+	}
+
+	// render the destination env before and after promotion
+	renderDir, err := os.MkdirTemp("", "murmur-promote")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(renderDir)
+
+	jsonnetArgs := strings.Fields(ctx.String("jsonnet-args"))
+	current := filepath.Join(renderDir, toEnv)
+	promoted := filepath.Join(renderDir, toEnv+".promoted")
+	toSel := maps.Clone(sel)
+	toSel[envLevel] = toEnv
+	if err = renderEnvDir(ctx, ctx.String("datadir"), toDir, toDir, current, jsonnetArgs, toSel); err != nil {
+		return err
+	}
+	if err = renderEnvDir(ctx, ctx.String("datadir"), stageDir, toDir, promoted, jsonnetArgs, toSel); err != nil {
+		return err
+	}
+
+	fmt.Println("\n# rendered changes")
+	if err = printDiff(renderDir, toEnv, toEnv+".promoted"); err != nil {
+		return err
+	}
+
+	if !ctx.Bool("apply") {
+		log.Info("not applying promotion: specify --apply to write changes", "to", toDir)
+		return nil
+	}
+
+	for _, c := range changes {
+		dst := filepath.Join(toDir, c.rel)
+		log.Info("promoting file", "action", c.action, "file", dst)
+		if c.action == "delete" {
+			if err = os.Remove(dst); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+			return err
+		}
+		if err = copyFile(filepath.Join(stageDir, c.rel), dst); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// stagePromotion writes the promoted sources from fromDir into stageDir, which
+// holds a copy of toDir, and returns the changes that were made
+func stagePromotion(fromDir, toDir, stageDir string, deleteExtra bool) ([]promoteChange, error) {
+
+	var changes []promoteChange
+
+	fromFiles, err := relFiles(fromDir)
+	if err != nil {
+		return nil, err
+	}
+	toFiles, err := relFiles(toDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for rel := range fromFiles {
+		if envSpecificFile(rel) {
+			log.Info("skipping env-specific file", "file", rel)
+			continue
+		}
+
+		src, err := os.ReadFile(filepath.Join(fromDir, rel))
+		if err != nil {
+			return nil, err
+		}
+
+		action := "add"
+		if toFiles[rel] {
+			action = "update"
+			dst, err := os.ReadFile(filepath.Join(toDir, rel))
+			if err != nil {
+				return nil, err
+			}
+			src, err = keepEnvSpecific(rel, src, dst)
+			if err != nil {
+				return nil, err
+			}
+			if bytes.Equal(src, dst) {
+				continue
+			}
+		}
+
+		stageFile := filepath.Join(stageDir, rel)
+		if err = os.MkdirAll(filepath.Dir(stageFile), 0750); err != nil {
+			return nil, err
+		}
+		if err = os.WriteFile(stageFile, src, 0644); err != nil {
+			return nil, err
+		}
+		changes = append(changes, promoteChange{rel: rel, action: action})
+	}
+
+	for rel := range toFiles {
+		if fromFiles[rel] || envSpecificFile(rel) {
+			continue
+		}
+		if !deleteExtra {
+			log.Warn("file only exists in the destination env: specify --delete to remove it", "file", filepath.Join(toDir, rel))
+			continue
+		}
+		if err = os.Remove(filepath.Join(stageDir, rel)); err != nil {
+			return nil, err
+		}
+		changes = append(changes, promoteChange{rel: rel, action: "delete"})
+	}
+
+	slices.SortFunc(changes, func(a, b promoteChange) int {
+		return strings.Compare(a.rel, b.rel)
+	})
+
+	return changes, nil
+}
+
+// envSpecificFile reports whether a file matches the env_specific_files rules
+func envSpecificFile(rel string) bool {
+	return matchesAny(config.Promote.EnvSpecificFiles, rel)
+}
+
+// matchesAny reports whether the relative path, or its base name, matches any
+// of the patterns
+func matchesAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		for _, name := range []string{filepath.ToSlash(rel), filepath.Base(rel)} {
+			if ok, _ := filepath.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keepEnvSpecific returns the promoted content of a file, retaining the
+// env-specific fields and lines of the destination
+func keepEnvSpecific(rel string, src, dst []byte) ([]byte, error) {
+
+	var fields []string
+	for pattern, f := range config.Promote.EnvSpecificFields {
+		if matchesAny([]string{pattern}, rel) {
+			fields = append(fields, f...)
+		}
+	}
+	if len(fields) > 0 && filepath.Ext(rel) == ".json" {
+		return keepJSONFields(src, dst, fields)
+	}
+
+	switch filepath.Ext(rel) {
+	case ".jsonnet", ".libsonnet":
+		return keepMarkedLines(src, dst, config.Promote.EnvSpecificMarker)
+	}
+
+	return src, nil
+}
+
+// keepJSONFields copies fields from the destination document into the source
+// document. Fields are looked up in a top-level object, or in each object of a
+// top-level array (matched by index). Only the values that differ are
+// replaced, with their text in the destination, so that the formatting, the
+// order of the keys and the numbers of the source are preserved.
+func keepJSONFields(src, dst []byte, fields []string) ([]byte, error) {
+	srcObjs, err := jsonObjects(src)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse promoted file, %w", err)
+	}
+	dstObjs, err := jsonObjects(dst)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse destination file, %w", err)
+	}
+	if len(srcObjs) != len(dstObjs) {
+		log.Warn("promoted and destination arrays differ in length: env-specific fields are kept by index", "fields", fields)
+	}
+
+	var patches []jsonPatch
+	for i, so := range srcObjs {
+		if i >= len(dstObjs) || so == nil || dstObjs[i] == nil {
+			continue
+		}
+		do := dstObjs[i]
+		for _, f := range fields {
+			dspan, ok := do.values[f]
+			if !ok {
+				continue
+			}
+			value := string(dst[dspan[0]:dspan[1]])
+			sspan, ok := so.values[f]
+			switch {
+			case !ok:
+				// the field is added after the last field of the object
+				key, _ := json.Marshal(f)
+				text := string(key) + so.sep + value
+				if len(so.values) > 0 {
+					text = "," + so.indent + text
+				}
+				patches = append(patches, jsonPatch{so.end, so.end, text})
+			case !murmur.SameJSON(src[sspan[0]:sspan[1]], []byte(value)):
+				patches = append(patches, jsonPatch{sspan[0], sspan[1], value})
+			}
+		}
+	}
+	if len(patches) == 0 {
+		return src, nil
+	}
+
+	slices.SortStableFunc(patches, func(a, b jsonPatch) int { return a.start - b.start })
+	var out bytes.Buffer
+	pos := 0
+	for _, p := range patches {
+		out.Write(src[pos:p.start])
+		out.WriteString(p.text)
+		pos = p.end
+	}
+	out.Write(src[pos:])
+	return out.Bytes(), nil
+}
+
+// jsonPatch replaces the bytes start:end of a document with text
+type jsonPatch struct {
+	start, end int
+	text       string
+}
+
+// jsonObject locates the fields of an object in a JSON document
+type jsonObject struct {
+	values map[string][2]int // the offsets of the value of each field
+	indent string            // the whitespace before the last field
+	sep    string            // the text between the last key and its value
+	end    int               // the offset after the last value, or after '{'
+}
+
+// jsonObjects locates the top-level object of a document, or the objects of a
+// top-level array: nil for the elements that are not objects
+func jsonObjects(doc []byte) ([]*jsonObject, error) {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		o, err := scanObject(dec, doc)
+		return []*jsonObject{o}, err
+	case json.Delim('['):
+		var objs []*jsonObject
+		for dec.More() {
+			var o *jsonObject
+			if bytes.HasPrefix(doc[skipSpace(doc, int(dec.InputOffset()), ","):], []byte("{")) {
+				if _, err = dec.Token(); err != nil {
+					return nil, err
+				}
+				if o, err = scanObject(dec, doc); err != nil {
+					return nil, err
+				}
+			} else {
+				var skip json.RawMessage
+				if err = dec.Decode(&skip); err != nil {
+					return nil, err
+				}
+			}
+			objs = append(objs, o)
+		}
+		return objs, nil
+	}
+	return nil, nil
+}
+
+// scanObject locates the fields of the object whose '{' was just read
+func scanObject(dec *json.Decoder, doc []byte) (*jsonObject, error) {
+	o := &jsonObject{values: make(map[string][2]int), sep: ": ", end: int(dec.InputOffset())}
+	for dec.More() {
+		keyStart := skipSpace(doc, int(dec.InputOffset()), ",")
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		keyEnd := int(dec.InputOffset())
+		var value json.RawMessage
+		if err = dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		end := int(dec.InputOffset())
+		start := end - len(value)
+
+		indent := keyStart
+		for indent > 0 && strings.ContainsRune(" \t\r\n", rune(doc[indent-1])) {
+			indent--
+		}
+		o.values[tok.(string)] = [2]int{start, end}
+		o.indent, o.sep, o.end = string(doc[indent:keyStart]), string(doc[keyEnd:start]), end
+	}
+	_, err := dec.Token() // '}'
+	return o, err
+}
+
+// skipSpace returns the offset of the first byte from i that is neither
+// whitespace nor one of the extra bytes
+func skipSpace(doc []byte, i int, extra string) int {
+	for i < len(doc) && strings.ContainsRune(" \t\r\n"+extra, rune(doc[i])) {
+		i++
+	}
+	return i
+}
+
+// keepMarkedLines replaces the lines of the source with the lines of the
+// destination that have the same key (the text before the first ':' or '='),
+// when either line carries the marker. A key that occurs several times is
+// matched by occurrence: the second 'replicas' line of the source is replaced
+// by the second 'replicas' line of the destination. A marked line of the
+// source with no line in the destination is an error, as its value would be
+// promoted as it is.
+func keepMarkedLines(src, dst []byte, marker string) ([]byte, error) {
+	if marker == "" || !bytes.Contains(dst, []byte(marker)) && !bytes.Contains(src, []byte(marker)) {
+		return src, nil
+	}
+
+	type occurrence struct {
+		key string
+		n   int
+	}
+	dstLines := make(map[occurrence]string)
+	seen := make(map[string]int)
+	for _, line := range strings.Split(string(dst), "\n") {
+		k := lineKey(line)
+		dstLines[occurrence{k, seen[k]}] = line
+		seen[k]++
+	}
+
+	clear(seen)
+	lines := strings.Split(string(src), "\n")
+	for i, line := range lines {
+		k := lineKey(line)
+		o := occurrence{k, seen[k]}
+		seen[k]++
+		d, ok := dstLines[o]
+		switch {
+		case ok && (strings.Contains(d, marker) || strings.Contains(line, marker)):
+			lines[i] = d
+		case !ok && strings.Contains(line, marker):
+			return nil, fmt.Errorf("line %d is marked %q but has no counterpart in the destination: add %q there first", i+1, marker, k)
+		}
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// lineKey returns the key of a jsonnet line, i.e. 'replicas' for
+// '  replicas: 3,  // murmur:env-specific'
+func lineKey(line string) string {
+	if i := strings.IndexAny(line, ":="); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(line)
+}
+
+// relFiles returns the set of files below a directory, relative to it. Hidden
+// files and directories are ignored.
+func relFiles(dir string) (map[string]bool, error) {
+	files := make(map[string]bool)
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[rel] = true
+		return nil
+	})
+	return files, err
+}
+
+// copyDir copies the regular files of src to dst, creating directories as
+// needed
+func copyDir(src, dst string) error {
+	files, err := relFiles(src)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dst, 0750); err != nil {
+		return err
+	}
+	for rel := range files {
+		if err = os.MkdirAll(filepath.Dir(filepath.Join(dst, rel)), 0750); err != nil {
+			return err
+		}
+		if err = copyFile(filepath.Join(src, rel), filepath.Join(dst, rel)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renderEnvDir renders the source files found in dir into outDir. Variables
+// are injected as if the files were located in envDir.
+func renderEnvDir(ctx *cli.Context, datadir, dir, envDir, outDir string, jsonnetArgs []string, sel murmur.Selection) error {
+	if err := os.MkdirAll(outDir, 0750); err != nil {
+		return err
+	}
+
+	// as with `jsonnet render`, a trailing -m is completed with the output
+	// directory
+	renderer := murmur.NewRendererRegistry(config, murmur.RenderOptions{
+		DataDir:     datadir,
+		OutDir:      outDir,
+		JsonnetArgs: jsonnetArgs,
+		Logger:      log,
+	})
+
+	files, err := murmur.FindFiles(dir, renderer.Extensions()...)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		rel, _ := filepath.Rel(dir, file)
+		src := config.Hierarchy.Source(datadir, filepath.Join(envDir, rel))
+		src.File, src.Selection = file, sel
+		if _, err = renderer.Render(ctx.Context, src); err != nil {
+			log.Error("render", "file", file, "msg", err)
+			return fmt.Errorf("error processing file %s", file)
+		}
+	}
+	return nil
+}
+
+// printDiff prints a unified diff of two paths, relative to dir, to stdout
+func printDiff(dir, a, b string) error {
+	cmd := exec.Command("git", "diff", "--no-index", "--no-color", a, b)
+	cmd.Dir = dir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+
+	// git diff exits 1 if there are differences
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to diff %s and %s, %w", a, b, err)
+	}
+	return nil
+}
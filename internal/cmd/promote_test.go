@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeepJSONFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst string
+		want     string
+	}{
+		{
+			name: "unchanged",
+			src:  "{\n    \"repo\": \"o/x\",\n    \"branch\": \"main\"\n}\n",
+			dst:  `{"branch":"main"}`,
+			want: "{\n    \"repo\": \"o/x\",\n    \"branch\": \"main\"\n}\n",
+		},
+		{
+			name: "value replaced in place",
+			src:  "{\n    \"replicas\": 12345678901234567890,\n    \"branch\": \"staging\",\n    \"a\": 1\n}\n",
+			dst:  "{\"branch\":   \"prod\"}",
+			want: "{\n    \"replicas\": 12345678901234567890,\n    \"branch\": \"prod\",\n    \"a\": 1\n}\n",
+		},
+		{
+			name: "equal numbers are not replaced",
+			src:  `{"branch": 1.0}`,
+			dst:  `{"branch": 1}`,
+			want: `{"branch": 1.0}`,
+		},
+		{
+			name: "missing field added",
+			src:  "{\n  \"repo\": \"o/x\"\n}",
+			dst:  `{"path": "prod"}`,
+			want: "{\n  \"repo\": \"o/x\",\n  \"path\": \"prod\"\n}",
+		},
+		{
+			name: "missing field added to an empty object",
+			src:  `{}`,
+			dst:  `{"path": "prod"}`,
+			want: `{"path": "prod"}`,
+		},
+		{
+			name: "array matched by index",
+			src:  "[\n  {\"repo\": \"a\", \"branch\": \"dev\"},\n  \"x\",\n  {\"repo\": \"b\", \"branch\": \"dev\"}\n]",
+			dst:  `[{"branch": "prod"}, {"branch": "other"}, {"branch": "prod", "path": "p"}]`,
+			want: "[\n  {\"repo\": \"a\", \"branch\": \"prod\"},\n  \"x\",\n  {\"repo\": \"b\", \"branch\": \"prod\", \"path\": \"p\"}\n]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := keepJSONFields([]byte(tt.src), []byte(tt.dst), []string{"branch", "path"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := keepJSONFields([]byte(`{`), []byte(`{}`), []string{"path"}); err == nil {
+		t.Error("invalid JSON: no error")
+	}
+}
+
+func TestKeepMarkedLines(t *testing.T) {
+	const marker = "murmur:env-specific"
+	tests := []struct {
+		name     string
+		src, dst string
+		want     string
+		wantErr  string
+	}{
+		{
+			name: "marked in both",
+			src:  "{\n  replicas: 1,  // murmur:env-specific\n  image: 'v2',\n}",
+			dst:  "{\n  replicas: 5,  // murmur:env-specific\n  image: 'v1',\n}",
+			want: "{\n  replicas: 5,  // murmur:env-specific\n  image: 'v2',\n}",
+		},
+		{
+			name: "only marked in the destination",
+			src:  "{\n  replicas: 1,\n  image: 'v2',\n}",
+			dst:  "{\n  replicas: 5,  // murmur:env-specific\n  image: 'v1',\n}",
+			want: "{\n  replicas: 5,  // murmur:env-specific\n  image: 'v2',\n}",
+		},
+		{
+			name: "only marked in the source",
+			src:  "{\n  replicas: 1,  // murmur:env-specific\n}",
+			dst:  "{\n  replicas: 5,\n}",
+			want: "{\n  replicas: 5,\n}",
+		},
+		{
+			name:    "marked in the source, missing in the destination",
+			src:     "{\n  image: 'v2',\n  replicas: 1,  // murmur:env-specific\n}",
+			dst:     "{\n  image: 'v1',\n}",
+			wantErr: "line 3 is marked",
+		},
+		{
+			name: "repeated keys matched by occurrence",
+			src:  "{\n  a: { size: 1 },\n  b: { size: 2 },\n}",
+			dst:  "{\n  a: { size: 1 },\n  size: 9,  // murmur:env-specific\n}",
+			want: "{\n  a: { size: 1 },\n  b: { size: 2 },\n}",
+		},
+		{
+			name: "second occurrence",
+			src:  "local a = {\n  size: 1,\n};\nlocal b = {\n  size: 2,\n};",
+			dst:  "local a = {\n  size: 1,\n};\nlocal b = {\n  size: 7,  // murmur:env-specific\n};",
+			want: "local a = {\n  size: 1,\n};\nlocal b = {\n  size: 7,  // murmur:env-specific\n};",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := keepMarkedLines([]byte(tt.src), []byte(tt.dst), marker)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package cmd
+
+import (
+	"time"
+
+	"github.com/jswank/murmur/pkg/murmur"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+// retriesFlag and retryDelayFlag are shared by commands that clone or push
+var retriesFlag = &cli.IntFlag{
+	Name:  "retries",
+	Usage: "Number of times to retry failed clones and pushes",
+	Value: 3,
+}
+
+var retryDelayFlag = &cli.DurationFlag{
+	Name:  "retry-delay",
+	Usage: "Delay before the first retry, doubled for each subsequent retry (max 30s)",
+	Value: 2 * time.Second,
+}
+
+// retryOptions returns the retry options of the retry flags
+func retryOptions(ctx *cli.Context) murmur.RetryOptions {
+	return murmur.RetryOptions{Retries: ctx.Int("retries"), Delay: ctx.Duration("retry-delay")}
+}
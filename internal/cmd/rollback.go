@@ -0,0 +1,287 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/jswank/murmur/pkg/murmur"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+const rollbackDesc = `Revert the most recent murmur commit of each repo.
+
+For each repo / branch of the targets, the most recent murmur commit that
+touched the path of a target is found and reverted. Only the changes to the
+paths of the targets are reverted. The revert is committed and pushed in the
+same way as 'repos commit', including --commit-script: like 'repos commit',
+rollback has no pull request mode and pushes to the branch of the targets.
+
+Murmur commits are identified by their '` + murmur.SourceTrailer + `' trailer, which
+records the team/app/env of the targets that were committed, or by a subject
+that starts with --marker. When a selection (--team, --app, --env or --filter)
+is given, only commits with a matching trailer are reverted.
+
+Repositories must be cloned (see 'repos clone'). Shallow clones are deepened
+as needed, up to --max-depth commits.
+`
+
+var rollbackCommand = &cli.Command{
+	Name:        "rollback",
+	Usage:       "revert the most recent murmur commit of repos",
+	Action:      rollbackRepos,
+	Before:      BeforeFunc,
+	Description: rollbackDesc,
+	Flags: append(DefaultFlags,
+		branchOverridesFlag,
+		repoDirFlag,
+		&cli.StringFlag{
+			Name:  "commit-script",
+			Usage: "script to run to commit the repo",
+		},
+		&cli.StringFlag{
+			Name:  "marker",
+			Usage: "Subject prefix that identifies murmur commits without a trailer",
+			Value: "murmur commit",
+		},
+		&cli.IntFlag{
+			Name:  "max-depth",
+			Usage: "Maximum number of commits to search in shallow clones",
+			Value: 500,
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Print the commits that would be reverted",
+		},
+		retriesFlag,
+		retryDelayFlag,
+	),
+}
+
+// logEntry is a single commit from `git log`
+type logEntry struct {
+	sha      string
+	subject  string
+	trailers map[string][]string
+}
+
+// rollbackRepos reverts the most recent murmur commit of each repo
+func rollbackRepos(ctx *cli.Context) error {
+
+	files, err := getFiles(ctx, ctx.String("datadir"), "targets.json")
+	if err = fail(murmur.PhaseConfig, "files", err); err != nil {
+		return err
+	}
+
+	targets, err := loadTargets(ctx, files)
+	if err != nil {
+		return err
+	}
+
+	// authenticate git commands to the remotes of the targets
+	err = gitAuth().Configure(targets)
+	if err != nil {
+		return murmur.Fail(murmur.PhaseConfig, "credentials", err)
+	}
+
+	for _, group := range murmur.RepoGroups(targets) {
+		err = rollbackTargetRepo(ctx, group)
+		if err = fail(murmur.PhaseGit, group[0].Repo+":"+group[0].Branch, err); err != nil {
+			return err
+		}
+	}
+
+	return failures.Err()
+}
+
+// rollbackTargetRepo reverts the most recent murmur commit that touched the
+// paths of the targets of a single repo
+func rollbackTargetRepo(ctx *cli.Context, targets []murmur.Target) error {
+
+	target := targets[0]
+	cloneDir := filepath.Join(ctx.String("repodir"), target.CloneDir())
+
+	if _, err := os.Stat(cloneDir); err != nil {
+		return fmt.Errorf("repository not cloned, %w", err)
+	}
+	if err := murmur.ScrubRemote(cloneDir); err != nil {
+		return err
+	}
+
+	paths := murmur.TargetPaths(targets)
+
+	commit, err := findMurmurCommit(ctx, cloneDir, paths)
+	if err != nil {
+		return err
+	}
+	if commit == nil {
+		log.Warn("no murmur commit found to roll back", "repo", target.Repo, "branch", target.Branch, "paths", paths)
+		return nil
+	}
+
+	log.Info("rolling back commit", "repo", target.Repo, "branch", target.Branch, "commit", commit.sha, "subject", commit.subject)
+	if ctx.Bool("dry-run") {
+		fmt.Printf("%s:%s %s %s\n", target.Repo, target.Branch, commit.sha, commit.subject)
+		return nil
+	}
+
+	// only the reverted changes are staged
+	if _, err = murmur.GitOutput(cloneDir, "reset", "--quiet"); err != nil {
+		return fmt.Errorf("unable to reset the index of repo, %w", err)
+	}
+
+	// reverse-apply the changes the commit made to the target paths. The
+	// blobs of partial clones are fetched from the remote as needed.
+	diffCmd := gitAuth().Command(exec.Command("git", append([]string{"diff", "--binary", commit.sha + "^", commit.sha, "--"}, paths...)...))
+	diffCmd.Dir = cloneDir
+	patch, err := diffCmd.Output()
+	if err != nil {
+		return fmt.Errorf("unable to diff commit %s, %w", commit.sha, err)
+	}
+
+	var stderr bytes.Buffer
+	applyCmd := gitAuth().Command(exec.Command("git", "apply", "--reverse", "--index", "--3way"))
+	applyCmd.Dir = cloneDir
+	applyCmd.Stdin = bytes.NewReader(patch)
+	applyCmd.Stderr = &stderr
+	if err = applyCmd.Run(); err != nil {
+		return fmt.Errorf("unable to revert commit %s in %s, %w: %s", commit.sha, target.Repo, err, strings.TrimSpace(stderr.String()))
+	}
+
+	trailers := []string{murmur.RevertTrailer + ": " + commit.sha}
+	for _, source := range commit.trailers[murmur.SourceTrailer] {
+		trailers = append(trailers, murmur.SourceTrailer+": "+source)
+	}
+	msg := murmur.CommitMessage(fmt.Sprintf("Revert \"%s\"\n\nThis reverts commit %s.", commit.subject, commit.sha), trailers)
+
+	_, err = newPublisher(ctx).CommitAndPush(ctx.Context, target, cloneDir, msg, paths, nil)
+	return err
+}
+
+// findMurmurCommit returns the most recent murmur commit that touched any of
+// the paths and has not been reverted, deepening shallow clones as needed.
+// nil is returned if there is no such commit.
+func findMurmurCommit(ctx *cli.Context, cloneDir string, paths []string) (*logEntry, error) {
+
+	depth := 0
+	for {
+		entries, err := gitLog(cloneDir, paths)
+		if err != nil {
+			return nil, err
+		}
+
+		reverted := make(map[string]bool)
+		for _, e := range entries {
+			for _, sha := range e.trailers[murmur.RevertTrailer] {
+				reverted[sha] = true
+			}
+		}
+
+		var found *logEntry
+		for _, e := range entries {
+			if len(e.trailers[murmur.RevertTrailer]) > 0 || reverted[e.sha] {
+				continue
+			}
+			if isMurmurCommit(ctx, e) {
+				found = &e
+				break
+			}
+		}
+
+		shallow, err := isShallow(cloneDir)
+		if err != nil {
+			return nil, err
+		}
+
+		// the parent of the commit is needed to revert it
+		if found != nil && (!shallow || hasCommit(cloneDir, found.sha+"^")) {
+			return found, nil
+		}
+		if !shallow {
+			return found, nil
+		}
+		if depth >= ctx.Int("max-depth") {
+			log.Warn("search depth exceeded in shallow clone", "dir", cloneDir, "max-depth", ctx.Int("max-depth"))
+			return nil, nil
+		}
+
+		depth += 50
+		log.Debug("deepening shallow clone", "dir", cloneDir, "depth", depth)
+		fetchCmd := gitAuth().Command(exec.Command("git", "fetch", "--deepen", "50"))
+		fetchCmd.Dir = cloneDir
+		if err = fetchCmd.Run(); err != nil {
+			return nil, fmt.Errorf("unable to deepen clone %s, %w", cloneDir, err)
+		}
+	}
+}
+
+// isMurmurCommit reports whether a commit was made by murmur for the current
+// selection
+func isMurmurCommit(ctx *cli.Context, e logEntry) bool {
+	sources := e.trailers[murmur.SourceTrailer]
+	filter := ctx.String("filter")
+
+	if len(sources) == 0 {
+		// commits identified by their subject have no recorded selection
+		return filter == "" && ctx.String("marker") != "" && strings.HasPrefix(e.subject, ctx.String("marker"))
+	}
+	if filter == "" {
+		return true
+	}
+	for _, source := range sources {
+		if ok, _ := filepath.Match(filter, source); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// gitLog returns the commits of the current branch that touched the paths,
+// most recent first
+func gitLog(cloneDir string, paths []string) ([]logEntry, error) {
+	logCmd := exec.Command("git", append([]string{"log", "--format=%H%x1f%s%x1f%(trailers:unfold,only)%x1e", "--"}, paths...)...)
+	logCmd.Dir = cloneDir
+	out, err := logCmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read log of %s, %w", cloneDir, err)
+	}
+
+	var entries []logEntry
+	for _, record := range strings.Split(string(out), "\x1e") {
+		fields := strings.SplitN(strings.TrimSpace(record), "\x1f", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		e := logEntry{sha: fields[0], subject: fields[1], trailers: make(map[string][]string)}
+		for _, line := range strings.Split(fields[2], "\n") {
+			k, v, ok := strings.Cut(line, ":")
+			if ok {
+				e.trailers[strings.TrimSpace(k)] = append(e.trailers[strings.TrimSpace(k)], strings.TrimSpace(v))
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// isShallow reports whether a clone is shallow
+func isShallow(cloneDir string) (bool, error) {
+	cmd := exec.Command("git", "rev-parse", "--is-shallow-repository")
+	cmd.Dir = cloneDir
+	out, err := cmd.Output()
+	if err != nil {
+		return false, fmt.Errorf("unable to inspect clone %s, %w", cloneDir, err)
+	}
+	return strings.TrimSpace(string(out)) == "true", nil
+}
+
+// hasCommit reports whether a revision exists in a clone
+func hasCommit(cloneDir, rev string) bool {
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	cmd.Dir = cloneDir
+	return cmd.Run() == nil
+}
@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jswank/murmur/pkg/murmur"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+// rollbackContext returns a context with the selection flags of rollback set
+func rollbackContext(filter, marker string, maxDepth int) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	set.String("filter", filter, "")
+	set.String("marker", marker, "")
+	set.Int("max-depth", maxDepth, "")
+	return cli.NewContext(nil, set, nil)
+}
+
+// commitFile writes a file in a repo and commits it with a message, returning
+// the sha of the commit
+func commitFile(t *testing.T, dir, name, content, msg string) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(file), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(content), 0640); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"add", "--", name},
+		{"-c", "user.name=t", "-c", "user.email=t@example.com", "commit", "--quiet", "-m", msg},
+	} {
+		if _, err := murmur.GitOutput(dir, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sha, err := murmur.GitOutput(dir, "rev-parse", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(sha)
+}
+
+// initRepo returns a new repo in a temporary directory
+func initRepo(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if _, err := murmur.GitOutput(dir, "init", "--quiet"); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestGitLog(t *testing.T) {
+	dir := initRepo(t)
+	first := commitFile(t, dir, "prod/a.json", "1", "murmur commit\n\nMurmur-Source: t/a/prod\nMurmur-Source: t/b/prod")
+	commitFile(t, dir, "other/b.json", "1", "unrelated")
+	second := commitFile(t, dir, "prod/a.json", "2", "Revert \"murmur commit\"\n\nThis reverts commit "+first+".\n\nMurmur-Revert: "+first)
+
+	entries, err := gitLog(dir, []string{"prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []logEntry{
+		{sha: second, subject: "Revert \"murmur commit\"", trailers: map[string][]string{murmur.RevertTrailer: {first}}},
+		{sha: first, subject: "murmur commit", trailers: map[string][]string{murmur.SourceTrailer: {"t/a/prod", "t/b/prod"}}},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got %+v, want %+v", entries, want)
+	}
+}
+
+func TestIsMurmurCommit(t *testing.T) {
+	tests := []struct {
+		name     string
+		filter   string
+		marker   string
+		subject  string
+		trailers map[string][]string
+		want     bool
+	}{
+		{name: "trailer", trailers: map[string][]string{murmur.SourceTrailer: {"t/a/prod"}}, want: true},
+		{name: "trailer matching the selection", filter: "t/*/prod", trailers: map[string][]string{murmur.SourceTrailer: {"u/b/dev", "t/a/prod"}}, want: true},
+		{name: "trailer outside of the selection", filter: "t/*/dev", trailers: map[string][]string{murmur.SourceTrailer: {"t/a/prod"}}},
+		{name: "subject marker", marker: "murmur commit", subject: "murmur commit 2024-01-01", want: true},
+		{name: "subject marker with a selection", filter: "t/*/prod", marker: "murmur commit", subject: "murmur commit"},
+		{name: "no marker", subject: "murmur commit"},
+		{name: "other subject", marker: "murmur commit", subject: "fix typo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := logEntry{subject: tt.subject, trailers: tt.trailers}
+			if got := isMurmurCommit(rollbackContext(tt.filter, tt.marker, 0), e); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindMurmurCommit(t *testing.T) {
+	dir := initRepo(t)
+	commitFile(t, dir, "prod/a.json", "0", "initial")
+	marked := commitFile(t, dir, "prod/a.json", "1", "murmur commit")
+	trailer := commitFile(t, dir, "prod/a.json", "2", "update\n\nMurmur-Source: t/a/prod")
+	reverted := commitFile(t, dir, "prod/a.json", "3", "update\n\nMurmur-Source: t/a/prod")
+	commitFile(t, dir, "prod/a.json", "2", "Revert \"update\"\n\nMurmur-Revert: "+reverted)
+	commitFile(t, dir, "prod/a.json", "4", "hand edit")
+	commitFile(t, dir, "dev/a.json", "1", "update\n\nMurmur-Source: t/a/dev")
+
+	tests := []struct {
+		name   string
+		filter string
+		want   string
+	}{
+		{name: "reverted commits are skipped", want: trailer},
+		{name: "selection", filter: "t/a/prod", want: trailer},
+		{name: "no commit in the selection", filter: "t/b/prod"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := findMurmurCommit(rollbackContext(tt.filter, "murmur commit", 500), dir, []string{"prod"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := entrySHA(e); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// once the trailer commit is reverted, only the subject marker is left,
+	// which is only used without a selection
+	commitFile(t, dir, "prod/a.json", "0", "Revert \"update\"\n\nMurmur-Revert: "+trailer)
+	for filter, want := range map[string]string{"": marked, "t/a/prod": ""} {
+		e, err := findMurmurCommit(rollbackContext(filter, "murmur commit", 500), dir, []string{"prod"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := entrySHA(e); got != want {
+			t.Errorf("filter %q: got %q, want %q", filter, got, want)
+		}
+	}
+}
+
+func TestFindMurmurCommitShallow(t *testing.T) {
+	origin := initRepo(t)
+	commitFile(t, origin, "prod/a.json", "0", "initial")
+	want := commitFile(t, origin, "prod/a.json", "1", "update\n\nMurmur-Source: t/a/prod")
+	for i := range 70 {
+		commitFile(t, origin, "prod/a.json", fmt.Sprint(i+2), "hand edit")
+	}
+
+	tests := []struct {
+		name     string
+		maxDepth int
+		want     string
+	}{
+		{name: "deepened", maxDepth: 100, want: want},
+		{name: "max depth exceeded", maxDepth: 50},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "clone")
+			if _, err := murmur.GitOutput("", "clone", "--quiet", "--depth", "1", "file://"+origin, dir); err != nil {
+				t.Fatal(err)
+			}
+			e, err := findMurmurCommit(rollbackContext("", "", tt.maxDepth), dir, []string{"prod"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := entrySHA(e); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if tt.want != "" && !hasCommit(dir, tt.want+"^") {
+				t.Error("parent of the commit not fetched")
+			}
+		})
+	}
+}
+
+// entrySHA returns the sha of a log entry, or "" for none
+func entrySHA(e *logEntry) string {
+	if e == nil {
+		return ""
+	}
+	return e.sha
+}
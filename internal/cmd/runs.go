@@ -0,0 +1,559 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jswank/murmur/pkg/murmur"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+// run is a generate or diff run of the server, for a list of filters
+type run struct {
+	ID       string     `json:"id"`
+	Command  string     `json:"command"` // generate or diff
+	Filters  []string   `json:"filters"`
+	Commit   bool       `json:"commit"`
+	Trigger  string     `json:"trigger"` // api, github or gitlab
+	Status   string     `json:"status"`  // queued, running, succeeded or failed
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Repos    []runRepo  `json:"repos,omitempty"`
+	ExitCode int        `json:"exit_code"`
+	Error    string     `json:"error,omitempty"`
+	Diff     string     `json:"diff,omitempty"`
+
+	push     *pushEvent // the push that triggered the run: the datadir is updated first
+	logs     *runLogs
+	notifier *murmur.Notifier // set for runs that publish, if notifications are enabled
+	journal  *murmur.Journal  // set if the audit journal is enabled
+	metrics  *murmur.Metrics  // set if --metrics-file is set
+	tracer   *murmur.Tracer   // set if --otlp-endpoint is set
+	config   *murmur.Config   // the configuration of the datadir when the run started
+	auth     *murmur.GitAuth
+}
+
+// runRepo is the outcome of a run for a repo / branch
+type runRepo struct {
+	Repo    string `json:"repo"`
+	Branch  string `json:"branch"`
+	Changed bool   `json:"changed"`
+	Commit  string `json:"commit,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// runLogs is the log of a run, written while it is read
+type runLogs struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *runLogs) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *runLogs) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+// runner queues runs and executes them with a number of workers. Runs that
+// write to the same repo are serialized: a run holds the lock of each of its
+// repos from the clone until it is published.
+type runner struct {
+	cli      *cli.Context // the flags of the serve command
+	datadir  string
+	prefix   string // the path of the datadir in its repo
+	branch   string // the branch of the datadir repo that webhooks pull
+	logLevel slog.Level
+
+	queue chan *run
+
+	mu        sync.Mutex
+	runs      []*run // oldest first, at most maxRuns
+	datadirMu sync.RWMutex
+	config    *murmur.Config  // reloaded when the datadir is pulled
+	configErr error           // set if the reloaded config needs a restart
+	auth      *murmur.GitAuth // shared by the runs, recreated if the credentials change
+	repos     map[string]*sync.Mutex
+}
+
+// maxRuns is the number of runs kept for their status
+const maxRuns = 100
+
+// newRunID returns a random run ID
+func newRunID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// submit queues a run. An error is returned if the queue is full.
+func (rn *runner) submit(r *run) error {
+	r.ID = newRunID()
+	r.Status = "queued"
+	r.Created = time.Now()
+	r.logs = &runLogs{}
+
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	select {
+	case rn.queue <- r:
+	default:
+		return errors.New("the run queue is full")
+	}
+	rn.runs = append(rn.runs, r)
+	if len(rn.runs) > maxRuns {
+		rn.runs = slices.Delete(rn.runs, 0, len(rn.runs)-maxRuns)
+	}
+	return nil
+}
+
+// get returns a copy of a run, false if it is unknown
+func (rn *runner) get(id string) (run, bool) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	for _, r := range rn.runs {
+		if r.ID == id {
+			return rn.snapshot(r), true
+		}
+	}
+	return run{}, false
+}
+
+// list returns copies of the runs, newest first, without their diffs
+func (rn *runner) list() []run {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	runs := make([]run, 0, len(rn.runs))
+	for i := len(rn.runs) - 1; i >= 0; i-- {
+		r := rn.snapshot(rn.runs[i])
+		r.Diff = ""
+		runs = append(runs, r)
+	}
+	return runs
+}
+
+// logs returns the logs of a run, false if it is unknown
+func (rn *runner) logs(id string) (string, bool) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	for _, r := range rn.runs {
+		if r.ID == id {
+			return r.logs.String(), true
+		}
+	}
+	return "", false
+}
+
+// snapshot returns a copy of the fields of a run that are read by the API.
+// rn.mu must be held.
+func (rn *runner) snapshot(r *run) run {
+	return run{
+		ID: r.ID, Command: r.Command, Filters: r.Filters, Commit: r.Commit, Trigger: r.Trigger,
+		Status: r.Status, Created: r.Created, Started: r.Started, Finished: r.Finished,
+		Repos: slices.Clone(r.Repos), ExitCode: r.ExitCode, Error: r.Error, Diff: r.Diff,
+	}
+}
+
+// update changes the fields of a run read by the API
+func (rn *runner) update(r *run, f func(r *run)) {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	f(r)
+}
+
+// work executes queued runs until the context is done
+func (rn *runner) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-rn.queue:
+			rn.execute(r)
+		}
+	}
+}
+
+// execute executes a run and records its outcome
+func (rn *runner) execute(r *run) {
+	rn.update(r, func(r *run) {
+		now := time.Now()
+		r.Status, r.Started = "running", &now
+	})
+	log.Info("run started", "id", r.ID, "command", r.Command, "filters", r.Filters, "trigger", r.Trigger)
+	logger := slog.New(scrubHandler{slog.NewTextHandler(r.logs, &slog.HandlerOptions{Level: rn.logLevel})})
+
+	var err error
+	if r.push != nil {
+		if err = rn.pull(logger); err != nil {
+			err = murmur.Fail(murmur.PhaseConfig, "datadir", err)
+		}
+	}
+
+	// the datadir, and its configuration, are not updated while they are
+	// read
+	rn.datadirMu.RLock()
+	var readOnce sync.Once
+	readDone := func() { readOnce.Do(rn.datadirMu.RUnlock) }
+	defer readDone()
+	r.config, r.auth = rn.config, rn.auth
+	if err == nil && rn.configErr != nil {
+		err = murmur.Fail(murmur.PhaseConfig, "config", rn.configErr)
+	}
+	if err == nil && r.push != nil {
+		filters := pushFilters(r.config.Hierarchy, rn.datadir, rn.prefix, r.push)
+		rn.update(r, func(r *run) { r.Filters = filters })
+		logger.Info("changed hierarchy directories", "filters", filters, "after", r.push.After)
+	}
+
+	notify := r.Command == "generate" && r.Commit && len(r.config.Notifications) > 0 && !rn.cli.Bool("no-notify")
+	if notify {
+		r.notifier = &murmur.Notifier{Config: r.config, DataDir: rn.datadir}
+	}
+	if journal != nil && r.Command == "generate" && r.Commit {
+		// the clones of runs are temporary: only the runs that publish are
+		// recorded. The datadir commit is read for each run, as webhooks
+		// update it.
+		r.journal = &murmur.Journal{File: journal.File, URL: journal.URL, Command: r.Command, DataDir: rn.datadir}
+	}
+	// the metrics file describes the last run, each run is a trace
+	if telemetry.metrics != nil {
+		r.metrics = &murmur.Metrics{Labels: map[string]string{"command": r.Command}}
+	}
+	if telemetry.tracer != nil {
+		r.tracer = &murmur.Tracer{Endpoint: telemetry.tracer.Endpoint, Headers: telemetry.tracer.Headers, ServiceName: telemetry.tracer.ServiceName}
+	}
+	var diff string
+	if err == nil {
+		diff, err = rn.generate(r, logger, readDone)
+	}
+	readDone()
+	if terr := exportTelemetry(r.metrics, r.tracer, r.auth, "murmur "+r.Command, *r.Started, err); terr != nil {
+		log.Warn("unable to export telemetry", "id", r.ID, "error", murmur.Scrub(terr.Error()))
+	}
+	if r.journal != nil {
+		if jerr := r.journal.Close(context.Background()); jerr != nil {
+			log.Warn(murmur.Scrub(jerr.Error()), "id", r.ID)
+		}
+	}
+	if notify {
+		if nerr := r.notifier.Notify(context.Background(), r.Command, *r.Started, err); nerr != nil {
+			log.Warn(murmur.Scrub(nerr.Error()), "id", r.ID)
+		}
+	}
+
+	var failures *murmur.Failures
+	msg := ""
+	if errors.As(err, &failures) {
+		msg = failures.Summary()
+	} else if err != nil {
+		msg = err.Error()
+	}
+	rn.update(r, func(r *run) {
+		now := time.Now()
+		r.Finished, r.Diff = &now, diff
+		r.ExitCode, r.Error = murmur.ExitCode(err), murmur.Scrub(msg)
+		r.Status = "succeeded"
+		if err != nil {
+			r.Status = "failed"
+		}
+	})
+	log.Info("run finished", "id", r.ID, "status", r.Status, "exit_code", r.ExitCode)
+}
+
+// generate renders the sources of the filters of a run into a temporary
+// directory, then clones, writes and (for a generate run) publishes the repos
+// of their targets in another. A diff run returns the changes it would make.
+// readDone is called once the datadir is rendered.
+func (rn *runner) generate(r *run, logger *slog.Logger, readDone func()) (string, error) {
+	ctx := context.Background()
+	defer readDone()
+
+	tmp, err := os.MkdirTemp("", "murmur-run-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	destdir, repodir := filepath.Join(tmp, "rendered"), filepath.Join(tmp, "repos")
+
+	renderer := murmur.NewRendererRegistry(r.config, murmur.RenderOptions{
+		DataDir:     rn.datadir,
+		OutDir:      destdir,
+		JsonnetArgs: strings.Fields(rn.cli.String("jsonnet-args")),
+		Logger:      logger,
+	})
+	files, err := rn.sources(renderer.Extensions(), r.Filters)
+	if err != nil {
+		return "", murmur.Fail(murmur.PhaseConfig, "files", err)
+	}
+
+	loader := &lockingLoader{
+		TargetLoader: murmur.FileTargetLoader{Dir: destdir, BranchOverrides: rn.cli.StringSlice("override-branch"), Logger: logger},
+		runner:       rn,
+		rendered:     readDone,
+	}
+	defer loader.unlock()
+
+	observer := func(e murmur.Event) {
+		rn.observe(r, e)
+		if r.notifier != nil {
+			r.notifier.Observe(e)
+		}
+		if r.journal != nil {
+			r.journal.Observe(e)
+		}
+		if r.metrics != nil {
+			r.metrics.Observe(e)
+		}
+		if r.tracer != nil {
+			r.tracer.Observe(e)
+		}
+	}
+	writer := &murmur.GitWriter{
+		Config:    r.config,
+		RepoDir:   repodir,
+		DataDir:   destdir,
+		Overwrite: true,
+		Sparse:    rn.cli.Bool("sparse"),
+		Retry:     retryOptions(rn.cli),
+		Auth:      r.auth,
+		Observer:  observer,
+		Logger:    logger,
+
+		SourceDir:   rn.datadir,
+		RefuseDrift: rn.cli.Bool("refuse-drift"),
+	}
+	p := &murmur.Pipeline{
+		Config:   r.config,
+		Renderer: renderer,
+		Targets:  loader,
+		Writer:   writer,
+		Observer: observer,
+		Options: murmur.PipelineOptions{
+			DataDir:  rn.datadir,
+			Failures: &murmur.Failures{Max: rn.cli.Int("max-failures")},
+			Logger:   logger,
+		},
+	}
+	if r.Command == "generate" && r.Commit {
+		p.Options.Publish = true
+		p.Publisher = &murmur.GitPublisher{
+			Config:       r.config,
+			RepoDir:      repodir,
+			DataDir:      destdir,
+			CommitMsg:    rn.cli.String("commit-msg"),
+			CommitScript: rn.cli.String("commit-script"),
+			Strict:       rn.cli.Bool("strict"),
+			Retry:        retryOptions(rn.cli),
+			Auth:         r.auth,
+			Writer:       writer,
+			Observer:     observer,
+			Logger:       logger,
+		}
+	}
+
+	if err = p.Run(ctx, files); err != nil || r.Command != "diff" {
+		return "", err
+	}
+	return cloneDiffs(repodir, loader.targets)
+}
+
+// sources returns the source files of the datadir selected by the filters
+func (rn *runner) sources(extensions, filters []string) ([]string, error) {
+	all, err := murmur.FindFiles(rn.datadir, extensions...)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, filter := range filters {
+		matched, err := filterFiles(all, filepath.Join(rn.datadir, filter))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range matched {
+			if !slices.Contains(files, f) {
+				files = append(files, f)
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files matched the filters %s", strings.Join(filters, ", "))
+	}
+	return files, nil
+}
+
+// pull fast-forwards the datadir to the webhook branch of its origin, once no
+// run is reading it, and reloads its configuration
+func (rn *runner) pull(logger *slog.Logger) error {
+	rn.datadirMu.Lock()
+	defer rn.datadirMu.Unlock()
+	logger.Info("updating datadir", "dir", rn.datadir, "branch", rn.branch)
+
+	// the checked out branch could have been changed since serve started
+	head, err := murmur.GitOutput(rn.datadir, "rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return err
+	}
+	if head != rn.branch {
+		return fmt.Errorf("the datadir has %s checked out, not the webhook branch %s", head, rn.branch)
+	}
+	remote := "refs/remotes/origin/" + rn.branch
+	if _, err = murmur.GitOutput(rn.datadir, "fetch", "--quiet", "origin", "+refs/heads/"+rn.branch+":"+remote); err != nil {
+		return fmt.Errorf("unable to fetch the datadir, %w", err)
+	}
+	out, err := murmur.GitOutput(rn.datadir, "merge", "--ff-only", remote)
+	if err != nil {
+		return fmt.Errorf("unable to update datadir, %w", err)
+	}
+	logger.Info("updated datadir", "dir", rn.datadir, "output", out)
+	return rn.reloadConfig(logger)
+}
+
+// reloadConfig reads the configuration file again. The hierarchy selection
+// flags and the audit journal are set up from the configuration when serve
+// starts: once either changes, runs fail until serve is restarted.
+func (rn *runner) reloadConfig(logger *slog.Logger) error {
+	filename := rn.config.Filename
+	if filename == "" {
+		filename = filepath.Join(rn.datadir, murmur.ConfigFilename)
+		if _, err := os.Stat(filename); err != nil {
+			return nil
+		}
+	}
+	c, err := murmur.NewConfigFromFile(filename)
+	if err != nil {
+		return err
+	}
+	if !slices.Equal(c.Hierarchy, rn.config.Hierarchy) || !reflect.DeepEqual(c.Audit, rn.config.Audit) {
+		rn.configErr = fmt.Errorf("the hierarchy or the audit settings of %s changed, serve must be restarted", filename)
+		return rn.configErr
+	}
+	if !reflect.DeepEqual(c.Credentials, rn.config.Credentials) {
+		rn.auth = &murmur.GitAuth{Config: c, Logger: log}
+	}
+	rn.config, rn.configErr = c, nil
+	logger.Info("reloaded config", "file", filename)
+	return nil
+}
+
+// observe records the outcome of each repo of a run
+func (rn *runner) observe(r *run, e murmur.Event) {
+	if e.Repo == "" || (e.Kind != murmur.EventClone && e.Kind != murmur.EventPublish) {
+		return
+	}
+	rn.update(r, func(r *run) {
+		i := slices.IndexFunc(r.Repos, func(rr runRepo) bool { return rr.Repo == e.Repo && rr.Branch == e.Branch })
+		if i < 0 {
+			r.Repos = append(r.Repos, runRepo{Repo: e.Repo, Branch: e.Branch})
+			i = len(r.Repos) - 1
+		}
+		if e.Kind == murmur.EventPublish {
+			r.Repos[i].Changed, r.Repos[i].Commit = e.Changed, e.Commit
+		}
+		if e.Err != nil {
+			r.Repos[i].Error = murmur.Scrub(e.Err.Error())
+		}
+	})
+}
+
+// lock locks the repos / branches of targets, in order, and returns a
+// function that unlocks them
+func (rn *runner) lock(targets []murmur.Target) func() {
+	var keys []string
+	for _, group := range murmur.RepoGroups(targets) {
+		keys = append(keys, group[0].Repo+":"+group[0].Branch)
+	}
+	slices.Sort(keys)
+
+	var locks []*sync.Mutex
+	for _, key := range keys {
+		rn.mu.Lock()
+		if rn.repos == nil {
+			rn.repos = make(map[string]*sync.Mutex)
+		}
+		l, ok := rn.repos[key]
+		if !ok {
+			l = new(sync.Mutex)
+			rn.repos[key] = l
+		}
+		rn.mu.Unlock()
+
+		l.Lock()
+		locks = append(locks, l)
+	}
+	return func() {
+		for _, l := range locks {
+			l.Unlock()
+		}
+	}
+}
+
+// lockingLoader loads the targets of a run once it is rendered, and holds
+// the locks of their repos until unlock is called
+type lockingLoader struct {
+	murmur.TargetLoader
+	runner   *runner
+	rendered func() // called once the rendered files are loaded
+
+	targets  []murmur.Target
+	unlocked func()
+}
+
+func (l *lockingLoader) LoadTargets(ctx context.Context) ([]murmur.Target, error) {
+	targets, err := l.TargetLoader.LoadTargets(ctx)
+	l.rendered()
+	if len(targets) > 0 {
+		l.targets = targets
+		l.unlocked = l.runner.lock(targets)
+	}
+	return targets, err
+}
+
+// unlock releases the locks of the repos, if they are held
+func (l *lockingLoader) unlock() {
+	if l.unlocked != nil {
+		l.unlocked()
+	}
+}
+
+// cloneDiffs returns the changes to the target paths of the clones of a run,
+// as a diff of each repo / branch
+func cloneDiffs(repodir string, targets []murmur.Target) (string, error) {
+	var b strings.Builder
+	for _, group := range murmur.RepoGroups(targets) {
+		target := group[0]
+		cloneDir := filepath.Join(repodir, target.CloneDir())
+		paths := murmur.TargetPaths(group)
+
+		// new files are staged so that they are part of the diff
+		if _, err := murmur.GitOutput(cloneDir, append([]string{"add", "--all", "--"}, paths...)...); err != nil {
+			return b.String(), fmt.Errorf("unable to stage changes of %s, %w", target.Repo, err)
+		}
+		diff, err := murmur.GitOutput(cloneDir, append([]string{"diff", "--cached", "--no-color", "--"}, paths...)...)
+		if err != nil {
+			return b.String(), fmt.Errorf("unable to diff %s, %w", target.Repo, err)
+		}
+		if diff != "" {
+			fmt.Fprintf(&b, "# %s:%s\n%s\n", target.Repo, target.Branch, diff)
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jswank/murmur/pkg/murmur"
+)
+
+func TestReloadConfig(t *testing.T) {
+	datadir := t.TempDir()
+	filename := filepath.Join(datadir, murmur.ConfigFilename)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	rn := &runner{datadir: datadir, config: murmur.DefaultConfig()}
+	rn.auth = &murmur.GitAuth{Config: rn.config}
+
+	// without a config file, the default config is kept
+	if err := rn.reloadConfig(logger); err != nil || rn.config.Filename != "" {
+		t.Fatalf("no config file: %v, %q", err, rn.config.Filename)
+	}
+
+	tests := []struct {
+		name     string
+		content  string
+		wantErr  string
+		wantAuth bool // the GitAuth is recreated
+	}{
+		{name: "new config file", content: `{"template_level": "team"}`},
+		{name: "credentials changed", content: `{"template_level": "team", "credentials": {"username": "murmur"}}`, wantAuth: true},
+		{name: "invalid", content: `{"hierarchy": ["Team"]}`, wantErr: "invalid config file"},
+		{name: "hierarchy changed", content: `{"hierarchy": ["team", "env"], "template_level": "team"}`, wantErr: "serve must be restarted"},
+		{name: "hierarchy restored", content: `{"template_level": "app", "credentials": {"username": "murmur"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(filename, []byte(tt.content), 0640); err != nil {
+				t.Fatal(err)
+			}
+			cfg, auth := rn.config, rn.auth
+			err := rn.reloadConfig(logger)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				if rn.config != cfg {
+					t.Error("config replaced")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rn.configErr != nil {
+				t.Errorf("configErr = %v", rn.configErr)
+			}
+			if rn.config.Filename != filename {
+				t.Errorf("config not reloaded: %q", rn.config.Filename)
+			}
+			if (rn.auth != auth) != tt.wantAuth {
+				t.Errorf("auth recreated: %v, want %v", rn.auth != auth, tt.wantAuth)
+			}
+		})
+	}
+}
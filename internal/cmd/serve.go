@@ -0,0 +1,419 @@
+package cmd
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jswank/murmur/pkg/murmur"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+const serveDesc = `Run murmur as a server.
+
+Runs of generate or diff are requested with the HTTP API, or triggered by the
+push webhooks of GitHub or GitLab for the datadir repo. Runs are queued and
+executed by --workers workers: runs that write to the same repo / branch are
+serialized. Each run renders into, and clones to, a temporary directory.
+
+API requests are authenticated with a bearer token, read from --token-file or
+$MURMUR_SERVE_TOKEN:
+
+	POST /runs            {"command": "generate", "filter": "ops/web/prod", "commit": true}
+	GET  /runs            the runs, newest first
+	GET  /runs/{id}       the status of a run, and the diff of a diff run
+	GET  /runs/{id}/logs  the logs of a run
+
+Webhooks are authenticated with the secret of the webhook, read from
+--webhook-secret-file or $MURMUR_WEBHOOK_SECRET:
+
+	POST /webhooks/github
+	POST /webhooks/gitlab
+
+A push to --webhook-branch of the datadir repo (the repo of the origin of the
+datadir) fast-forwards the datadir to the branch, then runs generate for the
+hierarchy directories of the changed files. The datadir must have the branch
+checked out. Pushes to other repos and branches are ignored. The config file
+is read again after each pull; a change of the hierarchy or of the audit
+settings fails the runs until serve is restarted.
+`
+
+var ServeCommand = &cli.Command{
+	Name:            "serve",
+	Usage:           "run generate and diff from an HTTP API and webhooks",
+	UsageText:       "murmur serve [options]",
+	HideHelpCommand: true,
+	Action:          serve,
+	Description:     serveDesc,
+	Before:          BeforeFunc,
+	Flags: append(DefaultFlags,
+		&cli.StringFlag{
+			Name:  "listen",
+			Usage: "Address to listen on",
+			Value: ":8080",
+		},
+		&cli.IntFlag{
+			Name:  "workers",
+			Usage: "Number of runs executed at once",
+			Value: 2,
+		},
+		&cli.StringFlag{
+			Name:  "token-file",
+			Usage: "File of the bearer token of API requests, can be set using $MURMUR_SERVE_TOKEN",
+		},
+		&cli.StringFlag{
+			Name:  "webhook-secret-file",
+			Usage: "File of the secret of webhooks, can be set using $MURMUR_WEBHOOK_SECRET. Webhooks are disabled if unset.",
+		},
+		&cli.StringFlag{
+			Name:  "webhook-branch",
+			Usage: "Branch of the datadir repo that triggers runs",
+			Value: "main",
+		},
+		&cli.BoolFlag{
+			Name:  "webhook-commit",
+			Usage: "Commit and push the changes of runs triggered by webhooks",
+		},
+		branchOverridesFlag,
+		&cli.StringFlag{
+			Name:  "commit-script",
+			Usage: "Script to run to commit / push changes to the repo",
+		},
+		&cli.StringFlag{
+			Name:  "commit-msg",
+			Usage: "Commit message",
+			Value: "murmur commit",
+		},
+		strictFlag,
+		refuseDriftFlag,
+		noNotifyFlag,
+		sparseFlag,
+		retriesFlag,
+		retryDelayFlag,
+		&cli.StringFlag{
+			Name:  "jsonnet-args",
+			Usage: "Arguments to pass to the jsonnet application.",
+			Value: "-m",
+		},
+	),
+}
+
+// errUnauthorized is returned for requests without valid credentials
+var errUnauthorized = errors.New("unauthorized")
+
+// server is the HTTP API and webhook receiver of serve
+type server struct {
+	runner        *runner
+	token         string
+	webhookSecret string
+	webhookRepo   string // the repo of the datadir, i.e. org/datadir
+	webhookCommit bool
+}
+
+func serve(ctx *cli.Context) error {
+
+	token, err := secretValue(ctx.String("token-file"), "MURMUR_SERVE_TOKEN")
+	if err != nil {
+		return murmur.Fail(murmur.PhaseConfig, "token", err)
+	}
+	if token == "" {
+		return murmur.Fail(murmur.PhaseConfig, "token", errors.New("a token is required: set --token-file or $MURMUR_SERVE_TOKEN"))
+	}
+	webhookSecret, err := secretValue(ctx.String("webhook-secret-file"), "MURMUR_WEBHOOK_SECRET")
+	if err != nil {
+		return murmur.Fail(murmur.PhaseConfig, "webhook secret", err)
+	}
+	murmur.AddSecrets(token, webhookSecret)
+
+	// the runs export their own metrics and spans: there is none for the
+	// server itself
+	telemetry.perRun = true
+
+	// run logs are kept at info level, or debug
+	level := slog.LevelInfo
+	if ctx.String("loglevel") == "debug" {
+		level = slog.LevelDebug
+	}
+
+	// the workers share the authentication of git commands: it is created
+	// before they start
+	s := &server{
+		runner: &runner{
+			cli:      ctx,
+			datadir:  ctx.String("datadir"),
+			branch:   ctx.String("webhook-branch"),
+			logLevel: level,
+			config:   config,
+			auth:     gitAuth(),
+			queue:    make(chan *run, maxRuns),
+		},
+		token:         token,
+		webhookSecret: webhookSecret,
+		webhookCommit: ctx.Bool("webhook-commit"),
+	}
+
+	if webhookSecret != "" {
+		if err = s.checkDataDir(); err != nil {
+			return murmur.Fail(murmur.PhaseConfig, "datadir", err)
+		}
+	}
+
+	sigCtx, stop := signal.NotifyContext(ctx.Context, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var workers sync.WaitGroup
+	for range max(ctx.Int("workers"), 1) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			s.runner.work(sigCtx)
+		}()
+	}
+
+	httpServer := &http.Server{
+		Addr:              ctx.String("listen"),
+		Handler:           s.routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-sigCtx.Done()
+		log.Info("shutting down: waiting for running runs")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	log.Info("listening", "address", httpServer.Addr, "datadir", s.runner.datadir, "workers", ctx.Int("workers"), "webhooks", webhookSecret != "")
+	err = httpServer.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	workers.Wait()
+	return nil
+}
+
+// checkDataDir reads the repo of the datadir, and the path of the datadir in
+// it, for webhooks: the changed files of pushes are relative to the root of
+// the repo. The datadir must have the webhook branch checked out, as it is
+// fast-forwarded to it.
+func (s *server) checkDataDir() error {
+	var err error
+	s.runner.prefix, err = murmur.GitOutput(s.runner.datadir, "rev-parse", "--show-prefix")
+	if err != nil {
+		return fmt.Errorf("webhooks need the datadir to be a git checkout, %w", err)
+	}
+	// the URL as configured: get-url would apply insteadOf rewrites
+	origin, err := murmur.GitOutput(s.runner.datadir, "config", "--get", "remote.origin.url")
+	if err != nil {
+		return fmt.Errorf("webhooks need the datadir to have an origin, %w", err)
+	}
+	if s.webhookRepo = remoteRepo(origin); s.webhookRepo == "" {
+		return fmt.Errorf("unable to read the repo of the origin of the datadir, %s", murmur.Scrub(origin))
+	}
+	head, err := murmur.GitOutput(s.runner.datadir, "rev-parse", "--abbrev-ref", "HEAD")
+	if err != nil {
+		return err
+	}
+	if head != s.runner.branch {
+		return fmt.Errorf("webhooks need the datadir to have --webhook-branch %s checked out, not %s", s.runner.branch, head)
+	}
+	return nil
+}
+
+// secretValue reads a secret from a file, or from an environment variable if
+// no file is given
+func secretValue(file, env string) (string, error) {
+	if file == "" {
+		return strings.TrimSpace(os.Getenv(env)), nil
+	}
+	b, err := os.ReadFile(murmur.ExpandHome(file))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// routes returns the handler of the API and the webhooks
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("POST /runs", s.authenticated(s.createRun))
+	mux.HandleFunc("GET /runs", s.authenticated(s.listRuns))
+	mux.HandleFunc("GET /runs/{id}", s.authenticated(s.getRun))
+	mux.HandleFunc("GET /runs/{id}/logs", s.authenticated(s.getRunLogs))
+	if s.webhookSecret != "" {
+		mux.HandleFunc("POST /webhooks/github", s.webhook("github", parseGitHubPush))
+		mux.HandleFunc("POST /webhooks/gitlab", s.webhook("gitlab", parseGitLabPush))
+	}
+	return mux
+}
+
+// authenticated checks the bearer token of API requests
+func (s *server) authenticated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// runRequest is the body of POST /runs. The selection is a filter
+// (team/app/env), or the values of hierarchy levels.
+type runRequest struct {
+	Command   string            `json:"command"` // generate or diff [default: diff]
+	Filter    string            `json:"filter"`
+	Selection map[string]string `json:"selection"`
+	Commit    bool              `json:"commit"` // commit and push the changes of a generate
+}
+
+func (s *server) createRun(w http.ResponseWriter, r *http.Request) {
+	var req runRequest
+	dec := json.NewDecoder(io.LimitReader(r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request, %w", err))
+		return
+	}
+
+	if req.Command == "" {
+		req.Command = "diff"
+	}
+	if req.Command != "generate" && req.Command != "diff" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid command %q: must be generate or diff", req.Command))
+		return
+	}
+	if req.Commit && req.Command != "generate" {
+		writeError(w, http.StatusBadRequest, errors.New("commit is only valid for generate"))
+		return
+	}
+
+	filter := req.Filter
+	switch {
+	case filter != "" && req.Selection != nil:
+		writeError(w, http.StatusBadRequest, errors.New("filter and selection are exclusive"))
+		return
+	case filter != "":
+		if _, err := config.Hierarchy.Parse(filter); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid filter, %w", err))
+			return
+		}
+	default:
+		for level := range req.Selection {
+			if !strings.Contains("/"+config.Hierarchy.String()+"/", "/"+level+"/") {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid selection: %q is not a level of the hierarchy %s", level, config.Hierarchy))
+				return
+			}
+		}
+		filter = config.Hierarchy.Pattern(req.Selection)
+	}
+
+	run := &run{Command: req.Command, Filters: []string{filter}, Commit: req.Commit, Trigger: "api"}
+	s.submit(w, run)
+}
+
+// submit queues a run and responds with its status
+func (s *server) submit(w http.ResponseWriter, r *run) {
+	if err := s.runner.submit(r); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	log.Info("run queued", "id", r.ID, "command", r.Command, "filters", r.Filters, "trigger", r.Trigger)
+	status, _ := s.runner.get(r.ID)
+	w.Header().Set("Location", "/runs/"+r.ID)
+	writeJSON(w, http.StatusAccepted, status)
+}
+
+func (s *server) listRuns(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.runner.list())
+}
+
+func (s *server) getRun(w http.ResponseWriter, r *http.Request) {
+	status, ok := s.runner.get(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("run not found"))
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+func (s *server) getRunLogs(w http.ResponseWriter, r *http.Request) {
+	logs, ok := s.runner.logs(r.PathValue("id"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("run not found"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, logs)
+}
+
+// webhook returns the handler of the push webhooks of a git host
+func (s *server) webhook(trigger string, parse func(*http.Request, []byte, string) (*pushEvent, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 25<<20))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		event, err := parse(r, body, s.webhookSecret)
+		if errors.Is(err, errUnauthorized) {
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if event == nil {
+			writeJSON(w, http.StatusOK, map[string]string{"status": "ignored", "reason": "not a push event"})
+			return
+		}
+		if !strings.EqualFold(event.Repo, s.webhookRepo) {
+			writeJSON(w, http.StatusOK, map[string]string{"status": "ignored", "reason": "push to " + event.Repo})
+			return
+		}
+		if event.Ref != "refs/heads/"+s.runner.branch {
+			writeJSON(w, http.StatusOK, map[string]string{"status": "ignored", "reason": "push to " + event.Ref})
+			return
+		}
+
+		if !event.Partial && !slices.ContainsFunc(event.Files, func(f string) bool { return strings.HasPrefix(f, s.runner.prefix) }) {
+			writeJSON(w, http.StatusOK, map[string]string{"status": "ignored", "reason": "no changes to the datadir"})
+			return
+		}
+		log.Info("push received", "trigger", trigger, "repo", event.Repo, "ref", event.Ref, "after", event.After, "files", len(event.Files))
+
+		// the filters are set once the datadir is updated
+		run := &run{Command: "generate", Commit: s.webhookCommit, Trigger: trigger, push: event}
+		s.submit(w, run)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": murmur.Scrub(err.Error())})
+}
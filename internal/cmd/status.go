@@ -0,0 +1,398 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jswank/murmur/pkg/murmur"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+const statusDesc = `Report the state of the clones in --repodir.
+
+For each repo / branch of the targets: the checked out branch, the HEAD
+commit, the number of commits ahead of and behind origin, and the uncommitted
+changes inside each target path.  Clones in --repodir (directories named
+<name>:<branch>) that are not referenced by the selected targets are reported
+as well.
+
+Specify --fetch to update the remote branches before counting.
+`
+
+const resetDesc = `Discard the uncommitted murmur writes to clones.
+
+Changes to the files murmur manages in the target paths are reverted, and the
+files murmur created there are removed: the files rendered for the targets,
+the manifests (.murmur-manifest.json) of the target paths and the files they
+record. Other changes, i.e. hand edits of other files, are left untouched.
+`
+
+var statusCommand = &cli.Command{
+	Name:        "status",
+	Usage:       "report the state of repo clones",
+	Action:      statusRepos,
+	Before:      BeforeFunc,
+	Description: statusDesc,
+	Flags: append(DefaultFlags,
+		branchOverridesFlag,
+		repoDirFlag,
+		formatFlag,
+		templateFlag,
+		&cli.BoolFlag{
+			Name:  "fetch",
+			Usage: "Fetch from origin before comparing",
+		},
+	),
+}
+
+var resetCommand = &cli.Command{
+	Name:        "reset",
+	Usage:       "discard uncommitted murmur writes in target paths",
+	Action:      resetRepos,
+	Before:      BeforeFunc,
+	Description: resetDesc,
+	Flags: append(DefaultFlags,
+		branchOverridesFlag,
+		repoDirFlag,
+		formatFlag,
+		templateFlag,
+	),
+}
+
+// cloneStatus is the state of a single clone
+type cloneStatus struct {
+	Repo       string              `json:"repo"`
+	Branch     string              `json:"branch"`
+	Dir        string              `json:"dir"`
+	HeadBranch string              `json:"head_branch,omitempty"`
+	Head       string              `json:"head,omitempty"`
+	Ahead      int                 `json:"ahead"`
+	Behind     int                 `json:"behind"`
+	Changes    map[string][]string `json:"changes"`
+	Referenced bool                `json:"referenced"`
+	Error      string              `json:"error,omitempty"`
+}
+
+// resetFile is a file whose changes were discarded
+type resetFile struct {
+	Dir    string `json:"dir"`    // the clone
+	Status string `json:"status"` // git status of the change, i.e. M or ??
+	File   string `json:"file"`   // relative to the clone
+}
+
+// statusRepos reports the state of the clones of the targets
+func statusRepos(ctx *cli.Context) error {
+
+	if _, err := formatTemplate(ctx); err != nil {
+		return murmur.Fail(murmur.PhaseConfig, "format", err)
+	}
+
+	groups, err := targetRepoGroups(ctx)
+	if err != nil {
+		return err
+	}
+
+	repoDir := ctx.String("repodir")
+	var statuses []cloneStatus
+	referenced := make(map[string]bool)
+
+	for _, group := range groups {
+		target := group[0]
+		cloneDir := filepath.Join(repoDir, target.CloneDir())
+		referenced[target.CloneDir()] = true
+
+		s := cloneStatus{
+			Repo:       target.Repo,
+			Branch:     target.Branch,
+			Dir:        cloneDir,
+			Changes:    make(map[string][]string),
+			Referenced: true,
+		}
+		if err := readCloneStatus(ctx, &s, murmur.TargetPaths(group)); err != nil {
+			log.Warn("unable to read clone status", "repo", target.Repo, "branch", target.Branch, "dir", cloneDir, "error", err)
+			s.Error = err.Error()
+		}
+		statuses = append(statuses, s)
+	}
+
+	// clones that no target references
+	entries, err := os.ReadDir(dirOrCwd(repoDir))
+	if err != nil {
+		return fmt.Errorf("unable to read repodir, %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || !strings.Contains(name, ":") || referenced[name] {
+			continue
+		}
+		cloneDir := filepath.Join(repoDir, name)
+		if _, err := os.Stat(filepath.Join(cloneDir, ".git")); err != nil {
+			continue
+		}
+		repoName, branch, _ := strings.Cut(name, ":")
+		s := cloneStatus{
+			Repo:    repoName,
+			Branch:  branch,
+			Dir:     cloneDir,
+			Changes: make(map[string][]string),
+		}
+		if err := readCloneStatus(ctx, &s, nil); err != nil {
+			s.Error = err.Error()
+		}
+		statuses = append(statuses, s)
+	}
+
+	err = printList(ctx, statuses, nil, "REPO\tBRANCH\tHEAD\tAHEAD\tBEHIND\tCHANGES\tREFERENCED\tDIR", func(s cloneStatus) []string {
+		changes := 0
+		for _, c := range s.Changes {
+			changes += len(c)
+		}
+		head := shortSHA(s.Head)
+		if s.Error != "" {
+			head = "error"
+		}
+		return []string{s.Repo, s.HeadBranch, head, strconv.Itoa(s.Ahead), strconv.Itoa(s.Behind), strconv.Itoa(changes), strconv.FormatBool(s.Referenced), s.Dir}
+	})
+	if err != nil {
+		return err
+	}
+	return failures.Err()
+}
+
+// readCloneStatus populates the state of a clone, and the uncommitted changes
+// inside each of the paths
+func readCloneStatus(ctx *cli.Context, s *cloneStatus, paths []string) error {
+
+	if _, err := os.Stat(s.Dir); err != nil {
+		return fmt.Errorf("repository not cloned, %w", err)
+	}
+
+	if ctx.Bool("fetch") {
+		if err := murmur.ScrubRemote(s.Dir); err != nil {
+			return err
+		}
+		if _, err := gitAuth().GitOutput(s.Dir, "fetch", "--quiet", "origin"); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if s.HeadBranch, err = murmur.GitOutput(s.Dir, "rev-parse", "--abbrev-ref", "HEAD"); err != nil {
+		return err
+	}
+	if s.Head, err = murmur.GitOutput(s.Dir, "rev-parse", "HEAD"); err != nil {
+		return err
+	}
+
+	// ahead / behind the upstream branch, if there is one
+	if counts, err := murmur.GitOutput(s.Dir, "rev-list", "--left-right", "--count", "HEAD...@{upstream}"); err == nil {
+		fields := strings.Fields(counts)
+		if len(fields) == 2 {
+			s.Ahead, _ = strconv.Atoi(fields[0])
+			s.Behind, _ = strconv.Atoi(fields[1])
+		}
+	} else {
+		log.Debug("no upstream branch", "dir", s.Dir, "error", err)
+	}
+
+	for _, p := range paths {
+		out, err := murmur.GitOutput(s.Dir, "status", "--porcelain", "--untracked-files=all", "--", p)
+		if err != nil {
+			return err
+		}
+		if out == "" {
+			continue
+		}
+		s.Changes[p] = strings.Split(out, "\n")
+	}
+
+	return nil
+}
+
+// resetRepos discards the uncommitted murmur writes to the target paths of
+// clones
+func resetRepos(ctx *cli.Context) error {
+
+	if _, err := formatTemplate(ctx); err != nil {
+		return murmur.Fail(murmur.PhaseConfig, "format", err)
+	}
+
+	groups, err := targetRepoGroups(ctx)
+	if err != nil {
+		return err
+	}
+
+	var reset []resetFile
+
+	for _, group := range groups {
+		target := group[0]
+		cloneDir := filepath.Join(ctx.String("repodir"), target.CloneDir())
+		if _, err := os.Stat(cloneDir); err != nil {
+			log.Warn("repository not cloned", "repo", target.Repo, "branch", target.Branch, "dir", cloneDir)
+			continue
+		}
+
+		files, err := managedFiles(cloneDir, group)
+		if err != nil {
+			return err
+		}
+		changes, err := changedFiles(cloneDir, files)
+		if err != nil {
+			return err
+		}
+		if len(changes) == 0 {
+			continue
+		}
+
+		log.Info("discarding murmur writes", "repo", target.Repo, "branch", target.Branch, "dir", cloneDir, "files", len(changes))
+		changed := slices.Sorted(maps.Keys(changes))
+		for _, file := range changed {
+			reset = append(reset, resetFile{Dir: cloneDir, Status: strings.TrimSpace(changes[file]), File: file})
+		}
+		if err = discardChanges(cloneDir, changed); err != nil {
+			return fmt.Errorf("unable to reset %s, %w", cloneDir, err)
+		}
+	}
+
+	err = printList(ctx, reset, nil, "DIR\tSTATUS\tFILE", func(f resetFile) []string {
+		return []string{f.Dir, f.Status, f.File}
+	})
+	if err != nil {
+		return err
+	}
+	return failures.Err()
+}
+
+// targetRepoGroups reads the selected target files and returns the targets
+// grouped by repo / branch
+func targetRepoGroups(ctx *cli.Context) ([][]murmur.Target, error) {
+	files, err := getFiles(ctx, ctx.String("datadir"), "targets.json")
+	if err = fail(murmur.PhaseConfig, "files", err); err != nil {
+		return nil, err
+	}
+
+	targets, err := loadTargets(ctx, files)
+	if err != nil {
+		return nil, err
+	}
+
+	// fetching needs to authenticate to the remotes
+	if ctx.Bool("fetch") {
+		if err = gitAuth().Configure(targets); err != nil {
+			return nil, murmur.Fail(murmur.PhaseConfig, "credentials", err)
+		}
+	}
+
+	return murmur.RepoGroups(targets), nil
+}
+
+// managedFiles returns the files of a clone murmur manages for a group of
+// targets, relative to the clone: the files rendered for the targets, their
+// manifests and the files the manifests record
+func managedFiles(cloneDir string, targets []murmur.Target) ([]string, error) {
+	files, err := murmur.ManagedFiles(targets)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range murmur.TargetPaths(targets) {
+		m, err := murmur.ReadManifest(filepath.Join(cloneDir, path))
+		if err != nil {
+			return nil, err
+		}
+		for name := range m {
+			if file := filepath.Join(path, filepath.FromSlash(name)); !slices.Contains(files, file) {
+				files = append(files, file)
+			}
+		}
+	}
+	return files, nil
+}
+
+// changedFiles returns the files with uncommitted changes, and their porcelain
+// status (i.e. ' M', '??'), among files of a clone
+func changedFiles(cloneDir string, files []string) (map[string]string, error) {
+	changes := make(map[string]string)
+	if len(files) == 0 {
+		return changes, nil
+	}
+	out, err := murmur.GitOutput(cloneDir, append([]string{"status", "--porcelain", "-z", "--untracked-files=all", "--no-renames", "--"}, files...)...)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range strings.Split(out, "\x00") {
+		if len(entry) > 3 {
+			changes[entry[3:]] = entry[:2]
+		}
+	}
+	return changes, nil
+}
+
+// discardChanges reverts the changes to files of a clone: they are unstaged,
+// tracked files are checked out and untracked files are removed, with the
+// directories left empty
+func discardChanges(cloneDir string, files []string) error {
+	if _, err := murmur.GitOutput(cloneDir, append([]string{"reset", "--quiet", "--"}, files...)...); err != nil {
+		return err
+	}
+	tracked, err := murmur.GitOutput(cloneDir, append([]string{"ls-files", "-z", "--"}, files...)...)
+	if err != nil {
+		return err
+	}
+	var checkout []string
+	for _, file := range strings.Split(tracked, "\x00") {
+		if file != "" {
+			checkout = append(checkout, file)
+		}
+	}
+	if len(checkout) > 0 {
+		if _, err = murmur.GitOutput(cloneDir, append([]string{"checkout", "--"}, checkout...)...); err != nil {
+			return err
+		}
+	}
+	for _, file := range files {
+		if slices.Contains(checkout, filepath.ToSlash(file)) {
+			continue
+		}
+		if err = os.Remove(filepath.Join(cloneDir, file)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		// os.Remove fails on the first directory that is not empty
+		for dir := filepath.Dir(file); dir != "."; dir = filepath.Dir(dir) {
+			if os.Remove(filepath.Join(cloneDir, dir)) != nil {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// printJSON writes v to stdout as indented JSON
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// dirOrCwd returns dir, or "." if it is empty
+func dirOrCwd(dir string) string {
+	if dir == "" {
+		return "."
+	}
+	return dir
+}
+
+func shortSHA(sha string) string {
+	if len(sha) > 12 {
+		return sha[:12]
+	}
+	return sha
+}
@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jswank/murmur/pkg/murmur"
+
+	cli "github.com/urfave/cli/v2"
+)
+
+// metricsFileFlag and otlpEndpointFlag enable the telemetry of runs
+var metricsFileFlag = &cli.StringFlag{
+	Name:  "metrics-file",
+	Usage: "Write Prometheus metrics of the run to a file, i.e. for the node_exporter textfile collector. Can be set using $MURMUR_METRICS_FILE",
+	Value: os.Getenv("MURMUR_METRICS_FILE"),
+}
+
+var otlpEndpointFlag = &cli.StringFlag{
+	Name:  "otlp-endpoint",
+	Usage: "Export spans of the run to an OTLP/HTTP collector, i.e. http://localhost:4318. Can be set using $OTEL_EXPORTER_OTLP_ENDPOINT",
+	Value: os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+}
+
+// telemetry collects the events of the command run, set up by BeforeFunc
+var telemetry struct {
+	command     string
+	start       time.Time
+	metricsFile string
+	metrics     *murmur.Metrics
+	tracer      *murmur.Tracer
+	perRun      bool // the runs of serve export their own telemetry
+}
+
+// setupTelemetry enables the exporters of the command line flags
+func setupTelemetry(ctx *cli.Context) {
+	command := commandName(ctx)
+	telemetry.command = "murmur " + command
+	telemetry.start = time.Now()
+
+	telemetry.metricsFile = ctx.String("metrics-file")
+	if telemetry.metricsFile != "" {
+		telemetry.metrics = &murmur.Metrics{
+			Labels: map[string]string{"command": command},
+		}
+	}
+	if ctx.String("otlp-endpoint") != "" {
+		telemetry.tracer = &murmur.Tracer{
+			Endpoint:    ctx.String("otlp-endpoint"),
+			Headers:     otlpHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")),
+			ServiceName: os.Getenv("OTEL_SERVICE_NAME"),
+		}
+	}
+}
+
+// observer returns the observer of the pipeline components, nil if telemetry,
+// notifications and the audit journal are disabled
+func observer() murmur.Observer {
+	if telemetry.metrics == nil && telemetry.tracer == nil && notifier == nil && journal == nil {
+		return nil
+	}
+	return func(e murmur.Event) {
+		if telemetry.metrics != nil {
+			telemetry.metrics.Observe(e)
+		}
+		if telemetry.tracer != nil {
+			telemetry.tracer.Observe(e)
+		}
+		if notifier != nil {
+			notifier.Observe(e)
+		}
+		if journal != nil {
+			journal.Observe(e)
+		}
+	}
+}
+
+// ExportTelemetry writes the metrics and exports the spans of the command run,
+// which ended with err. It does nothing if telemetry is disabled.
+func ExportTelemetry(err error) error {
+	if telemetry.perRun {
+		return nil
+	}
+	return exportTelemetry(telemetry.metrics, telemetry.tracer, auth, telemetry.command, telemetry.start, err)
+}
+
+// exportTelemetry writes the metrics (if set) and exports the spans (if set)
+// of a run that started at start and ended with err
+func exportTelemetry(metrics *murmur.Metrics, tracer *murmur.Tracer, auth *murmur.GitAuth, command string, start time.Time, err error) error {
+	var errs []error
+	duration := time.Since(start)
+
+	if metrics != nil {
+		// cached GitHub App tokens
+		if auth != nil {
+			if cache, ok := auth.Credentials.(interface{ CacheStats() (int, int) }); ok {
+				hits, misses := cache.CacheStats()
+				metrics.SetCache("credentials", hits, misses)
+			}
+		}
+		errs = append(errs, metrics.WriteTextfile(telemetry.metricsFile, duration, murmur.ExitCode(err)))
+	}
+	if tracer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		errs = append(errs, tracer.Export(ctx, command, start, err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// commandName returns the name of the command run, i.e. "repos clone"
+func commandName(ctx *cli.Context) string {
+	// the help name is the full command line, i.e. "murmur repos clone"
+	_, name, _ := strings.Cut(ctx.Command.HelpName, " ")
+	return name
+}
+
+// otlpHeaders parses the headers of $OTEL_EXPORTER_OTLP_HEADERS: a comma
+// separated list of name=value, with URL encoded values
+func otlpHeaders(s string) map[string]string {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		if v, err := url.QueryUnescape(strings.TrimSpace(value)); err == nil {
+			value = v
+		}
+		headers[strings.TrimSpace(name)] = value
+	}
+	return headers
+}
@@ -4,10 +4,8 @@ import (
 	"bufio"
 	"fmt"
 	"io"
-	"io/fs"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/jswank/murmur/pkg/murmur"
 
@@ -27,9 +25,9 @@ func readListFromStdin() ([]string, error) {
 }
 
 // getFiles returns a list of matching files from the commandline arguments
-// if 'dir' is specified, it will be searched for matching files
+// if 'dir' is specified, it will be searched for files with any of the suffixes
 // otherwise, use the first argument as the only file, or read a list from stdin
-func getFiles(ctx *cli.Context, dir, suffix string) ([]string, error) {
+func getFiles(ctx *cli.Context, dir string, suffixes ...string) ([]string, error) {
 
 	var files []string
 	var err error
@@ -48,8 +46,8 @@ func getFiles(ctx *cli.Context, dir, suffix string) ([]string, error) {
 			files = ctx.Args().Slice()
 		}
 	} else if dir != "" {
-		log.Debug("searching for files", "dir", dir, "suffix", suffix)
-		files, err = findFiles(dir, suffix)
+		log.Debug("searching for files", "dir", dir, "suffix", suffixes)
+		files, err = murmur.FindFiles(dir, suffixes...)
 		if err != nil {
 			return files, err
 		}
@@ -66,7 +64,7 @@ func getFiles(ctx *cli.Context, dir, suffix string) ([]string, error) {
 	}
 
 	if len(files) == 0 {
-		log.Warn("no matching files", "dir", dir, "suffix", suffix, "filter", ctx.String("filter"))
+		log.Warn("no matching files", "dir", dir, "suffix", suffixes, "filter", ctx.String("filter"), "hierarchy", config.Hierarchy.String())
 		return files, fmt.Errorf("no files matched the filter")
 	}
 
@@ -75,24 +73,6 @@ func getFiles(ctx *cli.Context, dir, suffix string) ([]string, error) {
 	return files, nil
 }
 
-// search recursively for suffixed files in the specified directory
-func findFiles(dir, suffix string) ([]string, error) {
-	var files []string
-	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if !d.IsDir() && strings.HasSuffix(d.Name(), suffix) {
-			files = append(files, path)
-		}
-		return nil
-	})
-	if err != nil {
-		return nil, fmt.Errorf("unable to search for files: %w", err)
-	}
-	return files, nil
-}
-
 // filterFiles returns a list of files that match the filter
 func filterFiles(files []string, filter string) ([]string, error) {
 	filter += "/*"
@@ -109,21 +89,6 @@ func filterFiles(files []string, filter string) ([]string, error) {
 	return filtered, nil
 }
 
-// getTargets reads target files and returns the list of Target structs that
-// they contain
-func getTargets(files []string) ([]murmur.Target, error) {
-	var targets []murmur.Target
-	for _, file := range files {
-		t, err := murmur.NewTargetsFromFile(file)
-		if err != nil {
-			log.Error("unable to read target file", "file", file, "error", err)
-			continue
-		}
-		targets = append(targets, t...)
-	}
-	return targets, nil
-}
-
 // Copy a file from src to dst using io.Copy
 func copyFile(src, dst string) error {
 	srcFile, err := os.Open(src)
@@ -155,19 +120,50 @@ func BeforeFunc(ctx *cli.Context) error {
 		return fmt.Errorf("unable to create a logger, %w", err)
 	}
 
+	if configErr != nil {
+		return murmur.Fail(murmur.PhaseConfig, "config", configErr)
+	}
+
+	setupTelemetry(ctx)
+
+	// collect failures up to the failure budget
+	failures.Max = ctx.Int("max-failures")
+	if ctx.Bool("errexit") {
+		failures.Max = 1
+	}
+	if config.Filename != "" {
+		log.Debug("loaded config", "file", config.Filename, "hierarchy", config.Hierarchy.String())
+	}
+
 	// set datadir to "."
 	if ctx.String("datadir") == "" {
 		ctx.Set("datadir", ".")
 	}
-
-	if ctx.String("team") != "*" || ctx.String("app") != "*" || ctx.String("env") != "*" {
+	setupNotifications(ctx)
+	setupJournal(ctx)
+
+	// build a filter from the hierarchy level flags, i.e. --team, --app, --env
+	sel := make(murmur.Selection)
+	for _, level := range config.Hierarchy {
+		if v := ctx.String(level); v != "" && v != "*" {
+			sel[level] = v
+		}
+	}
+	if len(sel) > 0 {
 		if ctx.String("filter") != "" {
-			log.Warn("filter is specified, ignoring team/app/env flags", "filter", ctx.String("filter"))
+			log.Warn(fmt.Sprintf("filter is specified, ignoring %s flags", config.Hierarchy), "filter", ctx.String("filter"))
 		} else {
-			ctx.Set("filter", fmt.Sprintf("%s/%s/%s", ctx.String("team"), ctx.String("app"), ctx.String("env")))
+			ctx.Set("filter", config.Hierarchy.Pattern(sel))
 		}
 	}
-	log.Info("filter", "filter", ctx.String("filter"))
+
+	if ctx.String("filter") != "" {
+		sel, err = config.Hierarchy.Parse(ctx.String("filter"))
+		if err != nil {
+			return murmur.Fail(murmur.PhaseConfig, "filter", fmt.Errorf("invalid filter, %w", err))
+		}
+	}
+	log.Info("filter", append([]any{"filter", ctx.String("filter")}, selectionAttrs(sel)...)...)
 
 	// if destdir is a relative path, make it absolute based on the current
 	// working directory. An absolute path is required because the directory is
@@ -182,3 +178,13 @@ func BeforeFunc(ctx *cli.Context) error {
 
 	return nil
 }
+
+// selectionAttrs returns log attributes for each hierarchy level of a
+// selection, in hierarchy order
+func selectionAttrs(sel murmur.Selection) []any {
+	var attrs []any
+	for _, level := range config.Hierarchy {
+		attrs = append(attrs, level, sel.Get(level))
+	}
+	return attrs
+}
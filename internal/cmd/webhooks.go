@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/jswank/murmur/pkg/murmur"
+)
+
+// pushEvent is a git push to the datadir repo, from a GitHub or GitLab
+// webhook
+type pushEvent struct {
+	Repo    string   // i.e. org/datadir
+	Ref     string   // i.e. refs/heads/main
+	After   string   // the commit pushed
+	Files   []string // added, modified and removed, relative to the repo
+	Partial bool     // the payload does not list every commit
+}
+
+// githubPayloadCommits is the maximum number of commits in the payload of a
+// GitHub push event
+const githubPayloadCommits = 20
+
+// pushPayload holds the fields shared by GitHub and GitLab push payloads
+type pushPayload struct {
+	Ref        string `json:"ref"`
+	After      string `json:"after"`
+	Repository struct {
+		FullName string `json:"full_name"` // GitHub
+	} `json:"repository"`
+	Project struct {
+		PathWithNamespace string `json:"path_with_namespace"` // GitLab
+	} `json:"project"`
+	Commits []struct {
+		Added    []string `json:"added"`
+		Modified []string `json:"modified"`
+		Removed  []string `json:"removed"`
+	} `json:"commits"`
+	TotalCommitsCount int `json:"total_commits_count"` // GitLab
+}
+
+// parseGitHubPush verifies the signature of a GitHub webhook and returns its
+// push event. A nil event is returned for other events, i.e. ping.
+func parseGitHubPush(r *http.Request, body []byte, secret string) (*pushEvent, error) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(r.Header.Get("X-Hub-Signature-256")), []byte(expected)) {
+		return nil, errUnauthorized
+	}
+	if r.Header.Get("X-GitHub-Event") != "push" {
+		return nil, nil
+	}
+
+	var p pushPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, fmt.Errorf("invalid push payload, %w", err)
+	}
+	event := p.event(p.Repository.FullName)
+	event.Partial = len(p.Commits) >= githubPayloadCommits
+	return event, nil
+}
+
+// parseGitLabPush verifies the token of a GitLab webhook and returns its push
+// event. A nil event is returned for other events.
+func parseGitLabPush(r *http.Request, body []byte, secret string) (*pushEvent, error) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), []byte(secret)) != 1 {
+		return nil, errUnauthorized
+	}
+	if r.Header.Get("X-Gitlab-Event") != "Push Hook" {
+		return nil, nil
+	}
+
+	var p pushPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, fmt.Errorf("invalid push payload, %w", err)
+	}
+	event := p.event(p.Project.PathWithNamespace)
+	event.Partial = p.TotalCommitsCount > len(p.Commits)
+	return event, nil
+}
+
+// event returns the push event of a payload
+func (p pushPayload) event(repo string) *pushEvent {
+	event := &pushEvent{Repo: repo, Ref: p.Ref, After: p.After}
+	for _, c := range p.Commits {
+		for _, files := range [][]string{c.Added, c.Modified, c.Removed} {
+			for _, f := range files {
+				if !slices.Contains(event.Files, f) {
+					event.Files = append(event.Files, f)
+				}
+			}
+		}
+	}
+	return event
+}
+
+// pushFilters returns the filters of the hierarchy directories affected by the
+// files of a push. prefix is the path of the datadir in its repo. A file in a
+// hierarchy directory selects it and the directories below: a change to
+// ops/web/common.libsonnet selects ops/web/*. A file that is not in a
+// hierarchy directory (i.e. lib/) selects everything, as does a push that
+// does not list all of its files.
+func pushFilters(h murmur.Hierarchy, datadir, prefix string, event *pushEvent) []string {
+	all := h.Pattern(nil)
+	if event.Partial {
+		return []string{all}
+	}
+
+	var filters []string
+	for _, file := range event.Files {
+		rel, ok := strings.CutPrefix(file, prefix)
+		if !ok {
+			continue
+		}
+
+		sel := make(murmur.Selection)
+		dirs := strings.Split(path.Dir(rel), "/")
+		for i, level := range h {
+			if i < len(dirs) && dirs[i] != "." {
+				sel[level] = dirs[i]
+			}
+		}
+		filter := h.Pattern(sel)
+		if matches, _ := filepath.Glob(filepath.Join(datadir, filter)); len(matches) == 0 {
+			filter = all
+		}
+		if filter == all {
+			return []string{all}
+		}
+		if !slices.Contains(filters, filter) {
+			filters = append(filters, filter)
+		}
+	}
+	return filters
+}
+
+// remoteRepo returns the repo of a remote URL, i.e. org/datadir for
+// https://github.com/org/datadir.git or git@github.com:org/datadir.git, ""
+// if it has no path
+func remoteRepo(remote string) string {
+	var repo string
+	if u, err := url.Parse(remote); err == nil && u.Scheme != "" && u.Host != "" {
+		repo = u.Path
+	} else if _, p, ok := strings.Cut(remote, ":"); ok && !strings.Contains(remote, "://") {
+		// scp-like syntax, user@host:path
+		repo = p
+	}
+	return strings.TrimSuffix(strings.Trim(repo, "/"), ".git")
+}
@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/jswank/murmur/pkg/murmur"
+)
+
+func TestPushFilters(t *testing.T) {
+	datadir := t.TempDir()
+	for _, dir := range []string{"ops/web/prod", "ops/web/dev", "ops/api/prod", "lib"} {
+		if err := os.MkdirAll(filepath.Join(datadir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := murmur.Hierarchy{"team", "app", "env"}
+
+	tests := []struct {
+		name    string
+		prefix  string
+		files   []string
+		partial bool
+		want    []string
+	}{
+		{name: "env directory", files: []string{"ops/web/prod/web.jsonnet"}, want: []string{"ops/web/prod"}},
+		{name: "app directory", files: []string{"ops/web/common.libsonnet"}, want: []string{"ops/web/*"}},
+		{name: "team directory", files: []string{"ops/team.libsonnet"}, want: []string{"ops/*/*"}},
+		{
+			name:  "several directories, once each",
+			files: []string{"ops/web/prod/web.jsonnet", "ops/api/prod/api.jsonnet", "ops/web/prod/web-targets.json"},
+			want:  []string{"ops/web/prod", "ops/api/prod"},
+		},
+		{name: "outside the hierarchy", files: []string{"ops/web/prod/a.jsonnet", "lib/k8s.libsonnet"}, want: []string{"*/*/*"}},
+		{name: "root of the datadir", files: []string{"murmur.json"}, want: []string{"*/*/*"}},
+		{name: "unknown directory", files: []string{"ops/db/prod/db.jsonnet"}, want: []string{"*/*/*"}},
+		{name: "partial push", files: []string{"ops/web/prod/web.jsonnet"}, partial: true, want: []string{"*/*/*"}},
+		{name: "datadir in a subdirectory", prefix: "data/", files: []string{"README.md", "data/ops/web/dev/web.jsonnet"}, want: []string{"ops/web/dev"}},
+		{name: "outside the datadir", prefix: "data/", files: []string{"README.md"}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pushFilters(h, datadir, tt.prefix, &pushEvent{Files: tt.files, Partial: tt.partial})
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("filters %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoteRepo(t *testing.T) {
+	tests := []struct {
+		remote string
+		want   string
+	}{
+		{"https://github.com/org/datadir.git", "org/datadir"},
+		{"https://github.com/org/datadir", "org/datadir"},
+		{"https://gitlab.example.com/group/sub/datadir.git/", "group/sub/datadir"},
+		{"ssh://git@github.com:22/org/datadir.git", "org/datadir"},
+		{"git@github.com:org/datadir.git", "org/datadir"},
+		{"https://github.com", ""},
+	}
+	for _, tt := range tests {
+		if got := remoteRepo(tt.remote); got != tt.want {
+			t.Errorf("remoteRepo(%q) = %q, want %q", tt.remote, got, tt.want)
+		}
+	}
+}
+
+func TestGitHubWebhook(t *testing.T) {
+	const secret = "s3cret"
+	s := &server{
+		runner:        &runner{branch: "main", queue: make(chan *run, 1)},
+		webhookSecret: secret,
+		webhookRepo:   "org/datadir",
+	}
+
+	tests := []struct {
+		name      string
+		repo, ref string
+		signature string // default: the signature of the payload
+		status    int
+		want      string // the status, or error, of the response
+	}{
+		{name: "push", repo: "org/datadir", ref: "refs/heads/main", status: http.StatusAccepted, want: "queued"},
+		{name: "other repo", repo: "evil/datadir", ref: "refs/heads/main", status: http.StatusOK, want: "ignored"},
+		{name: "other branch", repo: "org/datadir", ref: "refs/heads/dev", status: http.StatusOK, want: "ignored"},
+		{name: "bad signature", repo: "org/datadir", ref: "refs/heads/main", signature: "sha256=00", status: http.StatusUnauthorized, want: "unauthorized"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(map[string]any{
+				"ref":        tt.ref,
+				"after":      "abc",
+				"repository": map[string]string{"full_name": tt.repo},
+				"commits":    []map[string][]string{{"modified": {"ops/web/prod/web.jsonnet"}}},
+			})
+			signature := tt.signature
+			if signature == "" {
+				mac := hmac.New(sha256.New, []byte(secret))
+				mac.Write(body)
+				signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/webhooks/github", strings.NewReader(string(body)))
+			req.Header.Set("X-GitHub-Event", "push")
+			req.Header.Set("X-Hub-Signature-256", signature)
+			rec := httptest.NewRecorder()
+			s.webhook("github", parseGitHubPush)(rec, req)
+
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			var resp map[string]any
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+			if resp["status"] != tt.want && resp["error"] != tt.want {
+				t.Errorf("response %s, want %s", rec.Body, tt.want)
+			}
+			// empty the queue
+			select {
+			case <-s.runner.queue:
+			default:
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package murmur
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// writeMarker is created in the git directory of a clone while its files are
+// written, and removed once they are all written or rolled back. A clone with
+// the marker was left partially written, i.e. by a crash, and is not committed.
+const writeMarker = "murmur-write-in-progress"
+
+// writeMarkerFile returns the marker of a clone, "" if it is not a git repo
+func writeMarkerFile(cloneDir string) string {
+	gitDir, err := GitOutput(cloneDir, "rev-parse", "--absolute-git-dir")
+	if err != nil || gitDir == "" {
+		return ""
+	}
+	return filepath.Join(gitDir, writeMarker)
+}
+
+// checkWriteMarker returns an error if the files of a clone were left
+// partially written
+func checkWriteMarker(cloneDir string) error {
+	marker := writeMarkerFile(cloneDir)
+	if marker == "" {
+		return nil
+	}
+	if _, err := os.Stat(marker); err == nil {
+		return errors.New("the clone was left partially written by an interrupted write: write it again, or clone it again with --overwrite")
+	}
+	return nil
+}
+
+// writeTx stages the writes to a clone so that they can be rolled back. Files
+// are replaced atomically, the files they replace are backed up, and the
+// files and directories that are created are recorded.
+type writeTx struct {
+	backupDir string
+	backups   map[string]string // replaced file: its backup
+	created   []string          // files and directories, in the order they were created
+}
+
+// mkdirAll creates a directory and its missing parents
+func (tx *writeTx) mkdirAll(dir string) error {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Lstat(d); err == nil || filepath.Dir(d) == d {
+			break
+		}
+		missing = append(missing, d)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		tx.created = append(tx.created, missing[i])
+	}
+	return nil
+}
+
+// writeFile writes data to dst, backing up dst the first time it is replaced
+func (tx *writeTx) writeFile(dst string, data []byte) error {
+	if _, ok := tx.backups[dst]; !ok && !tx.isCreated(dst) {
+		fi, err := os.Lstat(dst)
+		switch {
+		case err == nil && !fi.Mode().IsRegular():
+			return fmt.Errorf("%s is not a regular file", dst)
+		case err == nil:
+			if err = tx.backup(dst); err != nil {
+				return fmt.Errorf("unable to back up %s, %w", dst, err)
+			}
+		case errors.Is(err, fs.ErrNotExist):
+			tx.created = append(tx.created, dst)
+		default:
+			return err
+		}
+	}
+	return writeFile(dst, bytes.NewReader(data))
+}
+
+func (tx *writeTx) isCreated(file string) bool {
+	for _, f := range tx.created {
+		if f == file {
+			return true
+		}
+	}
+	return false
+}
+
+// backup copies a file to the backup directory of the transaction
+func (tx *writeTx) backup(file string) error {
+	if tx.backupDir == "" {
+		dir, err := os.MkdirTemp("", "murmur-backup-")
+		if err != nil {
+			return err
+		}
+		tx.backupDir, tx.backups = dir, make(map[string]string)
+	}
+	backup := filepath.Join(tx.backupDir, strconv.Itoa(len(tx.backups)))
+	if err := copyFile(file, backup); err != nil {
+		return err
+	}
+	tx.backups[file] = backup
+	return nil
+}
+
+// rollback restores the files replaced and removes the files and directories
+// created, leaving the clone as it was before the transaction
+func (tx *writeTx) rollback() error {
+	var errs []error
+	for file, backup := range tx.backups {
+		if err := copyFile(backup, file); err != nil {
+			errs = append(errs, fmt.Errorf("unable to restore %s, %w", file, err))
+		}
+	}
+	for i := len(tx.created) - 1; i >= 0; i-- {
+		if err := os.Remove(tx.created[i]); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("unable to remove %s, %w", tx.created[i], err))
+		}
+	}
+	tx.close()
+	return errors.Join(errs...)
+}
+
+// close removes the backups of the transaction
+func (tx *writeTx) close() {
+	if tx.backupDir != "" {
+		os.RemoveAll(tx.backupDir)
+	}
+}
+
+// copyFile copies a file from src to dst atomically
+func copyFile(src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	return writeFile(dst, srcFile)
+}
+
+// writeFile writes the content of r to dst atomically: it is written to a
+// temporary file next to dst, which is renamed over it, so that dst is never
+// partially written. dst keeps its mode if it exists.
+func writeFile(dst string, r io.Reader) error {
+	mode := fs.FileMode(0644)
+	if fi, err := os.Stat(dst); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".murmur-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
@@ -0,0 +1,183 @@
+package murmur
+
+import (
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// snapshot returns the files (with their content and mode) and directories
+// under dir
+func snapshot(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, p)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			files[rel+"/"] = ""
+			return nil
+		}
+		content, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		files[rel] = info.Mode().String() + " " + string(content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestWriteTxRollback(t *testing.T) {
+	type write struct {
+		file    string
+		content string
+	}
+	tests := []struct {
+		name   string
+		dirs   []string // directories created with mkdirAll
+		writes []write
+	}{
+		{name: "nothing"},
+		{name: "replace", writes: []write{{"deploy/a.json", "new"}}},
+		{name: "replace twice", writes: []write{{"deploy/a.json", "new"}, {"deploy/a.json", "newer"}}},
+		{name: "replace a file with another mode", writes: []write{{"deploy/run.sh", "new"}}},
+		{name: "create", writes: []write{{"deploy/b.json", "new"}}},
+		{name: "create then replace", writes: []write{{"deploy/b.json", "new"}, {"deploy/b.json", "newer"}}},
+		{name: "create directories", dirs: []string{"deploy/stacks/web"}, writes: []write{{"deploy/stacks/web/a.json", "new"}}},
+		{name: "create nested directories twice", dirs: []string{"x/y", "x/y/z", "x/w"}, writes: []write{{"x/y/z/a.json", "new"}, {"x/w/b.json", "new"}}},
+		{name: "everything", dirs: []string{"deploy/new"}, writes: []write{
+			{"deploy/a.json", "new"},
+			{"deploy/new/b.json", "new"},
+			{"deploy/run.sh", "new"},
+			{"deploy/c.json", "new"},
+			{"deploy/a.json", "newer"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(dir, "deploy"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "deploy", "a.json"), []byte("old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "deploy", "run.sh"), []byte("old"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			before := snapshot(t, dir)
+
+			var tx writeTx
+			for _, d := range tt.dirs {
+				if err := tx.mkdirAll(filepath.Join(dir, d)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, w := range tt.writes {
+				file := filepath.Join(dir, w.file)
+				if err := tx.writeFile(file, []byte(w.content)); err != nil {
+					t.Fatal(err)
+				}
+				if content, _ := os.ReadFile(file); string(content) != w.content {
+					t.Fatalf("%s: %q, want %q", w.file, content, w.content)
+				}
+			}
+			// replaced files keep their mode
+			if fi, err := os.Stat(filepath.Join(dir, "deploy", "run.sh")); err != nil || fi.Mode().Perm() != 0755 {
+				t.Errorf("run.sh mode %v, error %v", fi.Mode(), err)
+			}
+
+			backupDir := tx.backupDir
+			if err := tx.rollback(); err != nil {
+				t.Fatal(err)
+			}
+			if after := snapshot(t, dir); !maps.Equal(before, after) {
+				t.Errorf("rolled back to\n%v\nwant\n%v", after, before)
+			}
+			if backupDir != "" {
+				if _, err := os.Stat(backupDir); err == nil {
+					t.Errorf("backups %s not removed", backupDir)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteTxClose(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.json")
+	if err := os.WriteFile(file, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tx writeTx
+	if err := tx.writeFile(file, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if tx.backupDir == "" {
+		t.Fatal("a.json not backed up")
+	}
+	tx.close()
+	if _, err := os.Stat(tx.backupDir); err == nil {
+		t.Errorf("backups %s not removed", tx.backupDir)
+	}
+	if content, _ := os.ReadFile(file); string(content) != "new" {
+		t.Errorf("a.json %q, want new", content)
+	}
+	// no temporary file is left next to the file
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d files, want 1", len(entries))
+	}
+}
+
+func TestWriteTxNotRegular(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Symlink("b.json", filepath.Join(dir, "a.json")); err != nil {
+		t.Fatal(err)
+	}
+	var tx writeTx
+	err := tx.writeFile(filepath.Join(dir, "a.json"), []byte("new"))
+	if err == nil || !strings.Contains(err.Error(), "is not a regular file") {
+		t.Errorf("error %v", err)
+	}
+	if _, err = os.Lstat(filepath.Join(dir, "b.json")); err == nil {
+		t.Error("b.json written through the symlink")
+	}
+}
+
+func TestCheckWriteMarker(t *testing.T) {
+	dir := t.TempDir()
+	// a directory that is not a git repo has no marker
+	if marker := writeMarkerFile(dir); marker != "" {
+		t.Errorf("marker %s", marker)
+	}
+	if _, err := GitOutput(dir, "init", "--quiet"); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWriteMarker(dir); err != nil {
+		t.Fatal(err)
+	}
+	marker := writeMarkerFile(dir)
+	if filepath.Base(marker) != writeMarker || filepath.Base(filepath.Dir(marker)) != ".git" {
+		t.Fatalf("marker %s", marker)
+	}
+	if err := os.WriteFile(marker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWriteMarker(dir); err == nil || !strings.Contains(err.Error(), "partially written") {
+		t.Errorf("error %v", err)
+	}
+}
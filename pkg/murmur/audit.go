@@ -0,0 +1,341 @@
+package murmur
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit operations
+const (
+	AuditWrite  = "write"  // a file written to a clone
+	AuditDelete = "delete" // a file deleted by a commit
+	AuditCommit = "commit" // a commit made in a clone
+	AuditPush   = "push"   // a commit pushed
+)
+
+// AuditRecord is an operation of the audit journal
+type AuditRecord struct {
+	Time          time.Time `json:"time"`
+	Op            string    `json:"op"` // write, delete, commit or push
+	User          string    `json:"user"`
+	Host          string    `json:"host"`
+	Command       string    `json:"command,omitempty"`
+	DataDirCommit string    `json:"datadir_commit,omitempty"` // HEAD of the datadir
+	DataDirDirty  bool      `json:"datadir_dirty,omitempty"`  // the datadir has uncommitted changes
+	Selection     []string  `json:"selection,omitempty"`      // the sources, i.e. team/app/env
+	Repo          string    `json:"repo"`
+	Branch        string    `json:"branch"`
+	Target        string    `json:"target,omitempty"` // the path of the target in the repo
+	Path          string    `json:"path,omitempty"`   // the file, relative to the repo
+	SHA256        string    `json:"sha256,omitempty"` // of the content written
+	Commit        string    `json:"commit,omitempty"`
+	Files         []string  `json:"files,omitempty"` // the files of a commit
+}
+
+// Journal records the files written to clones, the files deleted and the
+// commits made and pushed as an append-only NDJSON journal: each record is
+// appended to File, and posted to URL, as it happens. Records that could not
+// be posted are sent again with the next records, and when the journal is
+// closed.
+type Journal struct {
+	File    string // appended to, created if it does not exist
+	URL     string // receives the records as NDJSON, i.e. a log collector
+	Command string // the command run, i.e. "generate"
+	DataDir string // the datadir, for the commit it is at
+	Client  *http.Client
+
+	mu      sync.Mutex
+	base    *AuditRecord  // the fields shared by every record of the run
+	pending []AuditRecord // not posted yet
+	errs    []error
+}
+
+// Observe records the operations of an event, i.e. as the Observer of a
+// Pipeline, GitWriter or GitPublisher
+func (j *Journal) Observe(e Event) {
+	if e.Err != nil {
+		return
+	}
+	record := AuditRecord{Repo: e.Repo, Branch: e.Branch, Selection: e.Sources, Commit: e.Commit}
+
+	var records []AuditRecord
+	switch e.Kind {
+	case EventTarget:
+		record.Op, record.Target = AuditWrite, e.Path
+		for _, file := range e.Files {
+			r := record
+			r.Path = repoPath(e.Dir, file)
+			r.SHA256, _ = fileSHA256(file)
+			records = append(records, r)
+		}
+	case EventCommit:
+		// the files of the commit that no longer exist were deleted
+		for _, file := range e.Files {
+			if _, err := os.Stat(filepath.Join(e.Dir, file)); os.IsNotExist(err) {
+				r := record
+				r.Op, r.Path = AuditDelete, file
+				records = append(records, r)
+			}
+		}
+		record.Op, record.Files = AuditCommit, e.Files
+		records = append(records, record)
+	case EventPush:
+		record.Op = AuditPush
+		records = append(records, record)
+	}
+	if len(records) > 0 {
+		j.Record(records...)
+	}
+}
+
+// Record appends records to the journal. The time, user, host, command and
+// datadir commit of records are set if they are empty.
+func (j *Journal) Record(records ...AuditRecord) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	base := j.baseRecord()
+
+	var b bytes.Buffer
+	for _, r := range records {
+		if r.Time.IsZero() {
+			r.Time = time.Now().UTC()
+		}
+		if r.User == "" {
+			r.User, r.Host = base.User, base.Host
+		}
+		if r.Command == "" {
+			r.Command = base.Command
+		}
+		if r.DataDirCommit == "" {
+			r.DataDirCommit, r.DataDirDirty = base.DataDirCommit, base.DataDirDirty
+		}
+		line, err := json.Marshal(r)
+		if err != nil {
+			j.errs = append(j.errs, err)
+			continue
+		}
+		b.Write(append(line, '\n'))
+		if j.URL != "" {
+			j.pending = append(j.pending, r)
+		}
+	}
+
+	if j.File != "" {
+		if err := appendFile(j.File, b.Bytes()); err != nil {
+			j.errs = append(j.errs, fmt.Errorf("unable to write audit journal, %w", err))
+		}
+	}
+
+	// records are posted as they happen so that a crash loses none
+	if len(j.pending) > 0 {
+		if err := j.post(context.Background()); err == nil {
+			j.pending = nil
+		}
+	}
+}
+
+// baseRecord returns the fields shared by the records of the run, read once
+func (j *Journal) baseRecord() *AuditRecord {
+	if j.base != nil {
+		return j.base
+	}
+	j.base = &AuditRecord{Command: j.Command}
+	if u, err := user.Current(); err == nil {
+		j.base.User = u.Username
+	} else {
+		j.base.User = os.Getenv("USER")
+	}
+	j.base.Host, _ = os.Hostname()
+	if j.DataDir != "" {
+		// the journal is not a change of the datadir
+		j.base.DataDirCommit, j.base.DataDirDirty = dataDirCommit(j.DataDir, j.File)
+	}
+	return j.base
+}
+
+// Close posts the records that could not be posted to URL, and returns the
+// errors of the journal
+func (j *Journal) Close(ctx context.Context) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if len(j.pending) > 0 {
+		if err := j.post(ctx); err != nil {
+			j.errs = append(j.errs, fmt.Errorf("unable to send %d audit record(s), %w", len(j.pending), err))
+		} else {
+			j.pending = nil
+		}
+	}
+	err := errors.Join(j.errs...)
+	j.errs = nil
+	return err
+}
+
+// post sends the pending records to URL as NDJSON
+func (j *Journal) post(ctx context.Context) error {
+	// the URL of the endpoint may carry its credentials
+	AddSecrets(j.URL)
+
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, r := range j.pending {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, j.URL, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	client := j.Client
+	if client == nil {
+		client = &http.Client{Timeout: 30 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// appendFile appends data to a file with a single write, and syncs it
+func appendFile(file string, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// repoPath returns the path of a file relative to the clone dir, with
+// forward slashes
+func repoPath(dir, file string) string {
+	if rel, err := filepath.Rel(dir, file); err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.ToSlash(file)
+}
+
+// fileSHA256 returns the hex encoded SHA-256 of the content of a file
+func fileSHA256(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// AuditQuery selects records of the audit journal. Empty fields match every
+// record.
+type AuditQuery struct {
+	Repo  string // the repo, i.e. org/name
+	Path  string // a file or directory of the repo, or a glob
+	Op    string
+	Since time.Time
+	Until time.Time
+}
+
+// Match reports whether a record is selected by the query. The path matches
+// the file of a record, or one of the files of a commit.
+func (q AuditQuery) Match(r AuditRecord) bool {
+	if q.Repo != "" && r.Repo != q.Repo {
+		return false
+	}
+	if q.Op != "" && r.Op != q.Op {
+		return false
+	}
+	if !q.Since.IsZero() && r.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !r.Time.Before(q.Until) {
+		return false
+	}
+	if q.Path == "" {
+		return true
+	}
+	for _, file := range append([]string{r.Path}, r.Files...) {
+		if file != "" && matchRepoPath(q.Path, file) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRepoPath reports whether a file is p, is in the directory p, or
+// matches the glob p
+func matchRepoPath(p, file string) bool {
+	p = strings.TrimSuffix(p, "/")
+	if file == p || strings.HasPrefix(file, p+"/") {
+		return true
+	}
+	ok, _ := path.Match(p, file)
+	return ok
+}
+
+// ReadJournal returns the records of a journal file selected by the query, in
+// the order they were recorded
+func ReadJournal(file string, q AuditQuery) ([]AuditRecord, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var r AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return records, fmt.Errorf("%s:%d: invalid record, %w", file, n, err)
+		}
+		if q.Match(r) {
+			records = append(records, r)
+		}
+	}
+	return records, scanner.Err()
+}
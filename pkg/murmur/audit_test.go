@@ -0,0 +1,218 @@
+package murmur
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// auditServer is a stand-in for an audit endpoint: it records the records
+// posted, or fails while down
+type auditServer struct {
+	mu      sync.Mutex
+	down    bool
+	posts   int
+	records []AuditRecord
+}
+
+func (s *auditServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.posts++
+	if s.down {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/x-ndjson" {
+		http.Error(w, "not NDJSON", http.StatusUnsupportedMediaType)
+		return
+	}
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.records = append(s.records, record)
+	}
+}
+
+func (s *auditServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var paths []string
+	for _, r := range s.records {
+		paths = append(paths, r.Path)
+	}
+	return paths
+}
+
+func TestJournalPost(t *testing.T) {
+	srv := &auditServer{}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	file := filepath.Join(t.TempDir(), "audit", "murmur.ndjson")
+	j := &Journal{File: file, URL: ts.URL, Command: "generate"}
+
+	// records are posted as they are recorded, not when the journal is closed
+	j.Record(AuditRecord{Op: AuditWrite, Repo: "o/x", Branch: "main", Path: "a.json"})
+	if got := strings.Join(srv.received(), ","); got != "a.json" {
+		t.Fatalf("received %q, want a.json", got)
+	}
+
+	// the records that could not be posted are sent with the next records
+	srv.down = true
+	j.Record(AuditRecord{Op: AuditWrite, Repo: "o/x", Branch: "main", Path: "b.json"})
+	srv.down = false
+	j.Record(AuditRecord{Op: AuditCommit, Repo: "o/x", Branch: "main", Path: "c.json"})
+	if got := strings.Join(srv.received(), ","); got != "a.json,b.json,c.json" {
+		t.Fatalf("received %q, want a.json,b.json,c.json", got)
+	}
+	if err := j.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if srv.posts != 3 {
+		t.Errorf("%d posts, want 3", srv.posts)
+	}
+
+	// the records that cannot be posted when the journal is closed are an
+	// error
+	srv.down = true
+	j.Record(AuditRecord{Op: AuditPush, Repo: "o/x", Branch: "main", Path: "d.json"})
+	err := j.Close(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "unable to send 1 audit record(s), 503 Service Unavailable") {
+		t.Errorf("error %v", err)
+	}
+
+	// every record is in the file
+	records, err := ReadJournal(file, AuditQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 || records[0].Command != "generate" || records[0].User == "" || records[0].Time.IsZero() {
+		t.Errorf("journal %+v", records)
+	}
+}
+
+func TestDataDirCommitExclude(t *testing.T) {
+	dir := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		if _, err := GitOutput(dir, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git("init", "--quiet")
+	if err := os.WriteFile(filepath.Join(dir, "murmur.json"), []byte("{}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	git("add", ".")
+	git("-c", "user.name=t", "-c", "user.email=t@example.com", "commit", "--quiet", "-m", "init")
+
+	journal := filepath.Join(dir, "audit", "murmur.ndjson")
+	if err := appendFile(journal, []byte("{}\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		exclude []string
+		other   bool // another file is changed
+		want    bool
+	}{
+		{name: "journal", want: true},
+		{name: "journal excluded", exclude: []string{journal}, want: false},
+		{name: "relative journal excluded", exclude: []string{"", relPath(t, journal)}, want: false},
+		{name: "journal outside the datadir", exclude: []string{filepath.Join(t.TempDir(), "j.ndjson")}, want: true},
+		{name: "other change", exclude: []string{journal}, other: true, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other := filepath.Join(dir, "murmur.json")
+			content := []byte("{}\n")
+			if tt.other {
+				content = []byte("{\"hierarchy\":[\"team\"]}\n")
+			}
+			if err := os.WriteFile(other, content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			commit, dirty := dataDirCommit(dir, tt.exclude...)
+			if len(commit) != 40 {
+				t.Errorf("commit %q", commit)
+			}
+			if dirty != tt.want {
+				t.Errorf("dirty %t, want %t", dirty, tt.want)
+			}
+		})
+	}
+}
+
+// relPath returns a file relative to the working directory
+func relPath(t *testing.T, file string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rel, err := filepath.Rel(wd, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rel
+}
+
+func TestAuditQueryMatch(t *testing.T) {
+	at := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	write := AuditRecord{Time: at, Op: AuditWrite, Repo: "o/x", Path: "data/stacks/web.json"}
+	commit := AuditRecord{Time: at, Op: AuditCommit, Repo: "o/x", Files: []string{"data/a.json", "other/b.json"}}
+
+	tests := []struct {
+		name   string
+		q      AuditQuery
+		record AuditRecord
+		want   bool
+	}{
+		{"everything", AuditQuery{}, write, true},
+		{"repo", AuditQuery{Repo: "o/y"}, write, false},
+		{"op", AuditQuery{Op: AuditCommit}, write, false},
+		{"file", AuditQuery{Path: "data/stacks/web.json"}, write, true},
+		{"directory", AuditQuery{Path: "data/"}, write, true},
+		{"directory prefix only", AuditQuery{Path: "dat"}, write, false},
+		{"glob", AuditQuery{Path: "data/*/*.json"}, write, true},
+		{"file of a commit", AuditQuery{Path: "other"}, commit, true},
+		{"since", AuditQuery{Since: at}, write, true},
+		{"since later", AuditQuery{Since: at.Add(time.Second)}, write, false},
+		{"until is exclusive", AuditQuery{Until: at}, write, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.q.Match(tt.record); got != tt.want {
+				t.Errorf("match %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+// the journal file is NDJSON: one record per line
+func TestJournalFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "murmur.ndjson")
+	j := &Journal{File: file}
+	j.Record(AuditRecord{Op: AuditWrite, Path: "a"}, AuditRecord{Op: AuditWrite, Path: "b"})
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 2 {
+		t.Errorf("%d lines, want 2: %s", lines, data)
+	}
+}
@@ -0,0 +1,202 @@
+package murmur
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// credentialRefreshMargin is how long before its expiry a credential is
+// replaced
+const credentialRefreshMargin = 5 * time.Minute
+
+// GitAuth authenticates the git commands murmur runs (and commit scripts) to
+// the remotes of targets. For HTTPS remotes an Authorization header, scoped to
+// the remote URL, is passed to each command through $GIT_CONFIG_COUNT /
+// $GIT_CONFIG_KEY_n / $GIT_CONFIG_VALUE_n: the credential is not written to
+// the clone, shown on a command line or set in the environment of the
+// process, so other commands (i.e. renderers) never see it. SSH remotes use
+// ssh-agent, or the configured key file.
+type GitAuth struct {
+	Config      *Config
+	Credentials CredentialProvider // created from Config if nil
+	Logger      *slog.Logger
+
+	mu      sync.Mutex
+	remotes map[string]remoteAuth
+}
+
+// remoteAuth is the Authorization header of a remote, "" if it has no
+// credential, and the expiry of its credential
+type remoteAuth struct {
+	header  string
+	expires time.Time
+}
+
+// RemoteURL returns the URL of the remote of a target: ssh:// for the hosts
+// in the ssh configuration, https:// otherwise. Credentials are never part of
+// the URL.
+func (c *Config) RemoteURL(target Target) string {
+	if slices.Contains(c.Credentials.SSH.Hosts, target.Host()) {
+		return fmt.Sprintf("ssh://git@%s/%s.git", target.Host(), target.RepoPath())
+	}
+	return fmt.Sprintf("https://%s/%s.git", target.Host(), target.RepoPath())
+}
+
+// ScrubRemote removes the credentials that clones made by earlier versions of
+// murmur stored in the URL of their origin (https://oauth2:<token>@host/...).
+// The origin of a clone is set to its URL without the userinfo.
+func ScrubRemote(cloneDir string) error {
+	origin, err := GitOutput(cloneDir, "remote", "get-url", "origin")
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.User == nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil
+	}
+	u.User = nil
+	if _, err = GitOutput(cloneDir, "remote", "set-url", "origin", u.String()); err != nil {
+		return fmt.Errorf("unable to remove the credentials from the origin of %s, %w", cloneDir, err)
+	}
+	return nil
+}
+
+// Configure gets the credentials of the remotes of targets, which Env passes
+// to git. Credentials that are about to expire are replaced: call Configure
+// before each clone or push.
+func (a *GitAuth) Configure(targets []Target) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	log := logger(a.Logger)
+
+	var err error
+	if a.Credentials == nil {
+		a.Credentials, err = NewCredentialProvider(a.Config)
+		if err != nil {
+			return err
+		}
+	}
+	if a.remotes == nil {
+		a.remotes = make(map[string]remoteAuth)
+	}
+
+	for _, target := range targets {
+		url := a.Config.RemoteURL(target)
+		if target.Repo == "." || strings.HasPrefix(url, "ssh://") {
+			continue
+		}
+		auth, ok := a.remotes[url]
+		if ok && (auth.expires.IsZero() || time.Until(auth.expires) > credentialRefreshMargin) {
+			continue
+		}
+
+		cred, err := a.Credentials.Credential(target.Host(), target.RepoPath())
+		if err != nil {
+			return fmt.Errorf("unable to get credentials for %s, %w", target.Repo, err)
+		}
+		if cred == nil {
+			log.Warn("no credentials for repo: pushes will fail unless using an external commit-script", "repo", target.Repo, "env", TokenEnvName(target.Host()+"/"+target.RepoPath()))
+			a.remotes[url] = remoteAuth{}
+			continue
+		}
+		log.Debug("using credentials", "repo", target.Repo, "source", cred.Source, "expires", cred.Expires)
+		AddSecrets(cred.Secrets()...)
+		a.remotes[url] = remoteAuth{header: cred.Header(), expires: cred.Expires}
+	}
+
+	return nil
+}
+
+// Env returns the variables that authenticate git to the remotes configured
+// so far, to add to the environment of a git command or commit script. The
+// git configuration variables follow any already set in the environment of
+// the process. A nil GitAuth returns nil.
+func (a *GitAuth) Env() []string {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var env []string
+	if key := a.Config.Credentials.SSH.KeyFile; key != "" && os.Getenv("GIT_SSH_COMMAND") == "" {
+		key = a.Config.Path(ExpandHome(key))
+		env = append(env, "GIT_SSH_COMMAND=ssh -i '"+strings.ReplaceAll(key, "'", `'\''`)+"' -o IdentitiesOnly=yes")
+	}
+
+	urls := slices.Sorted(maps.Keys(a.remotes))
+	n, _ := strconv.Atoi(os.Getenv("GIT_CONFIG_COUNT"))
+	count := n
+	for _, url := range urls {
+		header := a.remotes[url].header
+		if header == "" {
+			continue
+		}
+		env = append(env,
+			fmt.Sprintf("GIT_CONFIG_KEY_%d=http.%s.extraHeader", count, url),
+			fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", count, header))
+		count++
+	}
+	if count > n {
+		env = append(env, "GIT_CONFIG_COUNT="+strconv.Itoa(count))
+	}
+	return env
+}
+
+// Command adds the variables of Env to the environment of a command
+func (a *GitAuth) Command(cmd *exec.Cmd) *exec.Cmd {
+	if env := a.Env(); len(env) > 0 {
+		cmd.Env = append(cmd.Environ(), env...)
+	}
+	return cmd
+}
+
+// GitOutput runs a git command authenticated to the remotes configured so
+// far in a directory, and returns its trimmed output
+func (a *GitAuth) GitOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	return gitOutput(a.Command(cmd))
+}
+
+// secrets are the values removed by Scrub
+var (
+	secrets   []string
+	secretsMu sync.RWMutex
+)
+
+// urlUserinfo matches the user:password of a URL
+var urlUserinfo = regexp.MustCompile(`://[^/@\s:]+:[^/@\s]+@`)
+
+// AddSecrets registers values that Scrub removes
+func AddSecrets(values ...string) {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, v := range values {
+		if v != "" && !slices.Contains(secrets, v) {
+			secrets = append(secrets, v)
+		}
+	}
+}
+
+// Scrub removes registered secrets, and passwords embedded in URLs, from a
+// string
+func Scrub(s string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	for _, v := range secrets {
+		s = strings.ReplaceAll(s, v, "***")
+	}
+	return urlUserinfo.ReplaceAllString(s, "://***@")
+}
@@ -0,0 +1,404 @@
+package murmur
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ConfigFilename is the name of the configuration file searched for in the
+// datadir (or current directory) when no configuration file is specified
+const ConfigFilename = "murmur.json"
+
+// Config is a struct that represents a murmur.json file
+// config = {
+//   hierarchy: ['team', 'app', 'env'],  // directory levels below the datadir
+//   template_level: 'app',              // level used to select jsonnet templates
+//   promote: {},                        // rules for `murmur promote`
+//   render: {},                         // variables injected into jsonnet
+//   schemas: {                          // JSON Schema file for each output type
+//     stacks: 'schemas/stacks.json',    // relative to the config file
+//   },
+//   formats: {                          // canonical style of the JSON outputs
+//     '*': {},                          // of each type, '*' for the others
+//   },
+//   policies: [],                       // rules checked before writing
+//   credentials: {},                    // authentication to git hosts
+//   notifications: [],                  // sinks of run summaries
+//   audit: {},                          // journal of writes and commits
+// };
+
+type Config struct {
+	Filename      string                  `json:"-"`
+	Hierarchy     Hierarchy               `json:"hierarchy"`
+	TemplateLevel string                  `json:"template_level"`
+	Promote       PromoteConfig           `json:"promote"`
+	Render        RenderConfig            `json:"render"`
+	Schemas       map[string]string       `json:"schemas"`
+	Formats       map[string]FormatConfig `json:"formats"`
+	Policies      []Policy                `json:"policies"`
+	Credentials   CredentialsConfig       `json:"credentials"`
+	Notifications []NotificationConfig    `json:"notifications"`
+	Audit         AuditConfig             `json:"audit"`
+}
+
+// Path resolves a path from the configuration file: relative paths are
+// relative to the directory of the configuration file
+func (c *Config) Path(p string) string {
+	if p == "" || filepath.IsAbs(p) || c.Filename == "" {
+		return p
+	}
+	return filepath.Join(filepath.Dir(c.Filename), p)
+}
+
+// SchemaFiles returns the resolved schema file for each output type
+func (c *Config) SchemaFiles() map[string]string {
+	files := make(map[string]string)
+	for t, p := range c.Schemas {
+		files[t] = c.Path(p)
+	}
+	return files
+}
+
+// FormatConfig declares the canonical style the JSON outputs of a type are
+// re-serialized to before they are written. Files of the clone that are not
+// in the canonical style are rewritten in it.
+//
+//	format = {
+//	  indent: 2,               // spaces, 0 for compact JSON [default: 2]
+//	  sort_keys: false,        // sort the keys of objects
+//	  trailing_newline: true,  // [default: true]
+//	  line_endings: 'lf',      // 'lf' or 'crlf' [default: 'lf']
+//	};
+type FormatConfig struct {
+	Indent          *int   `json:"indent"`
+	SortKeys        bool   `json:"sort_keys"`
+	TrailingNewline *bool  `json:"trailing_newline"`
+	LineEndings     string `json:"line_endings"`
+}
+
+// RenderConfig declares the variables murmur passes to jsonnet for each file
+//
+//	render = {
+//	  inject: 'ext',       // 'ext' (ext-vars), 'tla' (top-level arguments) or 'none'
+//	  names: {             // variable name for each hierarchy level and 'path'
+//	    env: 'ENV',        // default: the upper-cased level name
+//	  },
+//	  var_files: [],       // JSON files of additional variables
+//	  renderers: {         // renderer of each source file extension
+//	    '.jsonnet': { type: 'jsonnet' },   // default
+//	    '.json.tmpl': { type: 'template' },
+//	    '.src.yaml': { type: 'passthrough' },
+//	    '.cue': { type: 'exec', command: ['cue', 'export', '{file}'], output: 'stdout' },
+//	  },
+//	};
+type RenderConfig struct {
+	Inject    string                    `json:"inject"`
+	Names     map[string]string         `json:"names"`
+	VarFiles  []string                  `json:"var_files"`
+	Renderers map[string]RendererConfig `json:"renderers"`
+}
+
+// RendererConfig declares the renderer of a source file extension
+type RendererConfig struct {
+	Type    string   `json:"type"`    // jsonnet, template, passthrough or exec
+	Command []string `json:"command"` // exec: the command and its arguments
+	Output  string   `json:"output"`  // exec: files, stdout or multi [default: files]
+}
+
+// VarName returns the jsonnet variable name for a hierarchy level or 'path'
+func (r RenderConfig) VarName(key string) string {
+	if name, ok := r.Names[key]; ok && name != "" {
+		return name
+	}
+	return VarName(key)
+}
+
+// CredentialsConfig declares how murmur authenticates to git hosts
+//
+//	credentials = {
+//	  sources: ['env', 'token_file', 'netrc', 'helper'],  // tried in order,
+//	                                  // github_app first if app_id is set
+//	  token_files: {                  // token file for a host, host/org or
+//	    'github.com/myorg': 'secrets/myorg-token',  // host/org/name
+//	  },
+//	  username: 'oauth2',             // username sent with tokens
+//	  ssh: {
+//	    hosts: ['git.example.com'],   // hosts cloned over SSH
+//	    key_file: '~/.ssh/murmur',    // ssh-agent is used if unset
+//	  },
+//	  github_app: {},                 // authenticate as a GitHub App
+//	};
+type CredentialsConfig struct {
+	Sources    []string          `json:"sources"`
+	TokenFiles map[string]string `json:"token_files"`
+	Username   string            `json:"username"`
+	SSH        SSHConfig         `json:"ssh"`
+	GitHubApp  GitHubAppConfig   `json:"github_app"`
+}
+
+// GitHubAppConfig declares the GitHub App murmur authenticates as
+//
+//	github_app = {
+//	  app_id: '12345',                      // app ID or client ID
+//	  private_key_file: 'secrets/app.pem',  // or $MURMUR_GITHUB_APP_PRIVATE_KEY
+//	  api_url: 'https://api.github.com',
+//	  hosts: ['github.com'],                // git hosts of the app
+//	  installation_ids: {                   // installation of each owner,
+//	    myorg: 4567,                        // looked up if unset
+//	  },
+//	};
+type GitHubAppConfig struct {
+	AppID           string           `json:"app_id"`
+	PrivateKeyFile  string           `json:"private_key_file"`
+	APIURL          string           `json:"api_url"`
+	Hosts           []string         `json:"hosts"`
+	InstallationIDs map[string]int64 `json:"installation_ids"`
+}
+
+// SSHConfig declares the hosts murmur clones over SSH
+type SSHConfig struct {
+	Hosts   []string `json:"hosts"`
+	KeyFile string   `json:"key_file"`
+}
+
+// NotificationConfig declares a sink the summary of a run is sent to
+//
+//	notification = {
+//	  name: 'ops-slack',            // [default: the type]
+//	  type: 'slack',                // 'webhook' (JSON), 'slack' or 'teams'
+//	  url_env: 'OPS_SLACK_WEBHOOK', // variable of the URL, or url: '...'
+//	  filters: ['ops/*/*'],         // sources of the repos and failures sent,
+//	                                // [] for all
+//	  on: 'changes',                // 'changes' (or failures), 'failures' or
+//	                                // 'always'
+//	};
+type NotificationConfig struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	URL     string   `json:"url"`
+	URLEnv  string   `json:"url_env"`
+	Filters []string `json:"filters"`
+	On      string   `json:"on"`
+}
+
+// AuditConfig declares the journal of the files murmur writes and the commits
+// it makes and pushes
+//
+//	audit = {
+//	  file: 'audit/murmur.ndjson',  // appended to, relative to the config file
+//	  url_env: 'MURMUR_AUDIT_URL',  // variable of the URL the records are
+//	                                // posted to as NDJSON, or url: '...'
+//	};
+type AuditConfig struct {
+	File   string `json:"file"`
+	URL    string `json:"url"`
+	URLEnv string `json:"url_env"`
+}
+
+// PromoteConfig declares what stays env-specific when an env directory is
+// promoted to the next env
+//
+//	promote = {
+//	  env_specific_files: [],     // globs of files that are never promoted
+//	  env_specific_fields: {      // JSON fields that keep the destination value
+//	    '*targets.json': ['branch', 'path'],
+//	  },
+//	  env_specific_marker: 'murmur:env-specific',  // jsonnet line marker
+//	};
+type PromoteConfig struct {
+	EnvSpecificFiles  []string            `json:"env_specific_files"`
+	EnvSpecificFields map[string][]string `json:"env_specific_fields"`
+	EnvSpecificMarker string              `json:"env_specific_marker"`
+}
+
+// DefaultConfig returns the configuration used when no configuration file is
+// found
+func DefaultConfig() *Config {
+	c := &Config{}
+	c.setDefaults()
+	return c
+}
+
+// setDefaults populates unset fields
+func (c *Config) setDefaults() {
+	if len(c.Hierarchy) == 0 {
+		c.Hierarchy = DefaultHierarchy()
+	}
+	if c.TemplateLevel == "" {
+		c.TemplateLevel = "app"
+	}
+	if c.Promote.EnvSpecificFields == nil {
+		c.Promote.EnvSpecificFields = map[string][]string{
+			"*targets.json": {"branch", "path"},
+		}
+	}
+	if c.Promote.EnvSpecificMarker == "" {
+		c.Promote.EnvSpecificMarker = "murmur:env-specific"
+	}
+	if c.Render.Inject == "" {
+		c.Render.Inject = "ext"
+	}
+	if c.Render.Renderers == nil {
+		c.Render.Renderers = make(map[string]RendererConfig)
+	}
+	if _, ok := c.Render.Renderers[".jsonnet"]; !ok {
+		c.Render.Renderers[".jsonnet"] = RendererConfig{Type: "jsonnet"}
+	}
+	if c.Credentials.Sources == nil {
+		c.Credentials.Sources = []string{"env", "token_file", "netrc", "helper"}
+		if c.Credentials.GitHubApp.AppID != "" {
+			c.Credentials.Sources = append([]string{"github_app"}, c.Credentials.Sources...)
+		}
+	}
+	if c.Credentials.GitHubApp.APIURL == "" {
+		c.Credentials.GitHubApp.APIURL = "https://api.github.com"
+	}
+	if c.Credentials.GitHubApp.Hosts == nil {
+		c.Credentials.GitHubApp.Hosts = []string{DefaultGitHost}
+	}
+	if c.Credentials.Username == "" {
+		c.Credentials.Username = "oauth2"
+	}
+	for t, f := range c.Formats {
+		if f.Indent == nil {
+			f.Indent = new(int)
+			*f.Indent = 2
+		}
+		if f.TrailingNewline == nil {
+			f.TrailingNewline = new(bool)
+			*f.TrailingNewline = true
+		}
+		if f.LineEndings == "" {
+			f.LineEndings = "lf"
+		}
+		c.Formats[t] = f
+	}
+	for i, n := range c.Notifications {
+		if n.Name == "" {
+			c.Notifications[i].Name = n.Type
+		}
+		if n.On == "" {
+			c.Notifications[i].On = "changes"
+		}
+	}
+}
+
+// NewConfigFromFile creates a new Config struct from a JSON file. Unset fields
+// are populated from DefaultConfig.
+func NewConfigFromFile(filename string) (*Config, error) {
+	config := &Config{}
+
+	file, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(file, config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse config file %s, %w", filename, err)
+	}
+	config.Filename = filename
+
+	config.setDefaults()
+
+	err = config.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config file %s, %w", filename, err)
+	}
+	return config, nil
+}
+
+// Validate checks the configuration for consistency
+func (c *Config) Validate() error {
+	if err := c.Hierarchy.Validate(); err != nil {
+		return err
+	}
+	if !slices.Contains(c.Hierarchy, c.TemplateLevel) {
+		return fmt.Errorf("template_level %q is not a hierarchy level", c.TemplateLevel)
+	}
+	switch c.Render.Inject {
+	case "ext", "tla", "none":
+	default:
+		return fmt.Errorf("invalid render inject %q: must be ext, tla or none", c.Render.Inject)
+	}
+	for key := range c.Render.Names {
+		if key != "path" && !slices.Contains(c.Hierarchy, key) {
+			return fmt.Errorf("render name %q is not a hierarchy level or 'path'", key)
+		}
+	}
+	for _, f := range c.Render.VarFiles {
+		if f == "" || filepath.Base(f) != f {
+			return fmt.Errorf("invalid var_files entry %q: must be a file name", f)
+		}
+	}
+	for ext, r := range c.Render.Renderers {
+		if !strings.HasPrefix(ext, ".") || len(ext) < 2 {
+			return fmt.Errorf("invalid renderer extension %q: must start with '.'", ext)
+		}
+		switch r.Type {
+		case "jsonnet", "template", "passthrough":
+		case "exec":
+			if len(r.Command) == 0 {
+				return fmt.Errorf("exec renderer of %q has no command", ext)
+			}
+			switch r.Output {
+			case "", "files", "stdout", "multi":
+			default:
+				return fmt.Errorf("invalid output %q of exec renderer of %q: must be files, stdout or multi", r.Output, ext)
+			}
+		default:
+			return fmt.Errorf("invalid renderer type %q of %q: must be jsonnet, template, passthrough or exec", r.Type, ext)
+		}
+	}
+	for _, pattern := range c.Promote.EnvSpecificFiles {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid env_specific_files pattern %q, %w", pattern, err)
+		}
+	}
+	for pattern := range c.Promote.EnvSpecificFields {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid env_specific_fields pattern %q, %w", pattern, err)
+		}
+	}
+	for _, source := range c.Credentials.Sources {
+		if !slices.Contains([]string{"env", "token_file", "netrc", "helper", "github_app"}, source) {
+			return fmt.Errorf("invalid credential source %q: must be env, token_file, netrc, helper or github_app", source)
+		}
+		if source == "github_app" && c.Credentials.GitHubApp.AppID == "" {
+			return fmt.Errorf("credential source github_app requires github_app.app_id")
+		}
+	}
+	for t, f := range c.Formats {
+		if f.Indent != nil && (*f.Indent < 0 || *f.Indent > 8) {
+			return fmt.Errorf("invalid indent %d of format %q: must be 0 to 8", *f.Indent, t)
+		}
+		if f.LineEndings != "lf" && f.LineEndings != "crlf" {
+			return fmt.Errorf("invalid line_endings %q of format %q: must be lf or crlf", f.LineEndings, t)
+		}
+	}
+	if _, err := NewPolicySet(c.Policies); err != nil {
+		return fmt.Errorf("invalid policies, %w", err)
+	}
+	for _, n := range c.Notifications {
+		switch n.Type {
+		case "webhook", "slack", "teams":
+		default:
+			return fmt.Errorf("invalid type %q of notification %q: must be webhook, slack or teams", n.Type, n.Name)
+		}
+		if n.URL == "" && n.URLEnv == "" {
+			return fmt.Errorf("notification %q has no url or url_env", n.Name)
+		}
+		if !slices.Contains([]string{"changes", "failures", "always"}, n.On) {
+			return fmt.Errorf("invalid on %q of notification %q: must be changes, failures or always", n.On, n.Name)
+		}
+		for _, filter := range n.Filters {
+			if _, err := c.Hierarchy.Parse(filter); err != nil {
+				return fmt.Errorf("invalid filter of notification %q, %w", n.Name, err)
+			}
+		}
+	}
+	return nil
+}
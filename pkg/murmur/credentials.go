@@ -0,0 +1,280 @@
+package murmur
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Credential authenticates to a git host over HTTPS
+type Credential struct {
+	Username string
+	Password string    // password or token
+	Source   string    // the source that supplied the credential
+	Expires  time.Time // zero if the credential does not expire
+}
+
+// Header returns the HTTP Authorization header for the credential
+func (c Credential) Header() string {
+	return "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password))
+}
+
+// Secrets returns the values of the credential that must never be logged
+func (c Credential) Secrets() []string {
+	return []string{c.Password, strings.TrimPrefix(c.Header(), "Authorization: Basic ")}
+}
+
+// CredentialProvider supplies the credential for a repo (i.e. org/name) on a
+// host. A nil credential is returned if the provider has none.
+type CredentialProvider interface {
+	Credential(host, repo string) (*Credential, error)
+}
+
+// CredentialChain returns the credential of the first provider that has one
+type CredentialChain []CredentialProvider
+
+func (c CredentialChain) Credential(host, repo string) (*Credential, error) {
+	for _, p := range c {
+		cred, err := p.Credential(host, repo)
+		if err != nil || cred != nil {
+			return cred, err
+		}
+	}
+	return nil, nil
+}
+
+// CacheStats returns the cache hits and misses of the providers of the chain
+// that cache credentials
+func (c CredentialChain) CacheStats() (hits, misses int) {
+	for _, p := range c {
+		if cache, ok := p.(interface{ CacheStats() (int, int) }); ok {
+			h, m := cache.CacheStats()
+			hits, misses = hits+h, misses+m
+		}
+	}
+	return hits, misses
+}
+
+// GitHubAppKeyEnv is the environment variable that may hold the PEM encoded
+// private key of the GitHub App, instead of private_key_file
+const GitHubAppKeyEnv = "MURMUR_GITHUB_APP_PRIVATE_KEY"
+
+// NewCredentialProvider returns a CredentialChain of the sources of the
+// configuration, in order
+func NewCredentialProvider(c *Config) (CredentialProvider, error) {
+	var chain CredentialChain
+	for _, source := range c.Credentials.Sources {
+		switch source {
+		case "env":
+			chain = append(chain, EnvCredentials{Username: c.Credentials.Username})
+		case "token_file":
+			files := make(map[string]string)
+			for key, f := range c.Credentials.TokenFiles {
+				files[key] = c.Path(ExpandHome(f))
+			}
+			chain = append(chain, TokenFileCredentials{Files: files, Username: c.Credentials.Username})
+		case "netrc":
+			chain = append(chain, NetrcCredentials{})
+		case "helper":
+			chain = append(chain, HelperCredentials{})
+		case "github_app":
+			app := c.Credentials.GitHubApp
+			pemBytes := []byte(os.Getenv(GitHubAppKeyEnv))
+			if len(pemBytes) == 0 {
+				if app.PrivateKeyFile == "" {
+					return nil, fmt.Errorf("github_app: private_key_file or $%s must be set", GitHubAppKeyEnv)
+				}
+				var err error
+				pemBytes, err = os.ReadFile(c.Path(ExpandHome(app.PrivateKeyFile)))
+				if err != nil {
+					return nil, fmt.Errorf("unable to read GitHub App private key, %w", err)
+				}
+			}
+			g, err := NewGitHubAppCredentials(app, pemBytes)
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, g)
+		default:
+			return nil, fmt.Errorf("unknown credential source %q", source)
+		}
+	}
+	return chain, nil
+}
+
+// credentialKeys returns the keys a credential may be stored under, most
+// specific first: host/org/name, host/org and host
+func credentialKeys(host, repo string) []string {
+	keys := []string{host}
+	org, _, _ := strings.Cut(repo, "/")
+	if org != "" {
+		keys = append([]string{host + "/" + org}, keys...)
+	}
+	if repo != org {
+		keys = append([]string{host + "/" + repo}, keys...)
+	}
+	return keys
+}
+
+// EnvCredentials reads tokens from environment variables named
+// MURMUR_TOKEN_<KEY>, where KEY is a credential key (host/org/name, host/org
+// or host) upper-cased with every other character replaced by '_', i.e.
+// MURMUR_TOKEN_GITHUB_COM_MYORG. $GITHUB_TOKEN is used for github.com.
+type EnvCredentials struct {
+	Username string
+}
+
+func (e EnvCredentials) Credential(host, repo string) (*Credential, error) {
+	names := []string{}
+	for _, key := range credentialKeys(host, repo) {
+		names = append(names, TokenEnvName(key))
+	}
+	if host == DefaultGitHost {
+		names = append(names, "GITHUB_TOKEN")
+	}
+	for _, name := range names {
+		if token := os.Getenv(name); token != "" {
+			return &Credential{Username: e.Username, Password: token, Source: "env:" + name}, nil
+		}
+	}
+	return nil, nil
+}
+
+// TokenEnvName returns the environment variable EnvCredentials reads for a
+// credential key
+func TokenEnvName(key string) string {
+	return "MURMUR_TOKEN_" + strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, key)
+}
+
+// TokenFileCredentials reads tokens from files, keyed by credential key
+// (host/org/name, host/org or host)
+type TokenFileCredentials struct {
+	Files    map[string]string
+	Username string
+}
+
+func (t TokenFileCredentials) Credential(host, repo string) (*Credential, error) {
+	for _, key := range credentialKeys(host, repo) {
+		file, ok := t.Files[key]
+		if !ok {
+			continue
+		}
+		token, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read token file for %s, %w", key, err)
+		}
+		return &Credential{Username: t.Username, Password: strings.TrimSpace(string(token)), Source: "token_file:" + file}, nil
+	}
+	return nil, nil
+}
+
+// NetrcCredentials reads credentials from a netrc file: File, $NETRC or
+// ~/.netrc
+type NetrcCredentials struct {
+	File string
+}
+
+func (n NetrcCredentials) Credential(host, repo string) (*Credential, error) {
+	file := n.File
+	if file == "" {
+		file = os.Getenv("NETRC")
+	}
+	if file == "" {
+		file = ExpandHome("~/.netrc")
+	}
+	content, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read netrc file, %w", err)
+	}
+
+	// machine <host> login <user> password <password>, or default ...
+	var machine, login, password string
+	var found *Credential
+	tokens := strings.Fields(string(content))
+	flush := func() {
+		if found == nil && (machine == host || machine == "default") && password != "" {
+			found = &Credential{Username: login, Password: password, Source: "netrc:" + file}
+		}
+	}
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "machine", "default":
+			flush()
+			machine, login, password = "default", "", ""
+			if tokens[i] == "machine" && i+1 < len(tokens) {
+				i++
+				machine = tokens[i]
+			}
+		case "login":
+			if i+1 < len(tokens) {
+				i++
+				login = tokens[i]
+			}
+		case "password":
+			if i+1 < len(tokens) {
+				i++
+				password = tokens[i]
+			}
+		}
+	}
+	flush()
+	return found, nil
+}
+
+// HelperCredentials asks the git credential helpers configured for the user
+// (`git credential fill`). Prompting is disabled.
+type HelperCredentials struct{}
+
+func (HelperCredentials) Credential(host, repo string) (*Credential, error) {
+	cmd := exec.Command("git", "credential", "fill")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("protocol=https\nhost=%s\npath=%s.git\n\n", host, repo))
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ASKPASS=", "SSH_ASKPASS=")
+	out, err := cmd.Output()
+	if err != nil {
+		// no helper has a credential for the host
+		return nil, nil
+	}
+
+	cred := &Credential{Source: "helper"}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		k, v, _ := strings.Cut(scanner.Text(), "=")
+		switch k {
+		case "username":
+			cred.Username = v
+		case "password":
+			cred.Password = v
+		}
+	}
+	if cred.Password == "" {
+		return nil, nil
+	}
+	return cred, nil
+}
+
+// ExpandHome replaces a leading ~/ with the home directory of the user
+func ExpandHome(p string) string {
+	if !strings.HasPrefix(p, "~/") {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(home, p[2:])
+}
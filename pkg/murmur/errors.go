@@ -0,0 +1,216 @@
+package murmur
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Phase is the part of a run a failure occurred in
+type Phase string
+
+const (
+	PhaseConfig     Phase = "config"     // configuration, source and target files
+	PhaseRender     Phase = "render"     // rendering sources
+	PhaseValidation Phase = "validation" // schema validation of rendered files
+	PhasePolicy     Phase = "policy"     // deny policies
+	PhaseWrite      Phase = "write"      // writing rendered files to clones
+	PhaseGit        Phase = "git"        // clones, commits and pushes
+)
+
+// phases are the phases in the order they run
+var phases = []Phase{PhaseConfig, PhaseRender, PhaseValidation, PhasePolicy, PhaseWrite, PhaseGit}
+
+// ExitCode returns the process exit code of failures in a phase: 2 (config),
+// 3 (render), 4 (validation), 5 (policy), 6 (write) or 7 (git), or 1 for an
+// unknown phase
+func (p Phase) ExitCode() int {
+	if i := slices.Index(phases, p); i >= 0 {
+		return i + 2
+	}
+	return 1
+}
+
+// name returns the name of a phase, "other" if it is unset
+func (p Phase) name() string {
+	if p == "" {
+		return "other"
+	}
+	return string(p)
+}
+
+// Failure is the failure of an item (a file, or a repo) in a phase
+type Failure struct {
+	Phase Phase
+	Item  string
+	Err   error
+}
+
+func (f *Failure) Error() string {
+	if f.Item == "" {
+		return f.Err.Error()
+	}
+	return f.Item + ": " + f.Err.Error()
+}
+
+func (f *Failure) Unwrap() error { return f.Err }
+
+// Fail returns err as a Failure of an item in a phase. Errors that are (or
+// wrap) a Failure already are returned as they are.
+func Fail(phase Phase, item string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var f *Failure
+	var fs *Failures
+	if errors.As(err, &f) || errors.As(err, &fs) {
+		return err
+	}
+	return &Failure{Phase: phase, Item: item, Err: err}
+}
+
+// Failures collects the failures of a run so that they are reported together.
+// If Max is set, Add returns the Failures once Max failures are collected so
+// that the run stops. A nil *Failures collects nothing: Add returns the error
+// it is given, so the run stops at the first failure.
+type Failures struct {
+	Max int
+
+	mu   sync.Mutex
+	list []*Failure
+}
+
+// Add records a failure, or each of the joined failures of err. It returns
+// an error if the run should stop.
+func (f *Failures) Add(err error) error {
+	if err == nil {
+		return nil
+	}
+	if f == nil {
+		return err
+	}
+	if f.add(err) {
+		return f
+	}
+	return nil
+}
+
+// add records the failures of err and reports whether the budget is spent
+func (f *Failures) add(err error) bool {
+	if err == error(f) {
+		return true
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		spent := false
+		for _, e := range joined.Unwrap() {
+			spent = f.add(e) || spent
+		}
+		return spent
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var failure *Failure
+	if !errors.As(err, &failure) {
+		failure = &Failure{Err: err}
+	}
+	f.list = append(f.list, failure)
+	return f.Max > 0 && len(f.list) >= f.Max
+}
+
+// Len returns the number of failures
+func (f *Failures) Len() int {
+	if f == nil {
+		return 0
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.list)
+}
+
+// List returns the failures, in the order they were added
+func (f *Failures) List() []*Failure {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.list)
+}
+
+// Err returns the Failures if there are any, nil otherwise
+func (f *Failures) Err() error {
+	if f.Len() == 0 {
+		return nil
+	}
+	return f
+}
+
+func (f *Failures) Error() string {
+	var counts []string
+	for _, group := range f.groups() {
+		counts = append(counts, fmt.Sprintf("%s: %d", group[0].Phase.name(), len(group)))
+	}
+	return fmt.Sprintf("%d failure(s) (%s)", f.Len(), strings.Join(counts, ", "))
+}
+
+// Summary returns the failures grouped by phase, in the order the phases run
+func (f *Failures) Summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d failure(s)\n", f.Len())
+	for _, group := range f.groups() {
+		fmt.Fprintf(&b, "%s (%d):\n", group[0].Phase.name(), len(group))
+		for _, failure := range group {
+			// continuation lines of an error are indented under it
+			fmt.Fprintf(&b, "  %s\n", strings.ReplaceAll(strings.TrimSpace(failure.Error()), "\n", "\n    "))
+		}
+	}
+	return b.String()
+}
+
+// ExitCode returns the exit code of the earliest phase that failed
+func (f *Failures) ExitCode() int {
+	groups := f.groups()
+	if len(groups) == 0 {
+		return 0
+	}
+	return groups[0][0].Phase.ExitCode()
+}
+
+// groups returns the failures grouped by phase, in phase order. Failures of
+// an unknown phase are last.
+func (f *Failures) groups() [][]*Failure {
+	list := f.List()
+	var groups [][]*Failure
+	for _, phase := range append(slices.Clone(phases), "") {
+		var group []*Failure
+		for _, failure := range list {
+			if failure.Phase == phase || (phase == "" && !slices.Contains(phases, failure.Phase)) {
+				group = append(group, failure)
+			}
+		}
+		if len(group) > 0 {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// ExitCode returns the process exit code of an error: the code of its phase
+// if it is a Failure or Failures, 1 otherwise
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var fs *Failures
+	if errors.As(err, &fs) && fs.Len() > 0 {
+		return fs.ExitCode()
+	}
+	var f *Failure
+	if errors.As(err, &f) {
+		return f.Phase.ExitCode()
+	}
+	return 1
+}
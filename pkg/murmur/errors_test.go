@@ -0,0 +1,138 @@
+package murmur
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestFailuresAdd(t *testing.T) {
+	errA, errB, errC := errors.New("a"), errors.New("b"), errors.New("c")
+	tests := []struct {
+		name      string
+		max       int
+		errs      []error
+		stopAfter int // the number of errors added when Add asks to stop, 0 if it never does
+		want      int // the number of failures
+	}{
+		{name: "no failures", errs: []error{nil, nil}},
+		{name: "no budget", errs: []error{errA, errB, errC}, want: 3},
+		{name: "budget not spent", max: 4, errs: []error{errA, errB, errC}, want: 3},
+		{name: "budget spent", max: 2, errs: []error{errA, nil, errB}, stopAfter: 3, want: 2},
+		{name: "joined errors count once each", max: 3, errs: []error{errA, errors.Join(errB, errC)}, stopAfter: 2, want: 3},
+		{name: "nested joined errors", errs: []error{errors.Join(errA, errors.Join(errB, Fail(PhaseGit, "o/x:main", errC)))}, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &Failures{Max: tt.max}
+			stopAfter := 0
+			for i, err := range tt.errs {
+				if stop := f.Add(err); stop != nil && stopAfter == 0 {
+					if stop != error(f) {
+						t.Errorf("Add returned %v, want the Failures", stop)
+					}
+					stopAfter = i + 1
+				}
+			}
+			if stopAfter != tt.stopAfter {
+				t.Errorf("stopped after %d errors, want %d", stopAfter, tt.stopAfter)
+			}
+			if f.Len() != tt.want {
+				t.Errorf("%d failures, want %d", f.Len(), tt.want)
+			}
+			if (f.Err() == nil) != (tt.want == 0) {
+				t.Errorf("Err() = %v", f.Err())
+			}
+		})
+	}
+
+	// a nil Failures stops at the first error
+	var f *Failures
+	if err := f.Add(errA); err != errA {
+		t.Errorf("nil Failures: Add returned %v", err)
+	}
+	if f.Err() != nil || f.Len() != 0 {
+		t.Error("nil Failures recorded a failure")
+	}
+
+	// adding the Failures to itself, as an error returned by Add is, records
+	// nothing
+	f = &Failures{Max: 1}
+	stop := f.Add(errA)
+	if f.Add(stop) == nil || f.Len() != 1 {
+		t.Errorf("Failures added to itself: %d failures", f.Len())
+	}
+}
+
+func TestFailuresSummary(t *testing.T) {
+	f := &Failures{}
+	f.Add(Fail(PhaseGit, "o/x:main", errors.New("push rejected")))
+	f.Add(errors.New("unexpected"))
+	f.Add(Fail(PhaseValidation, "ops/web/prod/web-stacks.json", errors.New("/replicas: expected integer\n/image: required")))
+	f.Add(Fail(PhaseGit, "o/y:main", errors.New("clone failed")))
+	f.Add(Fail(PhaseRender, "", errors.New("jsonnet failed")))
+
+	want := `5 failure(s)
+render (1):
+  jsonnet failed
+validation (1):
+  ops/web/prod/web-stacks.json: /replicas: expected integer
+    /image: required
+git (2):
+  o/x:main: push rejected
+  o/y:main: clone failed
+other (1):
+  unexpected
+`
+	if got := f.Summary(); got != want {
+		t.Errorf("summary:\n%s\nwant:\n%s", got, want)
+	}
+	if got, want := f.Error(), "5 failure(s) (render: 1, validation: 1, git: 2, other: 1)"; got != want {
+		t.Errorf("error %q, want %q", got, want)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	failures := func(errs ...error) *Failures {
+		f := &Failures{}
+		for _, err := range errs {
+			f.Add(err)
+		}
+		return f
+	}
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "success", want: 0},
+		{name: "error", err: errors.New("x"), want: 1},
+		{name: "config", err: Fail(PhaseConfig, "murmur.json", errors.New("x")), want: 2},
+		{name: "render", err: Fail(PhaseRender, "", errors.New("x")), want: 3},
+		{name: "validation", err: Fail(PhaseValidation, "", errors.New("x")), want: 4},
+		{name: "policy", err: Fail(PhasePolicy, "", errors.New("x")), want: 5},
+		{name: "write", err: Fail(PhaseWrite, "", errors.New("x")), want: 6},
+		{name: "git", err: Fail(PhaseGit, "", errors.New("x")), want: 7},
+		{name: "wrapped failure", err: fmt.Errorf("run: %w", Fail(PhasePolicy, "", errors.New("x"))), want: 5},
+		{name: "failure kept by Fail", err: Fail(PhaseGit, "", Fail(PhaseRender, "", errors.New("x"))), want: 3},
+		{
+			name: "earliest phase of failures",
+			err: failures(
+				Fail(PhaseGit, "o/x:main", errors.New("x")),
+				Fail(PhaseValidation, "a.json", errors.New("x")),
+				Fail(PhasePolicy, "b.json", errors.New("x")),
+			),
+			want: 4,
+		},
+		{name: "unknown phase after the known ones", err: failures(errors.New("x"), Fail(PhaseWrite, "", errors.New("x"))), want: 6},
+		{name: "only unknown phases", err: failures(errors.New("x")), want: 1},
+		{name: "empty failures", err: failures(), want: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ExitCode(tt.err); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package murmur
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/big"
+	"path/filepath"
+	"strings"
+)
+
+// FormatFor returns the format of the outputs of a type: its own, or the
+// format of '*'. false is returned if neither is configured.
+func (c *Config) FormatFor(t string) (FormatConfig, bool) {
+	if f, ok := c.Formats[t]; ok {
+		return f, true
+	}
+	f, ok := c.Formats["*"]
+	return f, ok
+}
+
+// Canonical re-serializes a JSON document in the style of the format. The
+// order of keys is kept unless they are sorted, and strings and numbers are
+// kept as they are written.
+func (f FormatConfig) Canonical(data []byte) ([]byte, error) {
+	data = bytes.TrimSpace(data)
+	if f.SortKeys {
+		v, err := decodeJSON(data)
+		if err != nil {
+			return nil, err
+		}
+		// maps are encoded with sorted keys
+		var b bytes.Buffer
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		if err = enc.Encode(v); err != nil {
+			return nil, err
+		}
+		data = bytes.TrimSpace(b.Bytes())
+	}
+
+	indent := 2
+	if f.Indent != nil {
+		indent = *f.Indent
+	}
+	var out bytes.Buffer
+	if indent == 0 {
+		if err := json.Compact(&out, data); err != nil {
+			return nil, err
+		}
+	} else if err := json.Indent(&out, data, "", strings.Repeat(" ", indent)); err != nil {
+		return nil, err
+	}
+
+	if f.TrailingNewline == nil || *f.TrailingNewline {
+		out.WriteByte('\n')
+	}
+	// JSON strings cannot hold raw newlines: every newline is formatting
+	if f.LineEndings == "crlf" {
+		return bytes.ReplaceAll(out.Bytes(), []byte("\n"), []byte("\r\n")), nil
+	}
+	return out.Bytes(), nil
+}
+
+// isJSON reports whether a file is a JSON output
+func isJSON(file string) bool {
+	return strings.EqualFold(filepath.Ext(file), ".json")
+}
+
+// SameJSON reports whether two JSON documents have the same parsed content:
+// formatting, the order of keys and the notation of numbers are ignored.
+// Documents that cannot be parsed are not the same.
+func SameJSON(a, b []byte) bool {
+	va, err := decodeJSON(a)
+	if err != nil {
+		return false
+	}
+	vb, err := decodeJSON(b)
+	if err != nil {
+		return false
+	}
+	return equalJSON(va, vb)
+}
+
+// decodeJSON decodes a single JSON document, keeping numbers as written
+func decodeJSON(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, &json.SyntaxError{Offset: dec.InputOffset()}
+	}
+	return v, nil
+}
+
+// equalJSON compares decoded JSON values; numbers are compared by value
+func equalJSON(a, b any) bool {
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, va := range a {
+			vb, ok := b[k]
+			if !ok || !equalJSON(va, vb) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !equalJSON(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if a == b {
+			return true
+		}
+		fa, _, errA := big.ParseFloat(string(a), 10, 256, big.ToNearestEven)
+		fb, _, errB := big.ParseFloat(string(b), 10, 256, big.ToNearestEven)
+		return errA == nil && errB == nil && fa.Cmp(fb) == 0
+	default:
+		return a == b
+	}
+}
@@ -0,0 +1,133 @@
+package murmur
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCanonical(t *testing.T) {
+	zero, four := 0, 4
+	noNewline := false
+	doc := `{"b": 1, "a": [1.50, "x\ny"], "c": {}}`
+
+	tests := []struct {
+		name   string
+		format FormatConfig
+		in     string
+		want   string
+	}{
+		{"default", FormatConfig{}, doc, "{\n  \"b\": 1,\n  \"a\": [\n    1.50,\n    \"x\\ny\"\n  ],\n  \"c\": {}\n}\n"},
+		{"compact", FormatConfig{Indent: &zero}, doc, "{\"b\":1,\"a\":[1.50,\"x\\ny\"],\"c\":{}}\n"},
+		{"indent", FormatConfig{Indent: &four}, `{"a": [1]}`, "{\n    \"a\": [\n        1\n    ]\n}\n"},
+		{"sort keys", FormatConfig{Indent: &zero, SortKeys: true}, `{"b": {"d": 1, "c": 2}, "a": 1}`, "{\"a\":1,\"b\":{\"c\":2,\"d\":1}}\n"},
+		{"sort keys keeps numbers", FormatConfig{Indent: &zero, SortKeys: true}, `{"n": 12345678901234567890, "f": 1.50}`, "{\"f\":1.50,\"n\":12345678901234567890}\n"},
+		{"sort keys keeps HTML", FormatConfig{Indent: &zero, SortKeys: true}, `{"a": "<b>&"}`, "{\"a\":\"<b>&\"}\n"},
+		{"no trailing newline", FormatConfig{Indent: &zero, TrailingNewline: &noNewline}, "\n {\"a\": 1} \n", `{"a":1}`},
+		{"crlf", FormatConfig{LineEndings: "crlf"}, `{"a": "x\ny"}`, "{\r\n  \"a\": \"x\\ny\"\r\n}\r\n"},
+		{"idempotent", FormatConfig{}, "{\n  \"a\": 1\n}\n", "{\n  \"a\": 1\n}\n"},
+		{"scalar", FormatConfig{}, `"x"`, "\"x\"\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.format.Canonical([]byte(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for _, in := range []string{`{"a": }`, `{"a": 1} {"b": 2}`, ``} {
+		if _, err := (FormatConfig{SortKeys: true}).Canonical([]byte(in)); err == nil {
+			t.Errorf("%q: no error", in)
+		}
+	}
+	if _, err := (FormatConfig{}).Canonical([]byte(`{"a": `)); err == nil {
+		t.Error("no error for invalid JSON")
+	}
+}
+
+func TestSameJSON(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{`{"a": 1}`, `{"a":1}`, true},
+		{"{\r\n  \"a\": 1\r\n}\r\n", `{"a":1}`, true},
+		{`{"a": 1, "b": 2}`, `{"b": 2, "a": 1}`, true},
+		{`{"a": 1}`, `{"a": 1, "b": 2}`, false},
+		{`{"a": 1}`, `{"b": 1}`, false},
+		{`[1, 2]`, `[2, 1]`, false},
+		{`[1, 2]`, `[1, 2, 3]`, false},
+		{`1.50`, `1.5`, true},
+		{`1e2`, `100`, true},
+		{`-0`, `0`, true},
+		{`12345678901234567890`, `12345678901234567891`, false},
+		{`0.1`, `0.10000000000000001`, false},
+		{`1`, `"1"`, false},
+		{`null`, `false`, false},
+		{`{"a": null}`, `{"a": null}`, true},
+		{`{"a": {"b": [true]}}`, `{"a": {"b": [false]}}`, false},
+		{`"x\ny"`, `"x\u000ay"`, true},
+		{`{"a": 1}`, `{"a": 1} {}`, false},
+		{`{"a": `, `{"a": `, false},
+		{``, ``, false},
+	}
+	for _, tt := range tests {
+		if got := SameJSON([]byte(tt.a), []byte(tt.b)); got != tt.want {
+			t.Errorf("SameJSON(%q, %q) = %t, want %t", tt.a, tt.b, got, tt.want)
+		}
+		if got := SameJSON([]byte(tt.b), []byte(tt.a)); got != tt.want {
+			t.Errorf("SameJSON(%q, %q) = %t, want %t", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestOutput(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Formats = map[string]FormatConfig{"stacks": {}}
+	w := &GitWriter{Config: cfg}
+
+	tests := []struct {
+		name      string
+		typ       string
+		file      string
+		rendered  string
+		existing  string // "" for none
+		want      string
+		unchanged bool
+	}{
+		{"new", "stacks", "a.json", `{"a": 1}`, "", "{\n  \"a\": 1\n}\n", false},
+		{"canonical", "stacks", "a.json", `{"a": 1}`, "{\n  \"a\": 1\n}\n", "{\n  \"a\": 1\n}\n", true},
+		{"not canonical yet", "stacks", "a.json", `{"a": 1}`, `{"a":1}`, "{\n  \"a\": 1\n}\n", false},
+		{"changed", "stacks", "a.json", `{"a": 2}`, "{\n  \"a\": 1\n}\n", "{\n  \"a\": 2\n}\n", false},
+		{"unformatted type", "other", "a.json", `{"a": 1}`, "{\n    \"a\": 1.0\n}", `{"a": 1}`, true},
+		{"unformatted type changed", "other", "a.json", `{"a": 2}`, `{"a": 1}`, `{"a": 2}`, false},
+		{"not JSON", "stacks", "a.yaml", "a: 1\n", "a:  1\n", "a: 1\n", false},
+		{"not JSON unchanged", "stacks", "a.yaml", "a: 1\n", "a: 1\n", "a: 1\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			file, dest := filepath.Join(dir, "rendered-"+tt.file), filepath.Join(dir, tt.file)
+			if err := os.WriteFile(file, []byte(tt.rendered), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.existing != "" {
+				if err := os.WriteFile(dest, []byte(tt.existing), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			content, unchanged, err := w.output(tt.typ, file, dest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != tt.want || unchanged != tt.unchanged {
+				t.Errorf("got %q (unchanged %t), want %q (unchanged %t)", content, unchanged, tt.want, tt.unchanged)
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package murmur
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// SourceTrailer is added to murmur commits, once for each source
+	SourceTrailer = "Murmur-Source"
+
+	// RevertTrailer is added to rollback commits, with the reverted commit
+	RevertTrailer = "Murmur-Revert"
+)
+
+// maxRetryDelay caps the exponential backoff between attempts
+const maxRetryDelay = 30 * time.Second
+
+// RetryOptions controls the retries of clones and pushes
+type RetryOptions struct {
+	Retries int           // number of retries after the first attempt
+	Delay   time.Duration // delay before the first retry, doubled for each retry
+}
+
+// errRejected is returned by pushOnce when the remote branch has moved
+var errRejected = errors.New("push rejected: the remote branch has changed")
+
+// errPermanent wraps failures that retrying will not fix
+type errPermanent struct{ err error }
+
+func (e errPermanent) Error() string { return e.err.Error() }
+func (e errPermanent) Unwrap() error { return e.err }
+
+// permanentGitErrors are stderr messages of failures that should not be retried
+var permanentGitErrors = []string{
+	"Authentication failed",
+	"could not read Username",
+	"Repository not found",
+	"Permission denied",
+	"not found in upstream origin",
+	"already exists and is not an empty directory",
+}
+
+// withRetry runs fn until it succeeds, fails permanently, the context is done
+// or the retries are exhausted, with capped exponential backoff between
+// attempts
+func withRetry(ctx context.Context, log *slog.Logger, opts RetryOptions, op string, fn func() error) error {
+	retries := max(opts.Retries, 0)
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		err = fn()
+		var perm errPermanent
+		if err == nil || errors.As(err, &perm) || attempt >= retries {
+			return err
+		}
+		delay := retryDelay(opts, attempt)
+		log.Warn("retrying", "op", op, "attempt", attempt+1, "retries", retries, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryDelay returns the delay before a retry (counted from 0): Delay, doubled
+// for each retry before it, up to maxRetryDelay
+func retryDelay(opts RetryOptions, retry int) time.Duration {
+	delay := opts.Delay
+	for range retry {
+		delay = min(delay*2, maxRetryDelay)
+	}
+	return delay
+}
+
+// runGit runs a git command, returning an error that includes stderr. Known
+// non-transient failures are returned as errPermanent.
+func runGit(cmd *exec.Cmd) error {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	return runGitError(err, stderr.String())
+}
+
+// runGitError classifies a failed git command from its stderr
+func runGitError(err error, stderr string) error {
+	msg := strings.TrimSpace(stderr)
+	err = fmt.Errorf("%w: %s", err, msg)
+	for _, p := range permanentGitErrors {
+		if strings.Contains(msg, p) {
+			return errPermanent{err}
+		}
+	}
+	return err
+}
+
+// gitCmd returns a git command that runs in a directory
+func gitCmd(ctx context.Context, dir string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	return cmd
+}
+
+// GitOutput runs a git command in a directory and returns its trimmed output
+func GitOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	return gitOutput(cmd)
+}
+
+// gitOutput runs a git command and returns its trimmed output
+func gitOutput(cmd *exec.Cmd) (string, error) {
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("%s: %w: %s", cmd.String(), err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("%s: %w", cmd.String(), err)
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+// dataDirCommit returns the HEAD of a datadir, and whether it has uncommitted
+// changes. Changes to the excluded files, i.e. the audit journal murmur
+// appends to, are ignored. "" is returned if it is not in a git repo.
+func dataDirCommit(dir string, exclude ...string) (commit string, dirty bool) {
+	commit, _ = GitOutput(dir, "rev-parse", "HEAD")
+	if commit == "" {
+		return "", false
+	}
+	args := []string{"status", "--porcelain", "--", "."}
+	for _, file := range exclude {
+		if file == "" {
+			continue
+		}
+		absDir, err1 := filepath.Abs(dir)
+		absFile, err2 := filepath.Abs(file)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(absDir, absFile); err == nil && filepath.IsLocal(rel) {
+			args = append(args, ":(exclude,literal)"+filepath.ToSlash(rel))
+		}
+	}
+	status, _ := GitOutput(dir, args...)
+	return commit, status != ""
+}
+
+// CommitMessage appends trailers to a commit message
+func CommitMessage(msg string, trailers []string) string {
+	if len(trailers) == 0 {
+		return msg
+	}
+	return strings.TrimRight(msg, "\n") + "\n\n" + strings.Join(trailers, "\n") + "\n"
+}
+
+// hasStagedChanges reports whether any of the paths have staged changes
+func hasStagedChanges(ctx context.Context, cloneDir string, paths []string) bool {
+	if len(paths) == 0 {
+		return false
+	}
+	// if git diff --cached --quiet returns 0, there are no changes to commit
+	return gitCmd(ctx, cloneDir, append([]string{"diff", "--cached", "--quiet", "--"}, paths...)...).Run() != nil
+}
+
+// stagedFiles returns the files of the paths with staged changes, relative
+// to the root of the clone
+func stagedFiles(cloneDir string, paths []string) []string {
+	if len(paths) == 0 {
+		return nil
+	}
+	out, _ := GitOutput(cloneDir, append([]string{"diff", "--cached", "--name-only", "--"}, paths...)...)
+	return strings.Fields(out)
+}
+
+// messageSources returns the values of the source trailers of a commit
+// message
+func messageSources(msg string) []string {
+	var sources []string
+	for _, line := range strings.Split(msg, "\n") {
+		if source, ok := strings.CutPrefix(line, SourceTrailer+": "); ok {
+			sources = append(sources, strings.TrimSpace(source))
+		}
+	}
+	return sources
+}
+
+// pushRepo pushes the current branch of a clone to origin, retrying transient
+// failures. If the push is rejected because the remote branch has moved, the
+// local commits are rebased onto it. If the rebase conflicts, the clone is
+// reset to the remote branch and reapply is called to recreate the commit; a
+// nil reapply makes a conflict an error. auth, if set, is refreshed before
+// each attempt and authenticates the fetch and the pushes.
+func pushRepo(ctx context.Context, log *slog.Logger, opts RetryOptions, auth *GitAuth, target Target, cloneDir string, reapply func() (bool, error)) error {
+	return withRetry(ctx, log, opts, "push "+target.Repo, func() error {
+		if auth != nil {
+			if err := auth.Configure([]Target{target}); err != nil {
+				return err
+			}
+		}
+		err := pushOnce(ctx, log, auth, cloneDir)
+		if !errors.Is(err, errRejected) {
+			return err
+		}
+
+		log.Warn("push rejected, rebasing onto the remote branch", "repo", target.Repo, "branch", target.Branch, "dir", cloneDir)
+		if err := runGit(auth.Command(gitCmd(ctx, cloneDir, "fetch", "origin"))); err != nil {
+			return fmt.Errorf("unable to fetch %s, %w", target.Repo, err)
+		}
+		// uncommitted changes that murmur does not manage are stashed for the
+		// rebase and restored afterwards
+		err = runGit(auth.Command(gitCmd(ctx, cloneDir, "rebase", "--autostash", "@{upstream}")))
+		if err == nil {
+			return pushOnce(ctx, log, auth, cloneDir)
+		}
+
+		// the rebase conflicts: start over from the remote branch
+		log.Warn("rebase failed, re-applying changes to the remote branch", "repo", target.Repo, "branch", target.Branch, "dir", cloneDir, "error", err)
+		if _, err := GitOutput(cloneDir, "rev-parse", "--verify", "--quiet", "REBASE_HEAD"); err == nil {
+			if err := runGit(auth.Command(gitCmd(ctx, cloneDir, "rebase", "--abort"))); err != nil {
+				return errPermanent{fmt.Errorf("unable to abort rebase of %s, %w", target.Repo, err)}
+			}
+		}
+		if reapply == nil {
+			return errPermanent{fmt.Errorf("unable to rebase changes onto %s:%s", target.Repo, target.Branch)}
+		}
+		// --keep preserves uncommitted changes to files the reset doesn't touch
+		if err := runGit(auth.Command(gitCmd(ctx, cloneDir, "reset", "--keep", "@{upstream}"))); err != nil {
+			return errPermanent{fmt.Errorf("unable to reset %s, %w", target.Repo, err)}
+		}
+		changed, err := reapply()
+		if err != nil {
+			return errPermanent{fmt.Errorf("unable to re-apply changes to %s, %w", target.Repo, err)}
+		}
+		if !changed {
+			log.Info("remote branch already contains the changes", "repo", target.Repo, "branch", target.Branch)
+			return nil
+		}
+		return pushOnce(ctx, log, auth, cloneDir)
+	})
+}
+
+// pushOnce pushes the current branch, returning errRejected if the remote
+// branch has commits that are not in the clone
+func pushOnce(ctx context.Context, log *slog.Logger, auth *GitAuth, cloneDir string) error {
+	cmd := auth.Command(gitCmd(ctx, cloneDir, "push"))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	log.Info("pushing repository", "dir", cloneDir)
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	msg := stderr.String()
+	for _, p := range []string{"non-fast-forward", "fetch first", "[rejected]", "Updates were rejected"} {
+		if strings.Contains(msg, p) {
+			return errRejected
+		}
+	}
+	return runGitError(err, msg)
+}
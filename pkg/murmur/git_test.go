@@ -0,0 +1,302 @@
+package murmur
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		name  string
+		delay time.Duration
+		retry int
+		want  time.Duration
+	}{
+		{name: "first retry", delay: time.Second, retry: 0, want: time.Second},
+		{name: "doubled", delay: time.Second, retry: 3, want: 8 * time.Second},
+		{name: "capped", delay: time.Second, retry: 5, want: maxRetryDelay},
+		{name: "capped without overflow", delay: time.Second, retry: 100, want: maxRetryDelay},
+		{name: "no delay", retry: 3, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryDelay(RetryOptions{Delay: tt.delay}, tt.retry); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	errTransient := errors.New("connection reset")
+	tests := []struct {
+		name     string
+		retries  int
+		errs     []error // returned by the attempts in turn, then nil
+		cancel   bool
+		want     error
+		attempts int
+	}{
+		{name: "success", attempts: 1},
+		{name: "retried until success", retries: 3, errs: []error{errTransient, errTransient}, attempts: 3},
+		{name: "retries exhausted", retries: 2, errs: []error{errTransient, errTransient, errTransient, errTransient}, want: errTransient, attempts: 3},
+		{name: "no retries", errs: []error{errTransient}, want: errTransient, attempts: 1},
+		{name: "permanent", retries: 3, errs: []error{errPermanent{errTransient}}, want: errTransient, attempts: 1},
+		{name: "context done", retries: 3, errs: []error{errTransient}, cancel: true, want: context.Canceled, attempts: 1},
+	}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				cancel()
+			}
+			attempts := 0
+			err := withRetry(ctx, log, RetryOptions{Retries: tt.retries, Delay: time.Millisecond}, "test", func() error {
+				attempts++
+				if attempts <= len(tt.errs) {
+					return tt.errs[attempts-1]
+				}
+				return nil
+			})
+			if !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+			if attempts != tt.attempts {
+				t.Errorf("%d attempts, want %d", attempts, tt.attempts)
+			}
+		})
+	}
+}
+
+func TestRunGitError(t *testing.T) {
+	tests := []struct {
+		stderr    string
+		permanent bool
+	}{
+		{stderr: "fatal: Authentication failed for 'https://github.com/o/x.git/'", permanent: true},
+		{stderr: "fatal: could not read Username for 'https://github.com': terminal prompts disabled", permanent: true},
+		{stderr: "remote: Repository not found.\nfatal: repository 'https://github.com/o/x.git/' not found", permanent: true},
+		{stderr: "git@github.com: Permission denied (publickey).", permanent: true},
+		{stderr: "warning: Could not find remote branch main to clone.\nfatal: Remote branch main not found in upstream origin", permanent: true},
+		{stderr: "fatal: destination path 'x:main' already exists and is not an empty directory.", permanent: true},
+		{stderr: "fatal: unable to access 'https://github.com/o/x.git/': Could not resolve host: github.com"},
+		{stderr: "error: RPC failed; HTTP 502 curl 22 The requested URL returned error: 502"},
+	}
+	for _, tt := range tests {
+		err := runGitError(errors.New("exit status 128"), tt.stderr)
+		var perm errPermanent
+		if errors.As(err, &perm) != tt.permanent {
+			t.Errorf("%q: permanent = %v, want %v", tt.stderr, !tt.permanent, tt.permanent)
+		}
+		if !strings.Contains(err.Error(), strings.TrimSpace(tt.stderr)) {
+			t.Errorf("%q: stderr missing from %q", tt.stderr, err)
+		}
+	}
+}
+
+// testRemote returns a bare repo with a main branch that has deploy/a.json,
+// and a function that commits a file to it from another clone
+func testRemote(t *testing.T) (string, func(file, content string)) {
+	t.Helper()
+	t.Setenv("GIT_AUTHOR_NAME", "t")
+	t.Setenv("GIT_AUTHOR_EMAIL", "t@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "t")
+	t.Setenv("GIT_COMMITTER_EMAIL", "t@example.com")
+
+	remote := filepath.Join(t.TempDir(), "x.git")
+	if _, err := GitOutput("", "init", "--quiet", "--bare", "--initial-branch", "main", remote); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(t.TempDir(), "other")
+	if _, err := GitOutput("", "clone", "--quiet", remote, other); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GitOutput(other, "checkout", "--quiet", "-b", "main"); err != nil {
+		t.Fatal(err)
+	}
+	commit := func(file, content string) {
+		t.Helper()
+		testCommit(t, other, file, content)
+		if _, err := GitOutput(other, "push", "--quiet", "origin", "main"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit("deploy/a.json", "0")
+	return remote, commit
+}
+
+// testCommit writes a file to a clone and commits it
+func testCommit(t *testing.T, dir, file, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(file)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, file), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GitOutput(dir, "add", "--", file); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GitOutput(dir, "commit", "--quiet", "-m", "update "+file); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// remoteFile returns the content of a file on the main branch of a remote
+func remoteFile(t *testing.T, remote, file string) string {
+	t.Helper()
+	out, err := GitOutput(remote, "show", "main:"+file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestPushRepo(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	target := Target{Repo: "o/x", Branch: "main", Path: "deploy"}
+	opts := RetryOptions{Retries: 3, Delay: time.Millisecond}
+
+	tests := []struct {
+		name    string
+		remote  string // the change pushed to the remote after the clone
+		reapply bool
+		wantErr string
+		want    string // deploy/a.json on the remote
+	}{
+		{name: "fast-forward", want: "murmur"},
+		{name: "rejected, rebased", remote: "deploy/b.json", want: "murmur"},
+		{name: "rebase conflict", remote: "deploy/a.json", wantErr: "unable to rebase"},
+		{name: "rebase conflict, re-applied", remote: "deploy/a.json", reapply: true, want: "murmur"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote, commit := testRemote(t)
+			cloneDir := filepath.Join(t.TempDir(), "x:main")
+			if _, err := GitOutput("", "clone", "--quiet", remote, cloneDir); err != nil {
+				t.Fatal(err)
+			}
+			testCommit(t, cloneDir, "deploy/a.json", "murmur")
+			if tt.remote != "" {
+				commit(tt.remote, "remote")
+			}
+			// an uncommitted change that murmur does not manage
+			if err := os.WriteFile(filepath.Join(cloneDir, "notes.txt"), []byte("notes"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var reapply func() (bool, error)
+			reapplied := 0
+			if tt.reapply {
+				reapply = func() (bool, error) {
+					reapplied++
+					testCommit(t, cloneDir, "deploy/a.json", "murmur")
+					return true, nil
+				}
+			}
+
+			err := pushRepo(context.Background(), log, opts, nil, target, cloneDir, reapply)
+			if tt.wantErr != "" {
+				var perm errPermanent
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) || !errors.As(err, &perm) {
+					t.Fatalf("err = %v, want a permanent %q", err, tt.wantErr)
+				}
+				if _, err := GitOutput(cloneDir, "rev-parse", "--verify", "--quiet", "REBASE_HEAD"); err == nil {
+					t.Error("rebase not aborted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := remoteFile(t, remote, "deploy/a.json"); got != tt.want {
+				t.Errorf("deploy/a.json = %q, want %q", got, tt.want)
+			}
+			if tt.remote != "" && tt.remote != "deploy/a.json" && remoteFile(t, remote, tt.remote) != "remote" {
+				t.Errorf("remote change to %s lost", tt.remote)
+			}
+			if (reapplied > 0) != tt.reapply {
+				t.Errorf("reapplied %d times", reapplied)
+			}
+			if notes, _ := os.ReadFile(filepath.Join(cloneDir, "notes.txt")); string(notes) != "notes" {
+				t.Errorf("uncommitted change lost: %q", notes)
+			}
+		})
+	}
+}
+
+func TestPublishReapply(t *testing.T) {
+	remote, commit := testRemote(t)
+	datadir, repodir := t.TempDir(), t.TempDir()
+	if err := os.MkdirAll(filepath.Join(datadir, "ops", "web"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	rendered := `{"replicas": 3}` + "\n"
+	if err := os.WriteFile(filepath.Join(datadir, "ops", "web", "web-stacks.json"), []byte(rendered), 0644); err != nil {
+		t.Fatal(err)
+	}
+	target := Target{
+		Dir: filepath.Join(datadir, "ops", "web"), Filename: "web-targets.json", Prefix: "web", App: "web",
+		Name: "x", Repo: "o/x", Branch: "main", Path: "deploy", Types: []string{"stacks"},
+	}
+	cloneDir := filepath.Join(repodir, target.CloneDir())
+	if _, err := GitOutput("", "clone", "--quiet", remote, cloneDir); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &GitWriter{Config: DefaultConfig(), RepoDir: repodir, DataDir: datadir}
+	if _, err := w.Write(context.Background(), []Target{target}); err != nil {
+		t.Fatal(err)
+	}
+	// the remote changes the file murmur writes, and another file
+	commit("deploy/stacks/web-stacks.json", `{"replicas": 5}`)
+	commit("README.md", "remote")
+
+	p := &GitPublisher{
+		Config:    DefaultConfig(),
+		RepoDir:   repodir,
+		DataDir:   datadir,
+		CommitMsg: "murmur commit",
+		Retry:     RetryOptions{Delay: time.Millisecond},
+		Writer:    w,
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	result, err := p.Publish(context.Background(), []Target{target})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Changed {
+		t.Error("not changed")
+	}
+
+	// murmur's file wins, the other remote change is kept
+	if got := remoteFile(t, remote, "deploy/stacks/web-stacks.json"); got != strings.TrimSpace(rendered) {
+		t.Errorf("web-stacks.json = %q, want %q", got, rendered)
+	}
+	if got := remoteFile(t, remote, "README.md"); got != "remote" {
+		t.Errorf("README.md = %q", got)
+	}
+	head, err := GitOutput(remote, "rev-parse", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != result.Commit {
+		t.Errorf("remote at %s, want the commit %s", head, result.Commit)
+	}
+	msg, err := GitOutput(remote, "log", "-1", "--format=%B", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(msg, SourceTrailer+": ") {
+		t.Errorf("trailer missing from the re-applied commit: %q", msg)
+	}
+}
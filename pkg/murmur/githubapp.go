@@ -0,0 +1,208 @@
+package murmur
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GitHubAppCredentials authenticates as a GitHub App installation. A JWT
+// signed with the private key of the app is exchanged for an installation
+// access token of the owner (org or user) of each repo. Tokens are cached
+// until shortly before they expire.
+type GitHubAppCredentials struct {
+	AppID           string
+	Key             *rsa.PrivateKey
+	APIURL          string           // i.e. https://api.github.com
+	Hosts           []string         // git hosts the app authenticates to
+	InstallationIDs map[string]int64 // installation of each owner, looked up if unset
+	Client          *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]*Credential // owner -> installation token
+	hits   int
+	misses int
+}
+
+// tokenExpiryMargin is how long before its expiry a token is replaced
+const tokenExpiryMargin = 10 * time.Minute
+
+// NewGitHubAppCredentials returns GitHubAppCredentials from the github_app
+// configuration and the PEM encoded private key of the app
+func NewGitHubAppCredentials(c GitHubAppConfig, pemBytes []byte) (*GitHubAppCredentials, error) {
+	key, err := ParseRSAPrivateKey(pemBytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse GitHub App private key, %w", err)
+	}
+	return &GitHubAppCredentials{
+		AppID:           c.AppID,
+		Key:             key,
+		APIURL:          c.APIURL,
+		Hosts:           c.Hosts,
+		InstallationIDs: c.InstallationIDs,
+		Client:          &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// ParseRSAPrivateKey parses a PEM encoded PKCS #1 or PKCS #8 RSA private key
+func ParseRSAPrivateKey(pemBytes []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA private key")
+	}
+	return rsaKey, nil
+}
+
+func (g *GitHubAppCredentials) Credential(host, repo string) (*Credential, error) {
+	if !slices.Contains(g.Hosts, host) {
+		return nil, nil
+	}
+	owner, _, _ := strings.Cut(repo, "/")
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if cred, ok := g.tokens[owner]; ok && time.Until(cred.Expires) > tokenExpiryMargin {
+		g.hits++
+		return cred, nil
+	}
+	g.misses++
+
+	jwt, err := g.JWT(time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	id, ok := g.InstallationIDs[owner]
+	if !ok {
+		var installation struct {
+			ID int64 `json:"id"`
+		}
+		err = g.request(http.MethodGet, "/repos/"+repo+"/installation", jwt, http.StatusOK, &installation)
+		if err != nil {
+			return nil, fmt.Errorf("unable to find the GitHub App installation of %s, %w", repo, err)
+		}
+		id = installation.ID
+		if g.InstallationIDs == nil {
+			g.InstallationIDs = make(map[string]int64)
+		}
+		g.InstallationIDs[owner] = id
+	}
+
+	var token struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	err = g.request(http.MethodPost, fmt.Sprintf("/app/installations/%d/access_tokens", id), jwt, http.StatusCreated, &token)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create a GitHub App installation token for %s, %w", owner, err)
+	}
+	if token.Token == "" {
+		return nil, fmt.Errorf("no GitHub App installation token returned for %s", owner)
+	}
+
+	cred := &Credential{
+		Username: "x-access-token",
+		Password: token.Token,
+		Source:   fmt.Sprintf("github_app:%d", id),
+		Expires:  token.ExpiresAt,
+	}
+	if g.tokens == nil {
+		g.tokens = make(map[string]*Credential)
+	}
+	g.tokens[owner] = cred
+	return cred, nil
+}
+
+// CacheStats returns the number of installation tokens served from the cache
+// (hits), and the number that had to be created (misses)
+func (g *GitHubAppCredentials) CacheStats() (hits, misses int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.hits, g.misses
+}
+
+// JWT returns a JSON Web Token for the app, signed with RS256, that is valid
+// for 9 minutes from now (backdated by a minute for clock drift)
+func (g *GitHubAppCredentials) JWT(now time.Time) (string, error) {
+	// the issuer is the numeric app ID, or the client ID of the app
+	var iss any = g.AppID
+	if id, err := strconv.ParseInt(g.AppID, 10, 64); err == nil {
+		iss = id
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": iss,
+	})
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, g.Key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("unable to sign GitHub App JWT, %w", err)
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+// request calls the GitHub API with the JWT and decodes the response into v
+func (g *GitHubAppCredentials) request(method, path, jwt string, status int, v any) error {
+	req, err := http.NewRequest(method, strings.TrimRight(g.APIURL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+
+	client := g.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != status {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(body, &apiErr)
+		return fmt.Errorf("%s %s: %s %s", method, path, resp.Status, apiErr.Message)
+	}
+	return json.Unmarshal(body, v)
+}
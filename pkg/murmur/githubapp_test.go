@@ -0,0 +1,262 @@
+package murmur
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// githubAPI is a stand-in for the installation endpoints of the GitHub API
+type githubAPI struct {
+	t             *testing.T
+	key           *rsa.PublicKey
+	installations map[string]int64 // repo -> installation
+	expiresIn     time.Duration    // of the tokens created
+
+	mu       sync.Mutex
+	lookups  int
+	created  int
+	tokenErr bool // the token exchange fails
+}
+
+func (a *githubAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := verifyJWT(a.key, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")); err != nil {
+		a.t.Errorf("%s %s: %v", r.Method, r.URL.Path, err)
+		http.Error(w, `{"message":"bad credentials"}`, http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/installation"):
+		a.lookups++
+		repo := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/repos/"), "/installation")
+		id, ok := a.installations[repo]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message":"Not Found"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"id":%d}`, id)
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/app/installations/"):
+		a.created++
+		if a.tokenErr {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"message":"suspended"}`)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{
+			"token":      fmt.Sprintf("token-%d", a.created),
+			"expires_at": time.Now().Add(a.expiresIn).UTC().Format(time.RFC3339),
+		})
+	default:
+		a.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		http.NotFound(w, r)
+	}
+}
+
+// verifyJWT checks the RS256 signature and the claims of an app JWT
+func verifyJWT(key *rsa.PublicKey, jwt string) error {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed JWT %q", jwt)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return fmt.Errorf("invalid JWT signature, %w", err)
+	}
+	claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	var c struct {
+		Iss any   `json:"iss"`
+		Iat int64 `json:"iat"`
+		Exp int64 `json:"exp"`
+	}
+	if err = json.Unmarshal(claims, &c); err != nil {
+		return err
+	}
+	if c.Iss != float64(1234) {
+		return fmt.Errorf("iss %v, want 1234", c.Iss)
+	}
+	if now := time.Now().Unix(); c.Iat > now || c.Exp <= now || c.Exp-c.Iat > 600 {
+		return fmt.Errorf("invalid JWT validity %d-%d", c.Iat, c.Exp)
+	}
+	return nil
+}
+
+func newTestGitHubApp(t *testing.T, expiresIn time.Duration) (*GitHubAppCredentials, *githubAPI) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := &githubAPI{
+		t:             t,
+		key:           &key.PublicKey,
+		installations: map[string]int64{"o/x": 42, "o/y": 42, "p/z": 7},
+		expiresIn:     expiresIn,
+	}
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+
+	pemKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	g, err := NewGitHubAppCredentials(GitHubAppConfig{AppID: "1234", APIURL: srv.URL + "/", Hosts: []string{"github.com"}}, pemKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g, api
+}
+
+func TestGitHubAppCredential(t *testing.T) {
+	g, api := newTestGitHubApp(t, time.Hour)
+
+	cred, err := g.Credential("github.com", "o/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Username != "x-access-token" || cred.Password != "token-1" || cred.Source != "github_app:42" {
+		t.Errorf("credential %+v", cred)
+	}
+	if time.Until(cred.Expires) < 59*time.Minute {
+		t.Errorf("expires %v, want in an hour", cred.Expires)
+	}
+	if api.lookups != 1 || api.created != 1 {
+		t.Errorf("%d lookups, %d tokens created, want 1, 1", api.lookups, api.created)
+	}
+
+	// the token of the owner is cached: other repos of the owner reuse it
+	for _, repo := range []string{"o/x", "o/y"} {
+		cached, err := g.Credential("github.com", repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cached != cred {
+			t.Errorf("%s: token not served from the cache", repo)
+		}
+	}
+	if hits, misses := g.CacheStats(); hits != 2 || misses != 1 {
+		t.Errorf("cache stats %d hits, %d misses, want 2, 1", hits, misses)
+	}
+
+	// another owner has its own installation and token
+	other, err := g.Credential("github.com", "p/z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Password != "token-2" || other.Source != "github_app:7" {
+		t.Errorf("credential %+v", other)
+	}
+	if api.lookups != 2 || api.created != 2 {
+		t.Errorf("%d lookups, %d tokens created, want 2, 2", api.lookups, api.created)
+	}
+
+	// hosts the app does not authenticate to have no credential
+	if cred, err := g.Credential("gitlab.com", "o/x"); cred != nil || err != nil {
+		t.Errorf("other host: %v, %v", cred, err)
+	}
+}
+
+func TestGitHubAppCredentialExpiry(t *testing.T) {
+	// tokens about to expire are replaced, the installation is not looked up
+	// again
+	g, api := newTestGitHubApp(t, tokenExpiryMargin/2)
+
+	for i := 1; i <= 3; i++ {
+		cred, err := g.Credential("github.com", "o/x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("token-%d", i); cred.Password != want {
+			t.Errorf("token %q, want %q", cred.Password, want)
+		}
+	}
+	if api.lookups != 1 || api.created != 3 {
+		t.Errorf("%d lookups, %d tokens created, want 1, 3", api.lookups, api.created)
+	}
+	if hits, misses := g.CacheStats(); hits != 0 || misses != 3 {
+		t.Errorf("cache stats %d hits, %d misses, want 0, 3", hits, misses)
+	}
+}
+
+func TestGitHubAppCredentialErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		repo          string
+		installations map[string]int64
+		tokenErr      bool
+		want          string
+	}{
+		{name: "no installation", repo: "q/x", want: "404 Not Found Not Found"},
+		{name: "token refused", repo: "o/x", tokenErr: true, want: "403 Forbidden suspended"},
+		{name: "configured installation", repo: "q/x", installations: map[string]int64{"q": 9}, tokenErr: true, want: "/app/installations/9/access_tokens"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, api := newTestGitHubApp(t, time.Hour)
+			api.tokenErr = tt.tokenErr
+			g.InstallationIDs = tt.installations
+
+			_, err := g.Credential("github.com", tt.repo)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %v, want %q", err, tt.want)
+			}
+			if tt.installations != nil && api.lookups != 0 {
+				t.Errorf("%d lookups of a configured installation", api.lookups)
+			}
+		})
+	}
+}
+
+func TestParseRSAPrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		pem     []byte
+		wantErr bool
+	}{
+		{"pkcs1", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), false},
+		{"pkcs8", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), false},
+		{"not pem", []byte("secret"), true},
+		{"not a key", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("x")}), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRSAPrivateKey(tt.pem)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && !got.Equal(key) {
+				t.Error("parsed key differs")
+			}
+		})
+	}
+}
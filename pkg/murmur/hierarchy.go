@@ -0,0 +1,119 @@
+package murmur
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Hierarchy is the ordered list of directory levels below the datadir, i.e.
+// team/app/env. Jsonnet and target files are found in the leaf directories.
+type Hierarchy []string
+
+// Selection maps hierarchy levels to values, i.e. team=ops, app=web, env=prod.
+// A missing level, or a level set to "*", selects every directory at that
+// level.
+type Selection map[string]string
+
+var levelRE = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+// DefaultHierarchy returns the hierarchy used when none is configured
+func DefaultHierarchy() Hierarchy {
+	return Hierarchy{"team", "app", "env"}
+}
+
+// Validate checks that level names are usable as flag and variable names and
+// are unique
+func (h Hierarchy) Validate() error {
+	if len(h) == 0 {
+		return fmt.Errorf("hierarchy must contain at least one level")
+	}
+	seen := make(map[string]bool)
+	for _, level := range h {
+		if !levelRE.MatchString(level) {
+			return fmt.Errorf("invalid hierarchy level %q: must match %s", level, levelRE.String())
+		}
+		if seen[level] {
+			return fmt.Errorf("duplicate hierarchy level %q", level)
+		}
+		seen[level] = true
+	}
+	return nil
+}
+
+// String returns the hierarchy in the form used for filters, i.e. team/app/env
+func (h Hierarchy) String() string {
+	return strings.Join(h, "/")
+}
+
+// Parse converts a 'team/app/env' string into a Selection. Every level must be
+// present, and may not be '.' or '..'.
+func (h Hierarchy) Parse(s string) (Selection, error) {
+	elem := strings.Split(strings.Trim(s, "/"), "/")
+	if len(elem) != len(h) {
+		return nil, fmt.Errorf("%q does not match the hierarchy %s", s, h)
+	}
+	sel := make(Selection)
+	for i, level := range h {
+		switch elem[i] {
+		case "":
+			return nil, fmt.Errorf("%q does not match the hierarchy %s: %s is empty", s, h, level)
+		case ".", "..":
+			return nil, fmt.Errorf("%q does not match the hierarchy %s: %s is %q", s, h, level, elem[i])
+		}
+		sel[level] = elem[i]
+	}
+	return sel, nil
+}
+
+// Pattern returns the 'team/app/env' glob for a Selection. Unset levels are
+// replaced by '*'.
+func (h Hierarchy) Pattern(sel Selection) string {
+	elem := make([]string, len(h))
+	for i, level := range h {
+		elem[i] = sel.Get(level)
+	}
+	return strings.Join(elem, "/")
+}
+
+// FromPath returns the Selection for a file relative to the datadir, i.e.
+// ops/web/prod/web.jsonnet. false is returned if the file is not located in a
+// leaf directory of the hierarchy.
+func (h Hierarchy) FromPath(rel string) (Selection, bool) {
+	elem := strings.Split(filepath.ToSlash(filepath.Dir(rel)), "/")
+	if len(elem) != len(h) {
+		return nil, false
+	}
+	sel := make(Selection)
+	for i, level := range h {
+		if elem[i] == "." || elem[i] == ".." {
+			return nil, false
+		}
+		sel[level] = elem[i]
+	}
+	return sel, true
+}
+
+// Vars returns the template variables for a Selection: each level name is
+// upper-cased, i.e. TEAM, APP, ENV
+func (h Hierarchy) Vars(sel Selection) map[string]string {
+	vars := make(map[string]string)
+	for _, level := range h {
+		vars[VarName(level)] = sel.Get(level)
+	}
+	return vars
+}
+
+// VarName converts a hierarchy level into a variable name, i.e. 'env' to 'ENV'
+func VarName(level string) string {
+	return strings.ToUpper(strings.ReplaceAll(level, "-", "_"))
+}
+
+// Get returns the value for a level, or '*' if it is unset
+func (s Selection) Get(level string) string {
+	if v, ok := s[level]; ok && v != "" {
+		return v
+	}
+	return "*"
+}
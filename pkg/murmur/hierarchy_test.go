@@ -0,0 +1,101 @@
+package murmur
+
+import (
+	"maps"
+	"strings"
+	"testing"
+)
+
+func TestHierarchyParse(t *testing.T) {
+	regions := Hierarchy{"team", "app", "region", "env"}
+	tests := []struct {
+		name      string
+		hierarchy Hierarchy
+		s         string
+		want      Selection
+		wantErr   string
+	}{
+		{name: "default", hierarchy: DefaultHierarchy(), s: "ops/web/prod", want: Selection{"team": "ops", "app": "web", "env": "prod"}},
+		{name: "globs", hierarchy: DefaultHierarchy(), s: "ops/*/prod", want: Selection{"team": "ops", "app": "*", "env": "prod"}},
+		{name: "slashes trimmed", hierarchy: DefaultHierarchy(), s: "/ops/web/prod/", want: Selection{"team": "ops", "app": "web", "env": "prod"}},
+		{name: "custom", hierarchy: regions, s: "ops/web/us-east/prod", want: Selection{"team": "ops", "app": "web", "region": "us-east", "env": "prod"}},
+		{name: "single level", hierarchy: Hierarchy{"env"}, s: "prod", want: Selection{"env": "prod"}},
+		{name: "too short", hierarchy: regions, s: "ops/web/prod", wantErr: "does not match the hierarchy team/app/region/env"},
+		{name: "too long", hierarchy: DefaultHierarchy(), s: "ops/web/us-east/prod", wantErr: "does not match"},
+		{name: "empty level", hierarchy: DefaultHierarchy(), s: "ops//prod", wantErr: "app is empty"},
+		{name: "parent", hierarchy: DefaultHierarchy(), s: "ops/../prod", wantErr: `app is ".."`},
+		{name: "current", hierarchy: DefaultHierarchy(), s: "./web/prod", wantErr: `team is "."`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.hierarchy.Parse(tt.s)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHierarchyPattern(t *testing.T) {
+	regions := Hierarchy{"team", "app", "region", "env"}
+	tests := []struct {
+		hierarchy Hierarchy
+		sel       Selection
+		want      string
+	}{
+		{hierarchy: DefaultHierarchy(), want: "*/*/*"},
+		{hierarchy: DefaultHierarchy(), sel: Selection{"team": "ops", "app": "web", "env": "prod"}, want: "ops/web/prod"},
+		{hierarchy: DefaultHierarchy(), sel: Selection{"env": "prod", "app": ""}, want: "*/*/prod"},
+		{hierarchy: regions, sel: Selection{"region": "us-east", "other": "x"}, want: "*/*/us-east/*"},
+	}
+	for _, tt := range tests {
+		if got := tt.hierarchy.Pattern(tt.sel); got != tt.want {
+			t.Errorf("%s %v: got %q, want %q", tt.hierarchy, tt.sel, got, tt.want)
+		}
+	}
+
+	// a parsed selection gives back its pattern
+	sel, err := regions.Parse("ops/*/us-east/prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := regions.Pattern(sel); got != "ops/*/us-east/prod" {
+		t.Errorf("round trip: %q", got)
+	}
+}
+
+func TestHierarchyFromPath(t *testing.T) {
+	regions := Hierarchy{"team", "app", "region", "env"}
+	tests := []struct {
+		hierarchy Hierarchy
+		rel       string
+		want      Selection // nil if the file is not in a leaf directory
+	}{
+		{hierarchy: DefaultHierarchy(), rel: "ops/web/prod/web.jsonnet", want: Selection{"team": "ops", "app": "web", "env": "prod"}},
+		{hierarchy: regions, rel: "ops/web/us-east/prod/web.jsonnet", want: Selection{"team": "ops", "app": "web", "region": "us-east", "env": "prod"}},
+		{hierarchy: regions, rel: "ops/web/prod/web.jsonnet"},
+		{hierarchy: DefaultHierarchy(), rel: "ops/web/web.libsonnet"},
+		{hierarchy: DefaultHierarchy(), rel: "web.jsonnet"},
+		{hierarchy: Hierarchy{"env"}, rel: "web.jsonnet"},
+		{hierarchy: Hierarchy{"env"}, rel: "prod/web.jsonnet", want: Selection{"env": "prod"}},
+		{hierarchy: DefaultHierarchy(), rel: "../web/prod/web.jsonnet"},
+		{hierarchy: DefaultHierarchy(), rel: "ops/../prod/web.jsonnet"},
+		{hierarchy: DefaultHierarchy(), rel: "ops/web/./prod/web.jsonnet", want: Selection{"team": "ops", "app": "web", "env": "prod"}},
+		{hierarchy: DefaultHierarchy(), rel: "ops/web/prod/stacks/web.jsonnet"},
+	}
+	for _, tt := range tests {
+		got, ok := tt.hierarchy.FromPath(tt.rel)
+		if ok != (tt.want != nil) || !maps.Equal(got, tt.want) {
+			t.Errorf("%s %s: got %v, %v, want %v", tt.hierarchy, tt.rel, got, ok, tt.want)
+		}
+	}
+}
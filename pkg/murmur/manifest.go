@@ -0,0 +1,256 @@
+package murmur
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// ManifestFilename is the name of the file, written to the destination of
+// each target, that records the files murmur manages there
+const ManifestFilename = ".murmur-manifest.json"
+
+// ManifestEntry records the last write of a managed file
+type ManifestEntry struct {
+	SHA256        string `json:"sha256"`                   // of the content written
+	Source        string `json:"source,omitempty"`         // jsonnet file, relative to the datadir
+	Target        string `json:"target,omitempty"`         // target file, relative to the datadir
+	DataDirCommit string `json:"datadir_commit,omitempty"` // HEAD of the datadir
+	DataDirDirty  bool   `json:"datadir_dirty,omitempty"`  // the datadir had uncommitted changes
+}
+
+// Manifest maps the managed files of a target destination (relative to it,
+// with forward slashes, i.e. stacks/web-stacks.json) to their last write
+type Manifest map[string]ManifestEntry
+
+// ReadManifest reads the manifest of a target destination. An empty manifest
+// is returned if the directory has none.
+func ReadManifest(dir string) (Manifest, error) {
+	m := make(Manifest)
+	file, err := os.ReadFile(filepath.Join(dir, ManifestFilename))
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(file, &m); err != nil {
+		return nil, fmt.Errorf("invalid %s, %w", filepath.Join(dir, ManifestFilename), err)
+	}
+	return m, nil
+}
+
+// marshal returns the manifest as indented JSON, with sorted keys
+func (m Manifest) marshal() ([]byte, error) {
+	out, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// Drift statuses
+const (
+	DriftModified = "modified" // the content is not what murmur wrote
+	DriftDeleted  = "deleted"  // the file no longer exists
+)
+
+// Drift is a managed file whose content is not what murmur last wrote
+type Drift struct {
+	File          string `json:"file"` // relative to the clone
+	Status        string `json:"status"`
+	Source        string `json:"source,omitempty"`
+	DataDirCommit string `json:"datadir_commit,omitempty"`
+	Expected      string `json:"expected"`         // the SHA-256 murmur wrote
+	Actual        string `json:"actual,omitempty"` // the SHA-256 of the file
+}
+
+// Drift compares the files of the manifest of a target destination to the
+// files in the directory, and returns the files that drifted in the order of
+// their names. The files of the drifts are relative to root.
+func (m Manifest) Drift(root, dir string) []Drift {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var drifts []Drift
+	for _, name := range names {
+		entry := m[name]
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		d := Drift{
+			File:          repoPath(root, file),
+			Source:        entry.Source,
+			DataDirCommit: entry.DataDirCommit,
+			Expected:      entry.SHA256,
+		}
+		sum, err := fileSHA256(file)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			d.Status = DriftDeleted
+		case err != nil || sum != entry.SHA256:
+			d.Status, d.Actual = DriftModified, sum
+		default:
+			continue
+		}
+		drifts = append(drifts, d)
+	}
+	return drifts
+}
+
+// FindDrift returns the drifted files of every manifest of a clone
+func FindDrift(cloneDir string) ([]Drift, error) {
+	var drifts []Drift
+	err := filepath.WalkDir(cloneDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || d.Name() != ManifestFilename {
+			return nil
+		}
+		m, err := ReadManifest(filepath.Dir(p))
+		if err != nil {
+			return err
+		}
+		drifts = append(drifts, m.Drift(cloneDir, filepath.Dir(p))...)
+		return nil
+	})
+	return drifts, err
+}
+
+// managedFile is a file a target manages in its destination
+type managedFile struct {
+	src    string // the rendered file
+	target string // the target file, relative to the datadir
+}
+
+// updateManifest rebuilds the manifest of a destination from the files the
+// targets written to it manage. The entries of files whose content is
+// unchanged are kept. The entries of other files are kept only if the target
+// file that wrote them still exists and was not written in this run, i.e. it
+// was not selected: a file its target no longer produces is dropped. The
+// manifest is written only if it changed.
+func (w *GitWriter) updateManifest(tx *writeTx, destDir string, files map[string]managedFile, targets map[string]bool) error {
+	old, err := ReadManifest(destDir)
+	if err != nil {
+		return err
+	}
+	m := make(Manifest)
+	for name, entry := range old {
+		if _, ok := files[name]; ok || entry.Target == "" || targets[entry.Target] {
+			continue
+		}
+		if _, err = os.Stat(filepath.Join(w.DataDir, filepath.FromSlash(entry.Target))); err == nil {
+			m[name] = entry
+		}
+	}
+
+	commit, dirty := w.dataDirCommit()
+	for name, f := range files {
+		sum, err := fileSHA256(filepath.Join(destDir, filepath.FromSlash(name)))
+		if err != nil {
+			return err
+		}
+		if entry, ok := old[name]; ok && entry.SHA256 == sum {
+			entry.Target = f.target
+			m[name] = entry
+			continue
+		}
+		origin, _ := w.Config.Hierarchy.FileOrigin(w.DataDir, f.src)
+		m[name] = ManifestEntry{SHA256: sum, Source: origin.Source, Target: f.target, DataDirCommit: commit, DataDirDirty: dirty}
+	}
+
+	out, err := m.marshal()
+	if err != nil {
+		return err
+	}
+	file := filepath.Join(destDir, ManifestFilename)
+	if existing, err := os.ReadFile(file); err == nil && string(existing) == string(out) {
+		return nil
+	}
+	return tx.writeFile(file, out)
+}
+
+// targetFile returns the target file of a target, relative to the datadir
+func (w *GitWriter) targetFile(target Target) string {
+	return w.Config.Hierarchy.Source(w.DataDir, filepath.Join(target.Dir, target.Filename)).Path
+}
+
+// dataDirCommit returns the HEAD of the datadir of the sources, read once. The
+// audit journal is not a change of the datadir.
+func (w *GitWriter) dataDirCommit() (string, bool) {
+	w.commitOnce.Do(func() {
+		dir := w.SourceDir
+		if dir == "" {
+			dir = w.DataDir
+		}
+		if dir != "" {
+			w.commit, w.dirty = dataDirCommit(dir, w.Config.Path(w.Config.Audit.File))
+		}
+	})
+	return w.commit, w.dirty
+}
+
+// CheckDrift returns a write Failure, joined, for each managed file of the
+// targets that was changed since murmur last wrote it and that a write would
+// overwrite
+func (w *GitWriter) CheckDrift(targets []Target) error {
+	log := logger(w.Logger)
+
+	var errs []error
+	for _, target := range targets {
+		destDir := filepath.Join(w.cloneDir(target), target.Path)
+		m, err := ReadManifest(destDir)
+		if err != nil {
+			errs = append(errs, Fail(PhaseWrite, target.Repo+":"+target.Branch+"/"+target.Path, err))
+			continue
+		}
+		drifted := make(map[string]Drift)
+		for _, d := range m.Drift(destDir, destDir) {
+			if d.Status == DriftModified {
+				drifted[d.File] = d
+			}
+		}
+		if len(drifted) == 0 {
+			continue
+		}
+
+		for _, t := range target.Types {
+			files, err := target.TypeFiles(t)
+			if err != nil {
+				errs = append(errs, Fail(PhaseWrite, target.Repo+":"+target.Branch+"/"+target.Path, err))
+				continue
+			}
+			for _, file := range files {
+				name := t + "/" + target.DestFilename(file)
+				d, ok := drifted[name]
+				if !ok {
+					continue
+				}
+				dest := filepath.Join(destDir, filepath.FromSlash(name))
+				if _, unchanged, err := w.output(t, file, dest); err == nil && unchanged {
+					continue
+				}
+				log.Error("managed file was changed since murmur wrote it", "repo", target.Repo, "branch", target.Branch, "file", name, "source", d.Source)
+				errs = append(errs, Fail(PhaseWrite, target.Repo+":"+target.Branch+"/"+filepath.ToSlash(filepath.Join(target.Path, name)),
+					fmt.Errorf("the file was changed since murmur wrote it from %s: it is not overwritten", sourceOrUnknown(d.Source))))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func sourceOrUnknown(source string) string {
+	if source == "" {
+		return "an unknown source"
+	}
+	return source
+}
@@ -0,0 +1,191 @@
+package murmur
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func sha(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestManifestDrift(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "deploy")
+	for name, content := range map[string]string{"stacks/a.json": "a", "stacks/b.json": "changed", "c.json": "c"} {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a directory where a file is expected cannot be read
+	if err := os.Mkdir(filepath.Join(dir, "d.json"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		manifest Manifest
+		want     []Drift
+	}{
+		{name: "empty", manifest: Manifest{}},
+		{name: "unchanged", manifest: Manifest{"stacks/a.json": {SHA256: sha("a")}, "c.json": {SHA256: sha("c")}}},
+		{
+			name:     "modified",
+			manifest: Manifest{"stacks/b.json": {SHA256: sha("b"), Source: "ops/web/prod/web.jsonnet", DataDirCommit: "32f4fa46"}},
+			want:     []Drift{{File: "deploy/stacks/b.json", Status: DriftModified, Source: "ops/web/prod/web.jsonnet", DataDirCommit: "32f4fa46", Expected: sha("b"), Actual: sha("changed")}},
+		},
+		{
+			name:     "deleted",
+			manifest: Manifest{"stacks/e.json": {SHA256: sha("e")}},
+			want:     []Drift{{File: "deploy/stacks/e.json", Status: DriftDeleted, Expected: sha("e")}},
+		},
+		{
+			name:     "unreadable",
+			manifest: Manifest{"d.json": {SHA256: sha("d")}},
+			want:     []Drift{{File: "deploy/d.json", Status: DriftModified, Expected: sha("d")}},
+		},
+		{
+			name: "in the order of the names",
+			manifest: Manifest{
+				"stacks/e.json": {SHA256: sha("e")},
+				"stacks/a.json": {SHA256: sha("a")},
+				"stacks/b.json": {SHA256: sha("b")},
+				"c.json":        {SHA256: sha("x")},
+			},
+			want: []Drift{
+				{File: "deploy/c.json", Status: DriftModified, Expected: sha("x"), Actual: sha("c")},
+				{File: "deploy/stacks/b.json", Status: DriftModified, Expected: sha("b"), Actual: sha("changed")},
+				{File: "deploy/stacks/e.json", Status: DriftDeleted, Expected: sha("e")},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.manifest.Drift(root, dir); !slices.Equal(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateManifest(t *testing.T) {
+	datadir, repodir := t.TempDir(), t.TempDir()
+	write := func(file, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// two apps write to the same destination of a repo
+	for _, f := range []string{"web/web-targets.json", "web/web-stacks.json", "web/web-dbs.json", "api/api-targets.json", "api/api-stacks.json"} {
+		write(filepath.Join(datadir, "ops", f), `{"file": "`+f+`"}`)
+	}
+	destDir := filepath.Join(repodir, "x:main", "deploy")
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	target := func(app string, types ...string) Target {
+		return Target{
+			Dir: filepath.Join(datadir, "ops", app), Filename: app + "-targets.json", Prefix: app, App: app,
+			Name: "x", Repo: "o/x", Branch: "main", Path: "deploy", Types: types,
+		}
+	}
+	w := &GitWriter{Config: DefaultConfig(), RepoDir: repodir, DataDir: datadir}
+	entries := func() map[string]string {
+		t.Helper()
+		m, err := ReadManifest(destDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets := make(map[string]string)
+		for name, e := range m {
+			targets[name] = e.Target
+		}
+		return targets
+	}
+
+	tests := []struct {
+		name    string
+		setup   func()
+		targets []Target
+		want    map[string]string // the manifest: file to target file
+	}{
+		{
+			name:    "targets",
+			targets: []Target{target("web", "stacks", "dbs"), target("api", "stacks")},
+			want: map[string]string{
+				"stacks/web-stacks.json": "ops/web/web-targets.json",
+				"dbs/web-dbs.json":       "ops/web/web-targets.json",
+				"stacks/api-stacks.json": "ops/api/api-targets.json",
+			},
+		},
+		{
+			name:    "type removed, other target not selected",
+			targets: []Target{target("web", "stacks")},
+			want: map[string]string{
+				"stacks/web-stacks.json": "ops/web/web-targets.json",
+				"stacks/api-stacks.json": "ops/api/api-targets.json",
+			},
+		},
+		{
+			name:    "rendered file removed",
+			setup:   func() { os.Remove(filepath.Join(datadir, "ops", "api", "api-stacks.json")) },
+			targets: []Target{target("web", "stacks"), target("api", "stacks")},
+			want: map[string]string{
+				"stacks/web-stacks.json": "ops/web/web-targets.json",
+			},
+		},
+		{
+			name: "target file removed",
+			setup: func() {
+				write(filepath.Join(datadir, "ops", "api", "api-stacks.json"), `{}`)
+				if _, err := w.WriteFiles([]Target{target("api", "stacks")}); err != nil {
+					t.Fatal(err)
+				}
+				os.Remove(filepath.Join(datadir, "ops", "api", "api-targets.json"))
+			},
+			targets: []Target{target("web", "stacks")},
+			want: map[string]string{
+				"stacks/web-stacks.json": "ops/web/web-targets.json",
+			},
+		},
+		{
+			name: "entry without a target",
+			setup: func() {
+				m := Manifest{"stacks/old.json": {SHA256: sha("old")}, "stacks/web-stacks.json": {SHA256: sha(`{"file": "web/web-stacks.json"}`)}}
+				out, _ := m.marshal()
+				write(filepath.Join(destDir, ManifestFilename), string(out))
+			},
+			targets: []Target{target("web", "stacks")},
+			want: map[string]string{
+				"stacks/web-stacks.json": "ops/web/web-targets.json",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setup != nil {
+				tt.setup()
+			}
+			if _, err := w.WriteFiles(tt.targets); err != nil {
+				t.Fatal(err)
+			}
+			if got := entries(); !maps.Equal(got, tt.want) {
+				t.Errorf("manifest %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
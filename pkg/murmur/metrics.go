@@ -0,0 +1,181 @@
+package murmur
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics aggregates the events of a run into Prometheus metrics, written in
+// the text exposition format, i.e. to a file read by the textfile collector
+// of node_exporter. Every metric describes the run: they are gauges.
+type Metrics struct {
+	Labels map[string]string // added to every metric, i.e. command="generate"
+
+	mu        sync.Mutex
+	durations map[EventKind]time.Duration
+	counts    map[EventKind]int
+	rendered  int
+	written   int
+	changed   int
+	published int
+	failures  map[[2]string]int // phase, repo:branch
+	caches    map[string][2]int // hits, misses
+}
+
+// Observe records an event, i.e. as the Observer of a Pipeline
+func (m *Metrics) Observe(e Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.durations == nil {
+		m.durations = make(map[EventKind]time.Duration)
+		m.counts = make(map[EventKind]int)
+		m.failures = make(map[[2]string]int)
+	}
+
+	m.durations[e.Kind] += e.Duration
+	m.counts[e.Kind]++
+	if e.Err != nil {
+		repo := ""
+		if e.Repo != "" {
+			repo = e.Repo + ":" + e.Branch
+		}
+		m.failures[[2]string{string(e.Kind), repo}]++
+		return
+	}
+
+	switch e.Kind {
+	case EventRender:
+		m.rendered += len(e.Files)
+	case EventTarget:
+		m.written += len(e.Files)
+	case EventPublish:
+		if e.Changed {
+			m.published++
+			m.changed += len(e.Files)
+		}
+	}
+}
+
+// SetCache records the hits and misses of a cache, i.e. "github_app_token"
+func (m *Metrics) SetCache(name string, hits, misses int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.caches == nil {
+		m.caches = make(map[string][2]int)
+	}
+	m.caches[name] = [2]int{hits, misses}
+}
+
+// WriteText writes the metrics in the Prometheus text format. The run took
+// duration and ended with the exit code.
+func (m *Metrics) WriteText(w io.Writer, duration time.Duration, exitCode int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b := bufio.NewWriter(w)
+	gauge := func(name, help string) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	}
+	sample := func(name string, value any, labels ...string) {
+		fmt.Fprintf(b, "%s%s %v\n", name, m.labels(labels...), value)
+	}
+
+	gauge("murmur_run_timestamp_seconds", "Time the run ended, in seconds since the epoch.")
+	sample("murmur_run_timestamp_seconds", time.Now().Unix())
+	gauge("murmur_run_duration_seconds", "Duration of the run.")
+	sample("murmur_run_duration_seconds", duration.Seconds())
+	gauge("murmur_run_exit_code", "Exit code of the run, 0 if it succeeded.")
+	sample("murmur_run_exit_code", exitCode)
+
+	kinds := slices.Sorted(maps.Keys(m.durations))
+	gauge("murmur_phase_duration_seconds", "Total duration of the operations of each phase.")
+	for _, kind := range kinds {
+		sample("murmur_phase_duration_seconds", m.durations[kind].Seconds(), "phase", string(kind))
+	}
+	gauge("murmur_phase_operations", "Number of operations of each phase: files rendered, repos cloned, targets written, ...")
+	for _, kind := range kinds {
+		sample("murmur_phase_operations", m.counts[kind], "phase", string(kind))
+	}
+
+	gauge("murmur_files_rendered", "Number of files rendered.")
+	sample("murmur_files_rendered", m.rendered)
+	gauge("murmur_files_written", "Number of files written to repos.")
+	sample("murmur_files_written", m.written)
+	gauge("murmur_files_changed", "Number of files changed by the commits published.")
+	sample("murmur_files_changed", m.changed)
+	gauge("murmur_repos_changed", "Number of repos / branches with changes published.")
+	sample("murmur_repos_changed", m.published)
+
+	gauge("murmur_failures", "Number of failed operations of each phase and repo.")
+	keys := slices.SortedFunc(maps.Keys(m.failures), func(a, b [2]string) int {
+		return strings.Compare(a[0]+"\x00"+a[1], b[0]+"\x00"+b[1])
+	})
+	for _, key := range keys {
+		sample("murmur_failures", m.failures[key], "phase", key[0], "repo", key[1])
+	}
+
+	if len(m.caches) > 0 {
+		names := slices.Sorted(maps.Keys(m.caches))
+		gauge("murmur_cache_hits", "Number of cache hits.")
+		for _, name := range names {
+			sample("murmur_cache_hits", m.caches[name][0], "cache", name)
+		}
+		gauge("murmur_cache_misses", "Number of cache misses.")
+		for _, name := range names {
+			sample("murmur_cache_misses", m.caches[name][1], "cache", name)
+		}
+	}
+
+	return b.Flush()
+}
+
+// WriteTextfile writes the metrics to a file, replacing it atomically so that
+// a collector never reads a partial file
+func (m *Metrics) WriteTextfile(file string, duration time.Duration, exitCode int) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), "."+filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = m.WriteText(tmp, duration, exitCode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// labels formats the labels of a sample: the Labels of the metrics, then the
+// name / value pairs given
+func (m *Metrics) labels(pairs ...string) string {
+	var all []string
+	for _, name := range slices.Sorted(maps.Keys(m.Labels)) {
+		all = append(all, name+"="+labelValue(m.Labels[name]))
+	}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		all = append(all, pairs[i]+"="+labelValue(pairs[i+1]))
+	}
+	if len(all) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(all, ",") + "}"
+}
+
+// labelValue quotes a label value, escaping backslashes, quotes and newlines
+func labelValue(v string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v) + `"`
+}
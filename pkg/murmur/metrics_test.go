@@ -0,0 +1,74 @@
+package murmur
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "update the golden files of testdata")
+
+func TestMetricsTextfile(t *testing.T) {
+	m := &Metrics{Labels: map[string]string{"command": "generate", "datadir": `c:\data "x"`}}
+	for _, e := range []Event{
+		{Kind: EventRender, Files: []string{"a.json", "b.json"}, Duration: 1500 * time.Millisecond},
+		{Kind: EventRender, Err: errors.New("syntax error"), Duration: 500 * time.Millisecond},
+		{Kind: EventClone, Repo: "ops/deploy", Branch: "main", Duration: 2 * time.Second},
+		{Kind: EventWrite, Files: []string{"a.json", "b.json"}, Duration: time.Second},
+		{Kind: EventTarget, Repo: "ops/deploy", Branch: "main", Files: []string{"a.json"}, Duration: 250 * time.Millisecond},
+		{Kind: EventTarget, Repo: "ops/deploy", Branch: "main", Files: []string{"b.json"}, Duration: 250 * time.Millisecond},
+		{Kind: EventPublish, Repo: "ops/deploy", Branch: "main", Files: []string{"a.json"}, Changed: true, Duration: 3 * time.Second},
+		{Kind: EventPublish, Repo: "ops/other", Branch: "main", Duration: time.Second},
+		{Kind: EventPublish, Repo: "ops/broken", Branch: "prod", Err: errors.New("rejected"), Duration: time.Second},
+	} {
+		m.Observe(e)
+	}
+	m.SetCache("github_app_token", 3, 1)
+
+	file := filepath.Join(t.TempDir(), "murmur.prom")
+	if err := m.WriteTextfile(file, 90*time.Second, 6); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(file); err != nil {
+		t.Error(err)
+	} else if info.Mode().Perm() != 0644 {
+		t.Errorf("mode %v, want 0644", info.Mode().Perm())
+	}
+	if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(file), ".murmur.prom.*")); len(matches) > 0 {
+		t.Errorf("temporary files left: %q", matches)
+	}
+
+	// the timestamp is the end of the run, which changes on every run
+	timestamp := regexp.MustCompile(`(?m)^(murmur_run_timestamp_seconds\{.*\}) (\d+)$`)
+	match := timestamp.FindSubmatch(got)
+	if match == nil {
+		t.Fatalf("no timestamp:\n%s", got)
+	}
+	if ts, _ := strconv.ParseInt(string(match[2]), 10, 64); time.Since(time.Unix(ts, 0)) > time.Minute {
+		t.Errorf("timestamp %d", ts)
+	}
+	got = timestamp.ReplaceAll(got, []byte("$1 0"))
+
+	golden := filepath.Join("testdata", "metrics.prom")
+	if *update {
+		if err = os.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("textfile differs from %s (go test -update to update it):\n%s", golden, got)
+	}
+}
@@ -0,0 +1,402 @@
+package murmur
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RunSummary is the outcome of a run sent to notification sinks
+type RunSummary struct {
+	Command  string           `json:"command"`
+	Status   string           `json:"status"` // succeeded or failed
+	ExitCode int              `json:"exit_code"`
+	Started  time.Time        `json:"started"`
+	Finished time.Time        `json:"finished"`
+	Repos    []RepoSummary    `json:"repos"`
+	Failures []FailureSummary `json:"failures"`
+}
+
+// RepoSummary is the publish of a repo / branch
+type RepoSummary struct {
+	Repo    string   `json:"repo"`
+	Branch  string   `json:"branch"`
+	Sources []string `json:"sources"` // i.e. team/app/env
+	Changed bool     `json:"changed"`
+	Commit  string   `json:"commit,omitempty"`
+	URL     string   `json:"url,omitempty"` // of the commit, for changed repos
+	Files   []string `json:"files,omitempty"`
+}
+
+// FailureSummary is a failure of a run. Failures without sources (i.e. of the
+// configuration) are sent to every sink.
+type FailureSummary struct {
+	Phase   string   `json:"phase"`
+	Item    string   `json:"item,omitempty"`
+	Error   string   `json:"error"`
+	Sources []string `json:"sources,omitempty"`
+}
+
+// Changed returns the number of repos with changes published
+func (s RunSummary) Changed() int {
+	n := 0
+	for _, r := range s.Repos {
+		if r.Changed {
+			n++
+		}
+	}
+	return n
+}
+
+// Notifier sends the summary of a run to the notification sinks of the
+// configuration: the repos published, with links to their commits, and the
+// failures. Each sink receives the repos and failures of its filters.
+type Notifier struct {
+	Config  *Config
+	DataDir string // the datadir, for the sources of failed files
+	Client  *http.Client
+
+	mu    sync.Mutex
+	repos []*RepoSummary
+	// published marks the repos with a publish event: the others were only
+	// cloned, and are kept for the sources of their failures
+	published map[*RepoSummary]bool
+}
+
+// Observe records the sources of the repos cloned, and the outcome of the
+// repos published, i.e. as the Observer of a Pipeline
+func (n *Notifier) Observe(e Event) {
+	if e.Repo == "" || (e.Kind != EventClone && e.Kind != EventPublish) {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.published == nil {
+		n.published = make(map[*RepoSummary]bool)
+	}
+
+	i := slices.IndexFunc(n.repos, func(r *RepoSummary) bool { return r.Repo == e.Repo && r.Branch == e.Branch })
+	if i < 0 {
+		n.repos = append(n.repos, &RepoSummary{Repo: e.Repo, Branch: e.Branch})
+		i = len(n.repos) - 1
+	}
+	repo := n.repos[i]
+	for _, source := range e.Sources {
+		if !slices.Contains(repo.Sources, source) {
+			repo.Sources = append(repo.Sources, source)
+		}
+	}
+	if e.Kind != EventPublish || e.Err != nil {
+		return
+	}
+	n.published[repo] = true
+	repo.Changed, repo.Commit = e.Changed, e.Commit
+	if e.Changed {
+		repo.Files = e.Files
+		repo.URL = commitURL(e.Repo, e.Commit)
+	}
+}
+
+// Summary returns the summary of a run of a command, started at start, that
+// ended with runErr
+func (n *Notifier) Summary(command string, start time.Time, runErr error) RunSummary {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	s := RunSummary{
+		Command:  command,
+		Status:   "succeeded",
+		ExitCode: ExitCode(runErr),
+		Started:  start,
+		Finished: time.Now(),
+		Repos:    []RepoSummary{},
+		Failures: []FailureSummary{},
+	}
+	if runErr != nil {
+		s.Status = "failed"
+	}
+	for _, r := range n.repos {
+		if n.published[r] {
+			s.Repos = append(s.Repos, *r)
+		}
+	}
+
+	var list []*Failure
+	var fs *Failures
+	var f *Failure
+	switch {
+	case errors.As(runErr, &fs):
+		list = fs.List()
+	case errors.As(runErr, &f):
+		list = []*Failure{f}
+	case runErr != nil:
+		list = []*Failure{{Err: runErr}}
+	}
+	for _, f := range list {
+		s.Failures = append(s.Failures, FailureSummary{
+			Phase:   f.Phase.name(),
+			Item:    f.Item,
+			Error:   Scrub(f.Err.Error()),
+			Sources: n.itemSources(f.Item),
+		})
+	}
+	return s
+}
+
+// itemSources returns the sources of the item of a failure: the sources of a
+// repo / branch (and its targets), or of a file
+func (n *Notifier) itemSources(item string) []string {
+	if item == "" {
+		return nil
+	}
+	for _, r := range n.repos {
+		key := r.Repo + ":" + r.Branch
+		if item == key || strings.HasPrefix(item, key+"/") {
+			return r.Sources
+		}
+	}
+	if n.Config == nil {
+		return nil
+	}
+	origin, _ := n.Config.Hierarchy.FileOrigin(n.DataDir, item)
+	if origin.Selection == nil {
+		return nil
+	}
+	return []string{n.Config.Hierarchy.Pattern(origin.Selection)}
+}
+
+// Notify sends the summary of a run to each sink that it concerns. A sink
+// that cannot be reached does not stop the others.
+func (n *Notifier) Notify(ctx context.Context, command string, start time.Time, runErr error) error {
+	summary := n.Summary(command, start, runErr)
+
+	var errs []error
+	for _, sink := range n.Config.Notifications {
+		s := summary.filter(sink.Filters)
+		if !s.notifies(sink.On) {
+			continue
+		}
+		if err := n.send(ctx, sink, s); err != nil {
+			errs = append(errs, fmt.Errorf("unable to notify %s, %w", sink.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// filter returns the repos and failures of the sources matching the filters,
+// and the failures without sources
+func (s RunSummary) filter(filters []string) RunSummary {
+	if len(filters) == 0 {
+		return s
+	}
+	matches := func(sources []string) bool {
+		for _, source := range sources {
+			for _, filter := range filters {
+				if ok, _ := path.Match(filter, source); ok {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	filtered := s
+	filtered.Repos = []RepoSummary{}
+	for _, r := range s.Repos {
+		if matches(r.Sources) {
+			filtered.Repos = append(filtered.Repos, r)
+		}
+	}
+	filtered.Failures = []FailureSummary{}
+	for _, f := range s.Failures {
+		if len(f.Sources) == 0 || matches(f.Sources) {
+			filtered.Failures = append(filtered.Failures, f)
+		}
+	}
+	return filtered
+}
+
+// notifies reports whether a sink is notified of the summary: on changes (or
+// failures), on failures, or always
+func (s RunSummary) notifies(on string) bool {
+	switch on {
+	case "always":
+		return true
+	case "failures":
+		return len(s.Failures) > 0
+	default:
+		return len(s.Failures) > 0 || s.Changed() > 0
+	}
+}
+
+// send posts the payload of a summary to a sink
+func (n *Notifier) send(ctx context.Context, sink NotificationConfig, s RunSummary) error {
+	url := sink.URL
+	if sink.URLEnv != "" {
+		url = os.Getenv(sink.URLEnv)
+		if url == "" {
+			return fmt.Errorf("$%s is not set", sink.URLEnv)
+		}
+	}
+	// webhook URLs embed their credentials
+	AddSecrets(url)
+
+	var payload any
+	switch sink.Type {
+	case "slack":
+		payload = slackPayload(s)
+	case "teams":
+		payload = teamsPayload(s)
+	default:
+		payload = s
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := n.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// commitURL returns the web URL of a commit of a repo, for GitHub and GitLab
+// (and hosts with the same layout), or "" for a local repo
+func commitURL(repo, commit string) string {
+	if repo == "." || commit == "" {
+		return ""
+	}
+	t := Target{Repo: repo}
+	return "https://" + t.Host() + "/" + strings.TrimSuffix(t.RepoPath(), ".git") + "/commit/" + commit
+}
+
+// title returns the headline of a summary, i.e. "murmur generate succeeded:
+// 2 repo(s) changed"
+func (s RunSummary) title() string {
+	title := fmt.Sprintf("murmur %s %s: %d repo(s) changed", s.Command, s.Status, s.Changed())
+	if len(s.Failures) > 0 {
+		title += fmt.Sprintf(", %d failure(s)", len(s.Failures))
+	}
+	return title
+}
+
+// lines returns a line for each changed repo and each failure of a summary,
+// with links formatted by link
+func (s RunSummary) lines(link func(text, url string) string, escape func(string) string) (repos, failures []string) {
+	for _, r := range s.Repos {
+		if !r.Changed {
+			continue
+		}
+		name := escape(r.Repo + ":" + r.Branch)
+		if r.URL != "" {
+			name = link(name, r.URL)
+		}
+		line := fmt.Sprintf("%s %s, %d file(s)", name, shortCommit(r.Commit), len(r.Files))
+		if len(r.Sources) > 0 {
+			line += " (" + escape(strings.Join(r.Sources, ", ")) + ")"
+		}
+		repos = append(repos, line)
+	}
+	for _, f := range s.Failures {
+		line := f.Phase + ": "
+		if f.Item != "" {
+			line += f.Item + ": "
+		}
+		failures = append(failures, escape(line+firstLine(f.Error)))
+	}
+	return repos, failures
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+	return commit
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	return line
+}
+
+// slackPayload returns the message of a summary for a Slack (or compatible)
+// incoming webhook
+func slackPayload(s RunSummary) map[string]any {
+	escape := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+	repos, failures := s.lines(func(text, url string) string { return "<" + url + "|" + text + ">" }, escape)
+
+	text := "*" + escape(s.title()) + "*"
+	for _, line := range repos {
+		text += "\n• " + line
+	}
+	if len(failures) > 0 {
+		text += "\n*Failures*"
+		for _, line := range failures {
+			text += "\n• " + line
+		}
+	}
+	return map[string]any{"text": text}
+}
+
+// teamsPayload returns the Adaptive Card of a summary for a Microsoft Teams
+// incoming webhook
+func teamsPayload(s RunSummary) map[string]any {
+	escape := strings.NewReplacer("[", `\[`, "]", `\]`, "*", `\*`, "_", `\_`).Replace
+	repos, failures := s.lines(func(text, url string) string { return "[" + text + "](" + url + ")" }, escape)
+
+	color := "Good"
+	if s.Status == "failed" {
+		color = "Attention"
+	}
+	body := []map[string]any{
+		{"type": "TextBlock", "text": s.title(), "weight": "Bolder", "size": "Medium", "color": color, "wrap": true},
+	}
+	if len(repos) > 0 {
+		body = append(body, map[string]any{"type": "TextBlock", "text": "- " + strings.Join(repos, "\n- "), "wrap": true})
+	}
+	if len(failures) > 0 {
+		body = append(body,
+			map[string]any{"type": "TextBlock", "text": "Failures", "weight": "Bolder", "color": "Attention", "wrap": true},
+			map[string]any{"type": "TextBlock", "text": "- " + strings.Join(failures, "\n- "), "wrap": true},
+		)
+	}
+
+	return map[string]any{
+		"type": "message",
+		"attachments": []any{map[string]any{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content": map[string]any{
+				"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+				"type":    "AdaptiveCard",
+				"version": "1.4",
+				"body":    body,
+			},
+		}},
+	}
+}
@@ -0,0 +1,187 @@
+package murmur
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// notifyServer is a stand-in for the incoming webhooks of notification sinks:
+// it records the body posted to each path
+type notifyServer struct {
+	mu     sync.Mutex
+	bodies map[string][]byte
+}
+
+func (s *notifyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	s.bodies[r.URL.Path] = body
+	s.mu.Unlock()
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "not JSON", http.StatusUnsupportedMediaType)
+		return
+	}
+	if r.URL.Path == "/down" {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}
+}
+
+// testNotifier returns a notifier of a run that published o/x:main (changed)
+// and o/y:main (unchanged), and the error of the run: a failure of o/y
+func testNotifier(sinks []NotificationConfig) (*Notifier, error) {
+	n := &Notifier{Config: &Config{Hierarchy: Hierarchy{"team", "app", "env"}, Notifications: sinks}}
+	n.Observe(Event{Kind: EventClone, Repo: "o/x", Branch: "main", Sources: []string{"ops/web/prod"}})
+	n.Observe(Event{Kind: EventClone, Repo: "o/y", Branch: "main", Sources: []string{"ops/api/prod"}})
+	n.Observe(Event{Kind: EventPublish, Repo: "o/x", Branch: "main", Changed: true, Commit: "0123456789abcdef", Files: []string{"data/a.json", "data/b.json"}})
+	n.Observe(Event{Kind: EventPublish, Repo: "o/y", Branch: "main"})
+	// only cloned: not part of the summary
+	n.Observe(Event{Kind: EventClone, Repo: "o/z", Branch: "main", Sources: []string{"ops/db/prod"}})
+	return n, Fail(PhaseWrite, "o/y:main/data", errors.New("invalid <file>\ndetails"))
+}
+
+func TestNotify(t *testing.T) {
+	srv := &notifyServer{bodies: make(map[string][]byte)}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	t.Setenv("MURMUR_TEST_SLACK_URL", ts.URL+"/slack")
+	n, runErr := testNotifier([]NotificationConfig{
+		{Name: "webhook", Type: "webhook", URL: ts.URL + "/webhook"},
+		{Name: "slack", Type: "slack", URLEnv: "MURMUR_TEST_SLACK_URL"},
+		{Name: "teams", Type: "teams", URL: ts.URL + "/teams"},
+		{Name: "web", Type: "webhook", URL: ts.URL + "/web", Filters: []string{"ops/web/*"}},
+		{Name: "db", Type: "webhook", URL: ts.URL + "/db", Filters: []string{"ops/db/*"}},
+		{Name: "web failures", Type: "webhook", URL: ts.URL + "/web-failures", Filters: []string{"ops/web/*"}, On: "failures"},
+		{Name: "down", Type: "webhook", URL: ts.URL + "/down"},
+		{Name: "unset", Type: "webhook", URLEnv: "MURMUR_TEST_UNSET_URL"},
+	})
+
+	err := n.Notify(context.Background(), "generate", time.Now().Add(-time.Minute), runErr)
+	if err == nil || !strings.Contains(err.Error(), "unable to notify down, 500 Internal Server Error") ||
+		!strings.Contains(err.Error(), "unable to notify unset, $MURMUR_TEST_UNSET_URL is not set") {
+		t.Errorf("error %v", err)
+	}
+
+	// sinks that the summary does not concern are not notified
+	for _, path := range []string{"/db", "/web-failures"} {
+		if _, ok := srv.bodies[path]; ok {
+			t.Errorf("%s notified", path)
+		}
+	}
+
+	t.Run("webhook", func(t *testing.T) {
+		var s RunSummary
+		if err := json.Unmarshal(srv.bodies["/webhook"], &s); err != nil {
+			t.Fatal(err)
+		}
+		if s.Command != "generate" || s.Status != "failed" || s.ExitCode != ExitCode(runErr) {
+			t.Errorf("summary %+v", s)
+		}
+		if len(s.Repos) != 2 || s.Repos[0].URL != "https://github.com/o/x/commit/0123456789abcdef" || len(s.Repos[0].Files) != 2 || s.Repos[1].Changed {
+			t.Errorf("repos %+v", s.Repos)
+		}
+		want := FailureSummary{Phase: "write", Item: "o/y:main/data", Error: "invalid <file>\ndetails", Sources: []string{"ops/api/prod"}}
+		if len(s.Failures) != 1 || s.Failures[0].Phase != want.Phase || s.Failures[0].Item != want.Item ||
+			s.Failures[0].Error != want.Error || strings.Join(s.Failures[0].Sources, ",") != "ops/api/prod" {
+			t.Errorf("failures %+v, want %+v", s.Failures, want)
+		}
+	})
+
+	t.Run("filtered webhook", func(t *testing.T) {
+		var s RunSummary
+		if err := json.Unmarshal(srv.bodies["/web"], &s); err != nil {
+			t.Fatal(err)
+		}
+		if len(s.Repos) != 1 || s.Repos[0].Repo != "o/x" || len(s.Failures) != 0 {
+			t.Errorf("summary of ops/web/*: repos %+v, failures %+v", s.Repos, s.Failures)
+		}
+	})
+
+	t.Run("slack", func(t *testing.T) {
+		var payload struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(srv.bodies["/slack"], &payload); err != nil {
+			t.Fatal(err)
+		}
+		want := "*murmur generate failed: 1 repo(s) changed, 1 failure(s)*\n" +
+			"• <https://github.com/o/x/commit/0123456789abcdef|o/x:main> 0123456, 2 file(s) (ops/web/prod)\n" +
+			"*Failures*\n" +
+			"• write: o/y:main/data: invalid &lt;file&gt;"
+		if payload.Text != want {
+			t.Errorf("text %q, want %q", payload.Text, want)
+		}
+	})
+
+	t.Run("teams", func(t *testing.T) {
+		var payload struct {
+			Type        string `json:"type"`
+			Attachments []struct {
+				ContentType string `json:"contentType"`
+				Content     struct {
+					Type string `json:"type"`
+					Body []struct {
+						Text  string `json:"text"`
+						Color string `json:"color"`
+					} `json:"body"`
+				} `json:"content"`
+			} `json:"attachments"`
+		}
+		if err := json.Unmarshal(srv.bodies["/teams"], &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Type != "message" || len(payload.Attachments) != 1 ||
+			payload.Attachments[0].ContentType != "application/vnd.microsoft.card.adaptive" ||
+			payload.Attachments[0].Content.Type != "AdaptiveCard" {
+			t.Fatalf("payload %s", srv.bodies["/teams"])
+		}
+		body := payload.Attachments[0].Content.Body
+		want := []struct{ text, color string }{
+			{"murmur generate failed: 1 repo(s) changed, 1 failure(s)", "Attention"},
+			{"- [o/x:main](https://github.com/o/x/commit/0123456789abcdef) 0123456, 2 file(s) (ops/web/prod)", ""},
+			{"Failures", "Attention"},
+			{"- write: o/y:main/data: invalid <file>", ""},
+		}
+		if len(body) != len(want) {
+			t.Fatalf("%d text blocks, want %d: %s", len(body), len(want), srv.bodies["/teams"])
+		}
+		for i, w := range want {
+			if body[i].Text != w.text || body[i].Color != w.color {
+				t.Errorf("block %d: %q (%s), want %q (%s)", i, body[i].Text, body[i].Color, w.text, w.color)
+			}
+		}
+	})
+}
+
+func TestRunSummaryNotifies(t *testing.T) {
+	changed := RunSummary{Repos: []RepoSummary{{Repo: "o/x", Changed: true}}}
+	failed := RunSummary{Failures: []FailureSummary{{Phase: "write"}}}
+	unchanged := RunSummary{Repos: []RepoSummary{{Repo: "o/x"}}}
+
+	tests := []struct {
+		on      string
+		summary RunSummary
+		want    bool
+	}{
+		{"", changed, true},
+		{"", failed, true},
+		{"", unchanged, false},
+		{"changes", unchanged, false},
+		{"failures", changed, false},
+		{"failures", failed, true},
+		{"always", unchanged, true},
+	}
+	for _, tt := range tests {
+		if got := tt.summary.notifies(tt.on); got != tt.want {
+			t.Errorf("notifies(%q) of %+v = %t, want %t", tt.on, tt.summary, got, tt.want)
+		}
+	}
+}
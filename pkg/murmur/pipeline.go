@@ -0,0 +1,224 @@
+package murmur
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// EventKind is the stage of the pipeline an event reports on
+type EventKind string
+
+const (
+	EventRender  EventKind = "render"
+	EventClone   EventKind = "clone"
+	EventWrite   EventKind = "write"
+	EventTarget  EventKind = "target" // the write of a single target, part of write
+	EventPublish EventKind = "publish"
+	EventCommit  EventKind = "commit" // part of publish
+	EventPush    EventKind = "push"   // part of publish
+)
+
+// Event reports the completion of a step of the pipeline: the rendering of a
+// file, the clone, write or publish of a repo / branch, or the write of a
+// target. Components with an Observer report the steps they are made of: the
+// writing of each target, and the commit and push of a repo.
+type Event struct {
+	Kind     EventKind
+	File     string   // the rendered source file
+	Files    []string // the files rendered, written, or changed by a publish or commit
+	Repo     string
+	Branch   string
+	Path     string   // the path of the target in the repo
+	Dir      string   // the clone of the repo, for the steps of a write or publish
+	Sources  []string // the hierarchy values of the targets, i.e. team/app/env
+	Commit   string   // the commit published, or made by a commit or push
+	Changed  bool     // false if there was nothing to publish
+	Err      error
+	Start    time.Time
+	Duration time.Duration
+}
+
+// Observer is called with the event of each step of the pipeline, in order.
+// It is called from the goroutine running the pipeline.
+type Observer func(Event)
+
+// PipelineOptions controls how a Pipeline runs
+type PipelineOptions struct {
+	DataDir  string    // the datadir of the sources and rendered files
+	Publish  bool      // publish the repos after writing them
+	Failures *Failures // collects failures and continues, nil stops at the first
+	Logger   *slog.Logger
+}
+
+// Pipeline renders sources, loads targets, clones and writes their repos and
+// publishes them. Steps without a component are skipped: a Pipeline without a
+// Writer only renders.
+type Pipeline struct {
+	Config    *Config
+	Renderer  Renderer
+	Targets   TargetLoader
+	Writer    Writer
+	Publisher Publisher
+	Observer  Observer
+	Options   PipelineOptions
+}
+
+// Run renders the source files, then writes the rendered files of the targets
+// to their repos and publishes them. With Failures, each phase runs to the end
+// collecting failures, and the next phase only runs if there were none.
+func (p *Pipeline) Run(ctx context.Context, files []string) error {
+	if err := p.Render(ctx, files); err != nil {
+		return err
+	}
+	if p.Targets == nil || p.Writer == nil {
+		return p.Options.Failures.Err()
+	}
+
+	targets, err := p.Targets.LoadTargets(ctx)
+	if err = p.fail(err); err != nil {
+		return err
+	}
+	if err = p.Options.Failures.Err(); err != nil {
+		return err
+	}
+	if err = p.Clone(ctx, targets); err != nil {
+		return err
+	}
+	if err = p.Options.Failures.Err(); err != nil {
+		return err
+	}
+	if err = p.Write(ctx, targets); err != nil {
+		return err
+	}
+	if err = p.Options.Failures.Err(); err != nil {
+		return err
+	}
+	if p.Options.Publish {
+		if err = p.Publish(ctx, targets); err != nil {
+			return err
+		}
+	}
+	return p.Options.Failures.Err()
+}
+
+// Render renders each file, recording the origin of the files written in the
+// render index of their directory
+func (p *Pipeline) Render(ctx context.Context, files []string) error {
+	if p.Renderer == nil {
+		return nil
+	}
+	log := logger(p.Options.Logger)
+
+	for _, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		log.Info("render", "file", file)
+
+		start := time.Now()
+		src := p.Config.Hierarchy.Source(p.Options.DataDir, file)
+		rendered, err := p.Renderer.Render(ctx, src)
+		p.emit(Event{Kind: EventRender, File: file, Files: rendered, Err: err, Start: start})
+		if err != nil {
+			log.Warn("render", "file", file, "msg", err)
+			if err = p.fail(Fail(PhaseRender, file, err)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = IndexRenderedFiles(rendered, Origin{Source: src.Path, Selection: src.Selection})
+		if err != nil {
+			log.Warn("unable to update render index", "file", file, "msg", err)
+		}
+	}
+	return nil
+}
+
+// Clone prepares the repo of each repo / branch of the targets
+func (p *Pipeline) Clone(ctx context.Context, targets []Target) error {
+	log := logger(p.Options.Logger)
+
+	for _, group := range RepoGroups(targets) {
+		target := group[0]
+		start := time.Now()
+		err := p.Writer.Prepare(ctx, group)
+		p.emit(Event{Kind: EventClone, Repo: target.Repo, Branch: target.Branch, Sources: p.sources(group), Err: err, Start: start})
+		if err != nil {
+			log.Error("unable to clone repository", "repo", target.Name, "branch", target.Branch, "error", err)
+			if err = p.fail(Fail(PhaseGit, target.Repo+":"+target.Branch, err)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Write writes the rendered files of all targets. Nothing is written if any
+// file is invalid.
+func (p *Pipeline) Write(ctx context.Context, targets []Target) error {
+	start := time.Now()
+	written, err := p.Writer.Write(ctx, targets)
+	p.emit(Event{Kind: EventWrite, Files: written, Err: err, Start: start})
+	return p.fail(Fail(PhaseWrite, "", err))
+}
+
+// Publish publishes each repo / branch of the targets. Without Failures, it
+// stops at the first error.
+func (p *Pipeline) Publish(ctx context.Context, targets []Target) error {
+	if p.Publisher == nil {
+		return errors.New("no publisher")
+	}
+	for _, group := range RepoGroups(targets) {
+		target := group[0]
+		start := time.Now()
+		result, err := p.Publisher.Publish(ctx, group)
+		e := Event{Kind: EventPublish, Repo: target.Repo, Branch: target.Branch, Sources: p.sources(group), Err: err, Start: start}
+		if result != nil {
+			e.Commit, e.Changed, e.Files = result.Commit, result.Changed, result.Files
+		}
+		p.emit(e)
+		if err = p.fail(Fail(PhaseGit, target.Repo+":"+target.Branch, err)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sources returns the hierarchy values of targets, nil without an observer
+func (p *Pipeline) sources(targets []Target) []string {
+	if p.Observer == nil {
+		return nil
+	}
+	return p.Config.TargetSources(p.Options.DataDir, targets)
+}
+
+// fail records a failure, and returns an error if the pipeline should stop
+func (p *Pipeline) fail(err error) error {
+	return p.Options.Failures.Add(err)
+}
+
+// emit sends an event to the observer
+func (p *Pipeline) emit(e Event) {
+	p.Observer.emit(e)
+}
+
+// emit sends an event to the observer, if there is one, timed from its start
+func (o Observer) emit(e Event) {
+	if o == nil {
+		return
+	}
+	e.Duration = time.Since(e.Start)
+	o(e)
+}
+
+// logger returns l, or a logger that discards everything if l is nil
+func logger(l *slog.Logger) *slog.Logger {
+	if l != nil {
+		return l
+	}
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
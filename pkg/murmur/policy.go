@@ -0,0 +1,195 @@
+package murmur
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+)
+
+// Policy is an organization rule evaluated against rendered documents
+//
+//	policy = {
+//	  name: 'prod-no-autodeploy',
+//	  types: ['stacks'],      // output types the policy applies to, [] for all
+//	  for_each: '/*',         // JSON pointer of the values to check, '*' matches
+//	                          // every array element or object member
+//	  rule: 'target.env != "prod" || item.autodeploy == false',  // CEL, true passes
+//	  action: 'deny',         // 'deny' or 'warn'
+//	  message: 'prod stacks must have autodeploy=false',
+//	};
+type Policy struct {
+	Name    string   `json:"name"`
+	Types   []string `json:"types"`
+	ForEach string   `json:"for_each"`
+	Rule    string   `json:"rule"`
+	Action  string   `json:"action"`
+	Message string   `json:"message"`
+}
+
+// PolicyResult is a single policy violation
+type PolicyResult struct {
+	Policy  string `json:"policy"`
+	Action  string `json:"action"`
+	File    string `json:"file"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// PolicySet is a set of compiled policies
+type PolicySet struct {
+	policies []compiledPolicy
+}
+
+type compiledPolicy struct {
+	Policy
+	prg cel.Program
+}
+
+// NewPolicySet compiles the rules of each policy. Rules are CEL expressions
+// with the variables:
+//
+//	doc    - the rendered document
+//	item   - the value selected by for_each (the document if unset)
+//	target - a map of the target metadata: each hierarchy level, repo, name,
+//	         branch, path, type and file
+func NewPolicySet(policies []Policy) (*PolicySet, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("doc", cel.DynType),
+		cel.Variable("item", cel.DynType),
+		cel.Variable("target", cel.MapType(cel.StringType, cel.StringType)),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ps := &PolicySet{}
+	for i, p := range policies {
+		if p.Name == "" {
+			p.Name = fmt.Sprintf("policy-%d", i)
+		}
+		switch p.Action {
+		case "":
+			p.Action = "deny"
+		case "deny", "warn":
+		default:
+			return nil, fmt.Errorf("policy %s: invalid action %q: must be deny or warn", p.Name, p.Action)
+		}
+		if p.ForEach != "" && !strings.HasPrefix(p.ForEach, "/") {
+			return nil, fmt.Errorf("policy %s: for_each %q is not a JSON pointer", p.Name, p.ForEach)
+		}
+
+		ast, iss := env.Compile(p.Rule)
+		if iss.Err() != nil {
+			return nil, fmt.Errorf("policy %s: %w", p.Name, iss.Err())
+		}
+		if ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType {
+			return nil, fmt.Errorf("policy %s: rule must return a bool, not %s", p.Name, ast.OutputType())
+		}
+		prg, err := env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("policy %s: %w", p.Name, err)
+		}
+		ps.policies = append(ps.policies, compiledPolicy{Policy: p, prg: prg})
+	}
+	return ps, nil
+}
+
+// Len returns the number of policies in the set
+func (ps *PolicySet) Len() int {
+	return len(ps.policies)
+}
+
+// Evaluate checks a rendered document (decoded JSON) of a type against every
+// applicable policy. A rule that fails to evaluate is reported as a violation.
+func (ps *PolicySet) Evaluate(file, t string, doc any, target map[string]string) []PolicyResult {
+	var results []PolicyResult
+
+	for _, p := range ps.policies {
+		if len(p.Types) > 0 && !slices.Contains(p.Types, t) {
+			continue
+		}
+
+		items := []pointerValue{{path: "", value: doc}}
+		if p.ForEach != "" {
+			items = expandPointer(doc, p.ForEach)
+		}
+
+		for _, item := range items {
+			out, _, err := p.prg.Eval(map[string]any{
+				"doc":    doc,
+				"item":   item.value,
+				"target": target,
+			})
+
+			msg := p.Message
+			switch {
+			case err != nil:
+				msg = fmt.Sprintf("rule evaluation failed: %s", err)
+			case out.Value() == true:
+				continue
+			case out.Value() != false:
+				msg = fmt.Sprintf("rule returned %v, not a bool", out.Value())
+			}
+			if msg == "" {
+				msg = fmt.Sprintf("rule %q failed", p.Rule)
+			}
+
+			results = append(results, PolicyResult{
+				Policy:  p.Name,
+				Action:  p.Action,
+				File:    file,
+				Path:    item.path,
+				Message: msg,
+			})
+		}
+	}
+	return results
+}
+
+// pointerValue is a value of a document and its JSON pointer
+type pointerValue struct {
+	path  string
+	value any
+}
+
+// expandPointer returns the values matching a JSON pointer, where a '*'
+// reference token matches every array element or object member
+func expandPointer(doc any, pointer string) []pointerValue {
+	values := []pointerValue{{path: "", value: doc}}
+	for _, token := range strings.Split(pointer, "/")[1:] {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		var next []pointerValue
+		for _, v := range values {
+			switch node := v.value.(type) {
+			case map[string]any:
+				keys := []string{token}
+				if token == "*" {
+					keys = slices.Sorted(maps.Keys(node))
+				}
+				for _, k := range keys {
+					if child, ok := node[k]; ok {
+						next = append(next, pointerValue{path: v.path + "/" + escapeToken(k), value: child})
+					}
+				}
+			case []any:
+				if token == "*" {
+					for i, child := range node {
+						next = append(next, pointerValue{path: v.path + "/" + strconv.Itoa(i), value: child})
+					}
+				} else if i, err := strconv.Atoi(token); err == nil && i >= 0 && i < len(node) {
+					next = append(next, pointerValue{path: v.path + "/" + token, value: node[i]})
+				}
+			}
+		}
+		values = next
+	}
+	return values
+}
+
+func escapeToken(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
@@ -0,0 +1,165 @@
+package murmur
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNewPolicySet(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		wantErr string
+	}{
+		{name: "valid", policy: Policy{Rule: `item.replicas > 0`, ForEach: "/stacks/*"}},
+		{name: "invalid action", policy: Policy{Name: "p", Rule: "true", Action: "block"}, wantErr: `policy p: invalid action "block"`},
+		{name: "for_each not a pointer", policy: Policy{Name: "p", Rule: "true", ForEach: "stacks"}, wantErr: "not a JSON pointer"},
+		{name: "syntax error", policy: Policy{Name: "p", Rule: "item.replicas >"}, wantErr: "policy p: "},
+		{name: "unknown variable", policy: Policy{Name: "p", Rule: "stack.replicas > 0"}, wantErr: "undeclared reference"},
+		{name: "not a bool", policy: Policy{Name: "p", Rule: `"prod"`}, wantErr: "rule must return a bool"},
+		{name: "default name", policy: Policy{Rule: "1"}, wantErr: "policy policy-0: rule must return a bool"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPolicySet([]Policy{tt.policy})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// the rules are compiled when the configuration is validated
+	c := DefaultConfig()
+	c.Policies = []Policy{{Name: "p", Rule: "item.replicas >"}}
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "invalid policies, policy p") {
+		t.Errorf("Validate: %v", err)
+	}
+}
+
+func TestPolicySetEvaluate(t *testing.T) {
+	var doc any
+	err := json.Unmarshal([]byte(`{
+		"stacks": [
+			{"name": "web", "replicas": 3, "autodeploy": true},
+			{"name": "db", "replicas": 1, "autodeploy": false}
+		],
+		"owner": "ops"
+	}`), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := map[string]string{"team": "ops", "app": "web", "env": "prod", "repo": "o/x", "type": "stacks"}
+
+	tests := []struct {
+		name   string
+		policy Policy
+		typ    string
+		want   []PolicyResult
+	}{
+		{
+			name:   "doc binding",
+			policy: Policy{Name: "owner", Rule: `doc.owner == "dev"`, Message: "owned by dev"},
+			want:   []PolicyResult{{Policy: "owner", Action: "deny", File: "f.json", Path: "", Message: "owned by dev"}},
+		},
+		{
+			name:   "item and target bindings",
+			policy: Policy{Name: "autodeploy", ForEach: "/stacks/*", Rule: `target.env != "prod" || item.autodeploy == false`, Action: "warn"},
+			want:   []PolicyResult{{Policy: "autodeploy", Action: "warn", File: "f.json", Path: "/stacks/0", Message: `rule "target.env != \"prod\" || item.autodeploy == false" failed`}},
+		},
+		{
+			name:   "item is the doc without for_each",
+			policy: Policy{Name: "same", Rule: `item == doc`},
+		},
+		{
+			name:   "other type",
+			policy: Policy{Name: "dbs", Types: []string{"dbs"}, Rule: "false"},
+		},
+		{
+			name:   "listed type",
+			policy: Policy{Name: "stacks", Types: []string{"dbs", "stacks"}, Rule: "false", Message: "m"},
+			want:   []PolicyResult{{Policy: "stacks", Action: "deny", File: "f.json", Message: "m"}},
+		},
+		{
+			name:   "evaluation error",
+			policy: Policy{Name: "missing", ForEach: "/stacks/1", Rule: `item.image != ""`},
+			want:   []PolicyResult{{Policy: "missing", Action: "deny", File: "f.json", Path: "/stacks/1", Message: "rule evaluation failed: no such key: image"}},
+		},
+		{
+			name:   "dynamic rule not a bool",
+			policy: Policy{Name: "dyn", ForEach: "/stacks/0", Rule: `item.name`},
+			want:   []PolicyResult{{Policy: "dyn", Action: "deny", File: "f.json", Path: "/stacks/0", Message: "rule returned web, not a bool"}},
+		},
+		{
+			name:   "for_each without a match",
+			policy: Policy{Name: "none", ForEach: "/services/*", Rule: "false"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps, err := NewPolicySet([]Policy{tt.policy})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ps.Evaluate("f.json", "stacks", doc, target)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandPointer(t *testing.T) {
+	var doc any
+	err := json.Unmarshal([]byte(`{
+		"stacks": [{"name": "web", "ports": [80, 443]}, {"name": "db", "ports": [5432]}],
+		"labels": {"b": 2, "a": 1},
+		"a/b": {"c~d": true}
+	}`), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		pointer string
+		want    []string // the paths of the values
+	}{
+		{pointer: "", want: []string{""}},
+		{pointer: "/stacks", want: []string{"/stacks"}},
+		{pointer: "/stacks/*", want: []string{"/stacks/0", "/stacks/1"}},
+		{pointer: "/stacks/1/name", want: []string{"/stacks/1/name"}},
+		{pointer: "/stacks/*/ports/*", want: []string{"/stacks/0/ports/0", "/stacks/0/ports/1", "/stacks/1/ports/0"}},
+		{pointer: "/stacks/*/name", want: []string{"/stacks/0/name", "/stacks/1/name"}},
+		{pointer: "/labels/*", want: []string{"/labels/a", "/labels/b"}},
+		{pointer: "/a~1b/c~0d", want: []string{"/a~1b/c~0d"}},
+		{pointer: "/*/c~0d", want: []string{"/a~1b/c~0d"}},
+		{pointer: "/stacks/2"},
+		{pointer: "/stacks/-1"},
+		{pointer: "/stacks/name"},
+		{pointer: "/missing/*"},
+		{pointer: "/stacks/0/name/*"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pointer, func(t *testing.T) {
+			var got []string
+			for _, v := range expandPointer(doc, tt.pointer) {
+				got = append(got, v.path)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// the values are the ones the paths point to
+	values := expandPointer(doc, "/stacks/*/ports/*")
+	if len(values) != 3 || values[1].value != float64(443) {
+		t.Errorf("values %+v", values)
+	}
+}
@@ -0,0 +1,296 @@
+package murmur
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Publisher publishes the files written for the targets of a single repo /
+// branch, i.e. commits and pushes them
+type Publisher interface {
+	Publish(ctx context.Context, targets []Target) (*PublishResult, error)
+}
+
+// PublishResult is the outcome of publishing a repo / branch
+type PublishResult struct {
+	Repo    string
+	Branch  string
+	Changed bool     // false if there was nothing to commit
+	Commit  string   // the commit at HEAD of the clone after publishing
+	Files   []string // the files changed by the commit, relative to the clone
+}
+
+// GitPublisher commits the files murmur manages in the clones of RepoDir and
+// pushes them. Only managed files are staged: other changes are reported, and
+// are an error if Strict is set. If a commit script is set, it is run instead
+// of committing and pushing, with the commit message in $MURMUR_COMMIT_MSG.
+type GitPublisher struct {
+	Config       *Config
+	RepoDir      string
+	DataDir      string // the directory of the rendered files, for their origin
+	CommitMsg    string
+	CommitScript string
+	Strict       bool
+	Retry        RetryOptions
+	Auth         *GitAuth
+	Writer       Writer   // writes the files again if a push conflicts, may be nil
+	Observer     Observer // called after the commit and the push
+	Logger       *slog.Logger
+}
+
+// Publish commits and pushes a single repository for the targets that write
+// to it. The commit records the sources of the targets in trailers, so that
+// it can be found by rollback.
+func (p *GitPublisher) Publish(ctx context.Context, targets []Target) (*PublishResult, error) {
+	target := targets[0]
+	result, err := p.publish(ctx, targets)
+	return result, Fail(PhaseGit, target.Repo+":"+target.Branch, err)
+}
+
+func (p *GitPublisher) publish(ctx context.Context, targets []Target) (*PublishResult, error) {
+	target := targets[0]
+	cloneDir := filepath.Join(p.RepoDir, target.CloneDir())
+
+	// check if the repository has already been cloned in repodir / target.Name
+	if _, err := os.Stat(cloneDir); err != nil {
+		return nil, fmt.Errorf("repository not cloned, %w", err)
+	}
+	if err := checkWriteMarker(cloneDir); err != nil {
+		return nil, err
+	}
+	if err := ScrubRemote(cloneDir); err != nil {
+		return nil, err
+	}
+
+	staged, err := p.stageManagedFiles(ctx, cloneDir, targets)
+	if err != nil {
+		return nil, err
+	}
+
+	// record the sources of the commit so that it can be found by rollback
+	var trailers []string
+	for _, source := range p.Config.TargetSources(p.DataDir, targets) {
+		trailers = append(trailers, SourceTrailer+": "+source)
+	}
+	if len(trailers) == 0 {
+		trailers = append(trailers, SourceTrailer+": "+p.Config.Hierarchy.Pattern(nil))
+	}
+	commitMsg := CommitMessage(p.CommitMsg, trailers)
+
+	// if the push conflicts with changes to the remote branch, the files are
+	// written again onto the remote branch and committed
+	var reapply func() (bool, error)
+	if p.Writer != nil {
+		reapply = func() (bool, error) {
+			if _, err := p.Writer.Write(ctx, targets); err != nil {
+				return false, err
+			}
+			staged, err := p.stageManagedFiles(ctx, cloneDir, targets)
+			if err != nil {
+				return false, err
+			}
+			if !hasStagedChanges(ctx, cloneDir, staged) {
+				return false, nil
+			}
+			return true, gitCommit(ctx, cloneDir, commitMsg)
+		}
+	}
+
+	// the files the commit changes
+	changed := stagedFiles(cloneDir, staged)
+
+	result := &PublishResult{Repo: target.Repo, Branch: target.Branch}
+	result.Changed, err = p.CommitAndPush(ctx, target, cloneDir, commitMsg, staged, reapply)
+	if err != nil {
+		return result, err
+	}
+	if result.Changed {
+		result.Files = changed
+	}
+	result.Commit, _ = GitOutput(cloneDir, "rev-parse", "HEAD")
+	return result, nil
+}
+
+// stageManagedFiles stages only the files murmur writes for the targets of a
+// clone, and returns them. Anything else that was staged is unstaged first.
+func (p *GitPublisher) stageManagedFiles(ctx context.Context, cloneDir string, targets []Target) ([]string, error) {
+	log := logger(p.Logger)
+	target := targets[0]
+
+	managed, err := ManagedFiles(targets)
+	if err != nil {
+		return nil, err
+	}
+	var existing []string
+	for _, rel := range managed {
+		if _, err := os.Stat(filepath.Join(cloneDir, rel)); err == nil {
+			existing = append(existing, rel)
+		}
+	}
+
+	if _, err = GitOutput(cloneDir, "reset", "--quiet"); err != nil {
+		return nil, fmt.Errorf("unable to reset the index of repo, %w", err)
+	}
+	if len(existing) > 0 {
+		addCmd := gitCmd(ctx, cloneDir, append([]string{"add", "--"}, existing...)...)
+		log.Info("adding files to repo", "cmd", addCmd.String(), "repo", target.Repo, "branch", target.Branch, "dir", addCmd.Dir)
+		if err = addCmd.Run(); err != nil {
+			return nil, fmt.Errorf("unable to add files to repo, %w", err)
+		}
+	}
+
+	// report changes that murmur did not make
+	if err = p.checkUnmanagedChanges(target, cloneDir); err != nil {
+		return nil, err
+	}
+
+	return existing, nil
+}
+
+// checkUnmanagedChanges reports uncommitted changes in a clone that are not
+// staged, which murmur did not write. If Strict is set, they are an error.
+func (p *GitPublisher) checkUnmanagedChanges(target Target, cloneDir string) error {
+	log := logger(p.Logger)
+
+	out, err := GitOutput(cloneDir, "status", "--porcelain", "--untracked-files=all")
+	if err != nil {
+		return err
+	}
+
+	var unmanaged []string
+	for _, line := range strings.Split(out, "\n") {
+		// the first column is the index status: a blank or '?' means unstaged
+		if len(line) < 4 || (line[0] != ' ' && line[0] != '?') {
+			continue
+		}
+		unmanaged = append(unmanaged, line[3:])
+	}
+	if len(unmanaged) == 0 {
+		return nil
+	}
+
+	if p.Strict {
+		log.Error("repository has changes not written by murmur", "repo", target.Repo, "branch", target.Branch, "dir", cloneDir, "files", unmanaged)
+		return fmt.Errorf("repository %s has %d change(s) not written by murmur", target.Repo, len(unmanaged))
+	}
+	log.Warn("repository has changes not written by murmur: they will not be committed", "repo", target.Repo, "branch", target.Branch, "dir", cloneDir, "files", unmanaged)
+	return nil
+}
+
+// CommitAndPush commits the staged changes of a clone to the paths and pushes
+// them to the remote origin, or runs the commit script. It reports whether
+// there were changes to commit. If the push is rejected and the rebase onto
+// the remote branch conflicts, the clone is reset to the remote branch and
+// reapply is called to recreate the commit; a nil reapply makes a conflict an
+// error.
+func (p *GitPublisher) CommitAndPush(ctx context.Context, target Target, cloneDir, commitMsg string, paths []string, reapply func() (bool, error)) (bool, error) {
+	log := logger(p.Logger)
+
+	var err error
+
+	// set commitScript to the absolute path of the script, relative to the
+	// current working directory, if it is set
+	commitScript := ""
+	if p.CommitScript != "" {
+		commitScript, err = filepath.Abs(p.CommitScript)
+		if err != nil {
+			return false, fmt.Errorf("unable to get absolute path of commit script, %w", err)
+		}
+	}
+
+	if !hasStagedChanges(ctx, cloneDir, paths) {
+		log.Info("no changes to commit to repo", "repo", target.Repo, "branch", target.Branch, "dir", cloneDir)
+		return false, nil
+	}
+
+	// the events of the commit and push record what was committed
+	event := Event{Repo: target.Repo, Branch: target.Branch, Dir: cloneDir, Sources: messageSources(commitMsg)}
+	emit := func(kind EventKind, start time.Time, err error) {
+		e := event
+		e.Kind, e.Start, e.Err = kind, start, err
+		if err == nil {
+			e.Commit, _ = GitOutput(cloneDir, "rev-parse", "HEAD")
+		}
+		p.Observer.emit(e)
+	}
+	if p.Observer != nil {
+		event.Files = stagedFiles(cloneDir, paths)
+	}
+
+	// if a commit script is provided, run it rather than our default commit & push process
+	start := time.Now()
+	if commitScript != "" {
+		log.Debug("running commit script", "script", commitScript)
+		// the script pushes: it gets the credentials of the remote
+		if p.Auth != nil {
+			if err = p.Auth.Configure([]Target{target}); err != nil {
+				emit(EventCommit, start, err)
+				return true, err
+			}
+		}
+		commitCmd := exec.CommandContext(ctx, commitScript)
+		commitCmd.Env = append(append(os.Environ(), p.Auth.Env()...), "MURMUR_COMMIT_MSG="+commitMsg)
+		commitCmd.Dir = cloneDir
+		commitCmd.Stdout = os.Stdout
+		commitCmd.Stderr = os.Stderr
+
+		log.Info("commiting changes to repo", "cmd", commitCmd.String(), "repo", target.Repo, "branch", target.Branch, "dir", commitCmd.Dir)
+		if err = commitCmd.Run(); err != nil {
+			err = fmt.Errorf("Unable to commit to repo. %w", err)
+		}
+		emit(EventCommit, start, err)
+		return true, err
+	}
+
+	log.Info("commiting changes to repo", "repo", target.Repo, "branch", target.Branch, "dir", cloneDir)
+	err = gitCommit(ctx, cloneDir, commitMsg)
+	emit(EventCommit, start, err)
+	if err != nil {
+		return true, err
+	}
+
+	// push repo to the remote origin
+	log.Info("pushing repository", "repo", target.Repo, "branch", target.Branch, "dir", cloneDir)
+	start = time.Now()
+	if err = pushRepo(ctx, log, p.Retry, p.Auth, target, cloneDir, reapply); err != nil {
+		err = fmt.Errorf("unable to push repository, %w", err)
+	}
+	emit(EventPush, start, err)
+	return true, err
+}
+
+// TargetSources returns the hierarchy values (i.e. team/app/env) of the
+// targets, taken from the origin of their target files
+func (c *Config) TargetSources(datadir string, targets []Target) []string {
+	var sources []string
+	for _, t := range targets {
+		origin, _ := c.Hierarchy.FileOrigin(datadir, filepath.Join(t.Dir, t.Filename))
+		if origin.Selection == nil {
+			continue
+		}
+		source := c.Hierarchy.Pattern(origin.Selection)
+		if !slices.Contains(sources, source) {
+			sources = append(sources, source)
+		}
+	}
+	slices.Sort(sources)
+	return sources
+}
+
+// gitCommit commits the staged changes of a clone
+func gitCommit(ctx context.Context, cloneDir, commitMsg string) error {
+	commitCmd := gitCmd(ctx, cloneDir, "commit", "-m", commitMsg)
+	commitCmd.Stdout = os.Stdout
+	commitCmd.Stderr = os.Stderr
+	if err := commitCmd.Run(); err != nil {
+		return fmt.Errorf("Unable to commit to repo. %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package murmur
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// RenderIndexFilename is the name of the file, written to each directory that
+// receives rendered files, that records where each rendered file came from
+const RenderIndexFilename = ".murmur-render.json"
+
+// Origin records the source of a rendered file
+type Origin struct {
+	Source    string    `json:"source"`    // jsonnet file, relative to the datadir
+	Selection Selection `json:"selection"` // hierarchy values of the source
+}
+
+// RenderIndex maps rendered file names (base names) to their Origin
+type RenderIndex map[string]Origin
+
+// ReadRenderIndex reads the render index of a directory. An empty index is
+// returned if the directory has none.
+func ReadRenderIndex(dir string) (RenderIndex, error) {
+	idx := make(RenderIndex)
+	file, err := os.ReadFile(filepath.Join(dir, RenderIndexFilename))
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(file, &idx)
+	return idx, err
+}
+
+// WriteRenderIndex merges entries into the render index of a directory
+func WriteRenderIndex(dir string, entries RenderIndex) error {
+	idx, err := ReadRenderIndex(dir)
+	if err != nil {
+		return err
+	}
+	for name, origin := range entries {
+		idx[name] = origin
+	}
+	out, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, RenderIndexFilename), append(out, '\n'), 0644)
+}
+
+// Source is a file to render
+type Source struct {
+	File      string    // path of the file
+	Path      string    // path relative to the datadir, "" if outside of it
+	Selection Selection // hierarchy values, nil if not in a leaf directory
+}
+
+// Renderer renders a source file and returns the files it wrote. A renderer
+// that does not report its files returns nil.
+type Renderer interface {
+	Render(ctx context.Context, src Source) ([]string, error)
+}
+
+// JsonnetRenderer renders jsonnet files with the jsonnet application, run from
+// the directory of each file so that relative imports are resolved. The
+// hierarchy values, the path and the variable files of the datadir are passed
+// as set in the 'render' section of the configuration.
+type JsonnetRenderer struct {
+	Config  *Config
+	DataDir string
+	Args    []string // jsonnet arguments: a trailing -m is completed with OutDir
+	OutDir  string   // relative to the file if not absolute [default: .]
+	Logger  *slog.Logger
+}
+
+func (r JsonnetRenderer) Render(ctx context.Context, src Source) ([]string, error) {
+	log := logger(r.Logger)
+
+	vars, err := r.Vars(src)
+	if err != nil {
+		return nil, err
+	}
+
+	args := slices.Clone(r.Args)
+	if len(args) > 0 && args[len(args)-1] == "-m" {
+		outDir := r.OutDir
+		if outDir == "" {
+			outDir = "."
+		}
+		args = append(args, outDir)
+	}
+	args = append(append(args, vars...), filepath.Base(src.File))
+
+	cmd := exec.CommandContext(ctx, "jsonnet", args...)
+	cmd.Dir = filepath.Dir(src.File)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	log.Info("jsonnet", "cmd", cmd.String(), "dir", cmd.Dir)
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("error processing file %s, %w: %s", src.File, err, strings.TrimSpace(stderr.String()))
+	}
+
+	// with -m, jsonnet prints the name of each file it writes
+	var files []string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(cmd.Dir, line)
+		}
+		if _, err := os.Stat(line); err != nil {
+			// not a rendered file: jsonnet was not run with -m
+			return nil, nil
+		}
+		files = append(files, line)
+	}
+	return files, nil
+}
+
+// Vars returns the jsonnet arguments that inject the render variables of a
+// source, as set in the 'render' section of the configuration
+func (r JsonnetRenderer) Vars(src Source) ([]string, error) {
+	log := logger(r.Logger)
+	c := r.Config
+
+	if c.Render.Inject == "none" {
+		return nil, nil
+	}
+
+	strFlag, codeFlag := "--ext-str", "--ext-code"
+	if c.Render.Inject == "tla" {
+		strFlag, codeFlag = "--tla-str", "--tla-code"
+	}
+
+	vars, err := c.RenderVars(r.DataDir, src, log)
+	if err != nil {
+		return nil, err
+	}
+
+	var args []string
+	for _, name := range slices.Sorted(maps.Keys(vars)) {
+		flag := strFlag
+		if vars[name].Code {
+			flag = codeFlag
+		}
+		args = append(args, flag, name+"="+vars[name].Value)
+	}
+
+	log.Debug("jsonnet variables", "file", src.File, "args", args)
+
+	return args, nil
+}
+
+// RenderVar is a variable passed to a renderer: a string, or JSON code
+type RenderVar struct {
+	Value string
+	Code  bool
+}
+
+// RenderVars returns the variables of a source: the contents of the variable
+// files of the datadir and each directory down to the source, then the
+// hierarchy values and the datadir-relative path, which take precedence
+func (c *Config) RenderVars(datadir string, src Source, log *slog.Logger) (map[string]RenderVar, error) {
+	log = logger(log)
+	vars := make(map[string]RenderVar)
+
+	// variable files, from the datadir down to the directory of the file
+	dirs := []string{datadir}
+	absDatadir, _ := filepath.Abs(datadir)
+	absDir, _ := filepath.Abs(filepath.Dir(src.File))
+	if relDir, err := filepath.Rel(absDatadir, absDir); err == nil && !strings.HasPrefix(relDir, "..") && relDir != "." {
+		dir := datadir
+		for _, elem := range strings.Split(relDir, string(filepath.Separator)) {
+			dir = filepath.Join(dir, elem)
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range dirs {
+		for _, name := range c.Render.VarFiles {
+			varFile := filepath.Join(dir, name)
+			content, err := os.ReadFile(varFile)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			var fileVars map[string]json.RawMessage
+			if err = json.Unmarshal(content, &fileVars); err != nil {
+				return nil, fmt.Errorf("unable to parse variable file %s, %w", varFile, err)
+			}
+			log.Debug("read variable file", "file", varFile)
+			for k, v := range fileVars {
+				vars[k] = RenderVar{Value: string(v), Code: true}
+			}
+		}
+	}
+
+	// hierarchy values and the path take precedence over variable files
+	for _, level := range c.Hierarchy {
+		if src.Selection == nil {
+			break
+		}
+		name := c.Render.VarName(level)
+		if _, ok := vars[name]; ok {
+			log.Warn("variable file value overridden by hierarchy value", "name", name, "file", src.File)
+		}
+		vars[name] = RenderVar{Value: src.Selection.Get(level)}
+	}
+	if src.Path != "" {
+		vars[c.Render.VarName("path")] = RenderVar{Value: src.Path}
+	}
+
+	return vars, nil
+}
+
+// IndexRenderedFiles records the origin of rendered files in the render index
+// of the directories they were written to
+func IndexRenderedFiles(files []string, origin Origin) error {
+	entries := make(map[string]RenderIndex)
+	for _, file := range files {
+		outDir := filepath.Dir(file)
+		if entries[outDir] == nil {
+			entries[outDir] = make(RenderIndex)
+		}
+		entries[outDir][filepath.Base(file)] = origin
+	}
+	for outDir, idx := range entries {
+		if err := WriteRenderIndex(outDir, idx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FileOrigin returns the origin of a rendered file from the render index of
+// its directory. The source of files without an index entry is unknown, their
+// selection is taken from their location in the datadir hierarchy.
+func (h Hierarchy) FileOrigin(datadir, file string) (Origin, error) {
+	idx, err := ReadRenderIndex(filepath.Dir(file))
+	if origin, ok := idx[filepath.Base(file)]; ok {
+		return origin, nil
+	}
+	src := h.Source(datadir, file)
+	return Origin{Selection: src.Selection}, err
+}
+
+// Source returns a file as a Source: its path relative to the datadir and the
+// hierarchy values of its directory
+func (h Hierarchy) Source(datadir, file string) Source {
+	src := Source{File: file}
+	absDatadir, err1 := filepath.Abs(datadir)
+	absFile, err2 := filepath.Abs(file)
+	if err1 != nil || err2 != nil {
+		return src
+	}
+	rel, err := filepath.Rel(absDatadir, absFile)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return src
+	}
+	src.Path = filepath.ToSlash(rel)
+	if sel, ok := h.FromPath(rel); ok {
+		src.Selection = sel
+	}
+	return src
+}
@@ -0,0 +1,131 @@
+package murmur
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRenderVars(t *testing.T) {
+	datadir, outside := t.TempDir(), t.TempDir()
+	for file, content := range map[string]string{
+		"vars.json":               `{"region": "us", "replicas": 1, "TEAM": "from-file", "tags": ["a"]}`,
+		"ops/vars.json":           `{"replicas": 2}`,
+		"ops/web/prod/vars.json":  `{"replicas": 3, "image": "v1"}`,
+		"ops/web/prod/local.json": `{"image": "v2"}`,
+		"ops/web/dev/vars.json":   `{"replicas": `,
+	} {
+		file = filepath.Join(datadir, file)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	str := func(v string) RenderVar { return RenderVar{Value: v} }
+	code := func(v string) RenderVar { return RenderVar{Value: v, Code: true} }
+	tests := []struct {
+		name    string
+		names   map[string]string // the render names of the config
+		file    string
+		want    map[string]RenderVar
+		wantErr string
+	}{
+		{
+			name: "leaf",
+			file: filepath.Join(datadir, "ops/web/prod/web.jsonnet"),
+			want: map[string]RenderVar{
+				// the closest variable file wins, then the later file of a directory
+				"region": code(`"us"`), "replicas": code("3"), "image": code(`"v2"`), "tags": code(`["a"]`),
+				// the hierarchy values override the variable files
+				"TEAM": str("ops"), "APP": str("web"), "ENV": str("prod"),
+				"PATH": str("ops/web/prod/web.jsonnet"),
+			},
+		},
+		{
+			name:  "renamed",
+			names: map[string]string{"team": "team", "path": "FILE"},
+			file:  filepath.Join(datadir, "ops/web/prod/web.jsonnet"),
+			want: map[string]RenderVar{
+				"region": code(`"us"`), "replicas": code("3"), "image": code(`"v2"`), "tags": code(`["a"]`),
+				"TEAM": code(`"from-file"`), "team": str("ops"), "APP": str("web"), "ENV": str("prod"),
+				"FILE": str("ops/web/prod/web.jsonnet"),
+			},
+		},
+		{
+			name: "not in a leaf directory",
+			file: filepath.Join(datadir, "ops/web.jsonnet"),
+			want: map[string]RenderVar{
+				"region": code(`"us"`), "replicas": code("2"), "TEAM": code(`"from-file"`), "tags": code(`["a"]`),
+				"PATH": str("ops/web.jsonnet"),
+			},
+		},
+		{
+			name: "outside of the datadir",
+			file: filepath.Join(outside, "web.jsonnet"),
+			want: map[string]RenderVar{
+				"region": code(`"us"`), "replicas": code("1"), "TEAM": code(`"from-file"`), "tags": code(`["a"]`),
+			},
+		},
+		{
+			name:    "invalid variable file",
+			file:    filepath.Join(datadir, "ops/web/dev/web.jsonnet"),
+			wantErr: "unable to parse variable file " + filepath.Join(datadir, "ops/web/dev/vars.json"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.Render.VarFiles = []string{"vars.json", "local.json"}
+			c.Render.Names = tt.names
+			got, err := c.RenderVars(datadir, c.Hierarchy.Source(datadir, tt.file), nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJsonnetRendererVars(t *testing.T) {
+	datadir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(datadir, "vars.json"), []byte(`{"replicas": 1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		inject string
+		want   []string
+	}{
+		{inject: "ext", want: []string{"--ext-str", "APP=web", "--ext-str", "ENV=prod", "--ext-str", "PATH=ops/web/prod/web.jsonnet", "--ext-str", "TEAM=ops", "--ext-code", "replicas=1"}},
+		{inject: "tla", want: []string{"--tla-str", "APP=web", "--tla-str", "ENV=prod", "--tla-str", "PATH=ops/web/prod/web.jsonnet", "--tla-str", "TEAM=ops", "--tla-code", "replicas=1"}},
+		{inject: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.inject, func(t *testing.T) {
+			c := DefaultConfig()
+			c.Render.Inject = tt.inject
+			c.Render.VarFiles = []string{"vars.json"}
+			r := JsonnetRenderer{Config: c, DataDir: datadir}
+			got, err := r.Vars(c.Hierarchy.Source(datadir, filepath.Join(datadir, "ops/web/prod/web.jsonnet")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
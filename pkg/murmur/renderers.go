@@ -0,0 +1,359 @@
+package murmur
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RendererRegistry is a Renderer that renders each source with the renderer
+// of its file extension. The longest matching extension wins, so that i.e.
+// ".src.json" can be registered alongside ".json".
+type RendererRegistry map[string]Renderer
+
+// RenderOptions are the options shared by the renderers of a registry
+type RenderOptions struct {
+	DataDir     string
+	OutDir      string   // relative to the source if not absolute [default: .]
+	JsonnetArgs []string // a trailing -m is completed with OutDir
+	Logger      *slog.Logger
+}
+
+// NewRendererRegistry returns the renderers of the 'render.renderers' section
+// of the configuration
+func NewRendererRegistry(c *Config, opts RenderOptions) RendererRegistry {
+	registry := make(RendererRegistry)
+	for ext, rc := range c.Render.Renderers {
+		switch rc.Type {
+		case "jsonnet":
+			registry[ext] = JsonnetRenderer{Config: c, DataDir: opts.DataDir, Args: opts.JsonnetArgs, OutDir: opts.OutDir, Logger: opts.Logger}
+		case "template":
+			registry[ext] = TemplateRenderer{Config: c, DataDir: opts.DataDir, Ext: ext, OutDir: opts.OutDir, Logger: opts.Logger}
+		case "passthrough":
+			registry[ext] = PassthroughRenderer{Ext: ext, OutDir: opts.OutDir, Logger: opts.Logger}
+		case "exec":
+			registry[ext] = ExecRenderer{Config: c, DataDir: opts.DataDir, Ext: ext, Command: rc.Command, Output: rc.Output, OutDir: opts.OutDir, Logger: opts.Logger}
+		}
+	}
+	return registry
+}
+
+// Extensions returns the registered file extensions, sorted
+func (r RendererRegistry) Extensions() []string {
+	return slices.Sorted(maps.Keys(r))
+}
+
+// Match returns the extension a file is rendered by, "" if there is none
+func (r RendererRegistry) Match(file string) string {
+	match := ""
+	for ext := range r {
+		if strings.HasSuffix(file, ext) && len(ext) > len(match) && len(filepath.Base(file)) > len(ext) {
+			match = ext
+		}
+	}
+	return match
+}
+
+func (r RendererRegistry) Render(ctx context.Context, src Source) ([]string, error) {
+	ext := r.Match(src.File)
+	if ext == "" {
+		return nil, fmt.Errorf("no renderer for %s", src.File)
+	}
+	return r[ext].Render(ctx, src)
+}
+
+// TemplateRenderer renders Go text/template files. The data of a template is
+// its render variables: the hierarchy values, the path and the (decoded)
+// contents of the variable files, i.e. {{.ENV}}. The output file is named
+// after the template, minus the extension, with a .json extension, and the
+// name may itself use the variables: "{{.APP}}-stacks.json.tmpl" (for
+// ".json.tmpl" or ".tmpl") renders "web-stacks.json".
+type TemplateRenderer struct {
+	Config  *Config
+	DataDir string
+	Ext     string // the extension removed from output names
+	OutDir  string // relative to the template if not absolute [default: .]
+	Logger  *slog.Logger
+}
+
+func (r TemplateRenderer) Render(ctx context.Context, src Source) ([]string, error) {
+	log := logger(r.Logger)
+
+	vars, err := r.Config.RenderVars(r.DataDir, src, log)
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string]any)
+	for name, v := range vars {
+		if !v.Code {
+			data[name] = v.Value
+			continue
+		}
+		var value any
+		if err = json.Unmarshal([]byte(v.Value), &value); err != nil {
+			return nil, fmt.Errorf("invalid value of variable %s, %w", name, err)
+		}
+		data[name] = value
+	}
+
+	content, err := os.ReadFile(src.File)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(filepath.Base(src.File)).Funcs(templateFuncs).Option("missingkey=error").Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse template %s, %w", src.File, err)
+	}
+	var out bytes.Buffer
+	if err = tmpl.Execute(&out, data); err != nil {
+		return nil, fmt.Errorf("unable to render template %s, %w", src.File, err)
+	}
+	if !json.Valid(out.Bytes()) {
+		return nil, fmt.Errorf("template %s did not render valid JSON", src.File)
+	}
+
+	name, err := r.outputName(src.File, data)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("template", "file", src.File, "output", name)
+	return writeRendered(src.File, r.OutDir, map[string][]byte{name: out.Bytes()})
+}
+
+// outputName returns the name of the file a template renders, executing the
+// name as a template
+func (r TemplateRenderer) outputName(file string, data map[string]any) (string, error) {
+	name := strings.TrimSuffix(filepath.Base(file), r.Ext)
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(name)
+	if err != nil {
+		return "", fmt.Errorf("invalid template name %s, %w", file, err)
+	}
+	var out strings.Builder
+	if err = tmpl.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("invalid template name %s, %w", file, err)
+	}
+	return jsonName(out.String()), nil
+}
+
+// templateFuncs are the functions available to templates
+var templateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		out, err := json.Marshal(v)
+		return string(out), err
+	},
+	"join": func(sep string, v []any) string {
+		s := make([]string, len(v))
+		for i, e := range v {
+			s[i] = fmt.Sprint(e)
+		}
+		return strings.Join(s, sep)
+	},
+	"default": func(def, v any) any {
+		if v == nil || v == "" {
+			return def
+		}
+		return v
+	},
+}
+
+// PassthroughRenderer copies JSON files, and converts YAML files to JSON. The
+// output file is named after the source, minus the extension, with a .json
+// extension: "web-stacks.src.yaml" (for ".src.yaml") renders "web-stacks.json".
+type PassthroughRenderer struct {
+	Ext    string
+	OutDir string // relative to the source if not absolute [default: .]
+	Logger *slog.Logger
+}
+
+func (r PassthroughRenderer) Render(ctx context.Context, src Source) ([]string, error) {
+	log := logger(r.Logger)
+
+	content, err := os.ReadFile(src.File)
+	if err != nil {
+		return nil, err
+	}
+
+	switch filepath.Ext(src.File) {
+	case ".yaml", ".yml":
+		var doc any
+		if err = yaml.Unmarshal(content, &doc); err != nil {
+			return nil, fmt.Errorf("unable to parse %s, %w", src.File, err)
+		}
+		if content, err = json.MarshalIndent(doc, "", "   "); err != nil {
+			return nil, fmt.Errorf("unable to convert %s to JSON, %w", src.File, err)
+		}
+		content = append(content, '\n')
+	default:
+		if !json.Valid(content) {
+			return nil, fmt.Errorf("invalid JSON in %s", src.File)
+		}
+	}
+
+	name := jsonName(strings.TrimSuffix(filepath.Base(src.File), r.Ext))
+	log.Info("passthrough", "file", src.File, "output", name)
+	return writeRendered(src.File, r.OutDir, map[string][]byte{name: content})
+}
+
+// ExecRenderer renders sources with an external command, run from the
+// directory of the source. In the arguments of the command, {file} is
+// replaced by the name of the source, {outdir} by the output directory and
+// {path} by the datadir-relative path of the source. The render variables are
+// passed in the environment as $MURMUR_VAR_<name>, and all together as a JSON
+// object in $MURMUR_VARS.
+//
+// The output of the command is read according to Output:
+//   - files: the command writes files to {outdir} and prints their names, one
+//     per line, relative to the directory of the source or absolute (as
+//     `jsonnet -m` does)
+//   - stdout: the command prints a JSON document, written to a file named after
+//     the source, minus the extension, with a .json extension
+//   - multi: the command prints a JSON object of file names and their JSON
+//     documents (as `jsonnet` without -m does for multi-file output)
+type ExecRenderer struct {
+	Config  *Config
+	DataDir string
+	Ext     string
+	Command []string
+	Output  string // files, stdout or multi [default: files]
+	OutDir  string // relative to the source if not absolute [default: .]
+	Logger  *slog.Logger
+}
+
+func (r ExecRenderer) Render(ctx context.Context, src Source) ([]string, error) {
+	log := logger(r.Logger)
+
+	vars, err := r.Config.RenderVars(r.DataDir, src, log)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(src.File)
+	outDir := r.OutDir
+	if outDir == "" {
+		outDir = "."
+	}
+
+	replacer := strings.NewReplacer("{file}", filepath.Base(src.File), "{outdir}", outDir, "{path}", src.Path)
+	args := make([]string, len(r.Command))
+	for i, arg := range r.Command {
+		args[i] = replacer.Replace(arg)
+	}
+
+	all := make(map[string]json.RawMessage)
+	env := os.Environ()
+	for name, v := range vars {
+		env = append(env, "MURMUR_VAR_"+name+"="+v.Value)
+		if v.Code {
+			all[name] = json.RawMessage(v.Value)
+		} else {
+			all[name], _ = json.Marshal(v.Value)
+		}
+	}
+	allVars, err := json.Marshal(all)
+	if err != nil {
+		return nil, err
+	}
+	env = append(env, "MURMUR_VARS="+string(allVars))
+
+	if r.Output == "" || r.Output == "files" {
+		if err = os.MkdirAll(filepath.Join(dir, outDir), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Env = env
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	log.Info("exec", "cmd", cmd.String(), "dir", cmd.Dir)
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("error processing file %s, %w: %s", src.File, err, strings.TrimSpace(stderr.String()))
+	}
+
+	switch r.Output {
+	case "stdout":
+		if !json.Valid(stdout.Bytes()) {
+			return nil, fmt.Errorf("invalid JSON output for %s", src.File)
+		}
+		name := jsonName(strings.TrimSuffix(filepath.Base(src.File), r.Ext))
+		return writeRendered(src.File, r.OutDir, map[string][]byte{name: stdout.Bytes()})
+	case "multi":
+		var docs map[string]json.RawMessage
+		if err = json.Unmarshal(stdout.Bytes(), &docs); err != nil {
+			return nil, fmt.Errorf("invalid multi-file output for %s, %w", src.File, err)
+		}
+		files := make(map[string][]byte)
+		for name, doc := range docs {
+			var out bytes.Buffer
+			if err = json.Indent(&out, doc, "", "   "); err != nil {
+				return nil, err
+			}
+			files[name] = append(out.Bytes(), '\n')
+		}
+		return writeRendered(src.File, r.OutDir, files)
+	}
+
+	var files []string
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(dir, line)
+		}
+		if _, err := os.Stat(line); err != nil {
+			return nil, fmt.Errorf("output %s of %s is not a file, %w", line, src.File, err)
+		}
+		files = append(files, line)
+	}
+	return files, nil
+}
+
+// writeRendered writes the files rendered from a source to the output
+// directory, relative to the directory of the source, and returns their paths
+func writeRendered(file, outDir string, contents map[string][]byte) ([]string, error) {
+	if outDir == "" {
+		outDir = "."
+	}
+	if !filepath.IsAbs(outDir) {
+		outDir = filepath.Join(filepath.Dir(file), outDir)
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, name := range slices.Sorted(maps.Keys(contents)) {
+		if name == "" || filepath.Base(name) != name {
+			return nil, fmt.Errorf("invalid output file name %q of %s", name, file)
+		}
+		dest := filepath.Join(outDir, name)
+		if err := os.WriteFile(dest, contents[name], 0644); err != nil {
+			return nil, err
+		}
+		files = append(files, dest)
+	}
+	return files, nil
+}
+
+// jsonName adds a .json extension to a file name that has none
+func jsonName(name string) string {
+	if strings.HasSuffix(name, ".json") {
+		return name
+	}
+	return name + ".json"
+}
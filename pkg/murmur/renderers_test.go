@@ -0,0 +1,257 @@
+package murmur
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeFiles writes files, relative to a directory
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readFiles returns the content of files, keyed by their base name
+func readFiles(t *testing.T, files []string) map[string]string {
+	t.Helper()
+	contents := make(map[string]string)
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[filepath.Base(file)] = string(content)
+	}
+	return contents
+}
+
+func TestNewRendererRegistry(t *testing.T) {
+	c := DefaultConfig()
+	c.Render.Renderers = map[string]RendererConfig{
+		".jsonnet":     {Type: "jsonnet"},
+		".json.tmpl":   {Type: "template"},
+		".tmpl":        {Type: "template"},
+		".src.json":    {Type: "passthrough"},
+		".yaml":        {Type: "passthrough"},
+		".cue":         {Type: "exec", Command: []string{"cue", "export", "{file}"}, Output: "stdout"},
+		".unknown":     {Type: "other"},
+		".web.jsonnet": {Type: "exec", Command: []string{"render"}},
+	}
+	r := NewRendererRegistry(c, RenderOptions{DataDir: "data", OutDir: "out"})
+
+	if got, want := r.Extensions(), []string{".cue", ".json.tmpl", ".jsonnet", ".src.json", ".tmpl", ".web.jsonnet", ".yaml"}; !slices.Equal(got, want) {
+		t.Errorf("extensions %q, want %q", got, want)
+	}
+	if _, ok := r[".json.tmpl"].(TemplateRenderer); !ok {
+		t.Errorf(".json.tmpl: %T", r[".json.tmpl"])
+	}
+	if e, ok := r[".cue"].(ExecRenderer); !ok || e.Output != "stdout" || e.OutDir != "out" || e.DataDir != "data" {
+		t.Errorf(".cue: %#v", r[".cue"])
+	}
+
+	tests := []struct {
+		file string
+		want string
+	}{
+		{file: "ops/web/prod/web.jsonnet", want: ".jsonnet"},
+		{file: "ops/web/prod/app.web.jsonnet", want: ".web.jsonnet"},
+		{file: "ops/web/prod/stacks.json.tmpl", want: ".json.tmpl"},
+		{file: "ops/web/prod/stacks.tmpl", want: ".tmpl"},
+		{file: "ops/web/prod/stacks.src.json", want: ".src.json"},
+		{file: "ops/web/prod/stacks.json"},
+		{file: "ops/web/prod/.yaml"},
+		{file: "ops/web/prod/web.libsonnet"},
+	}
+	for _, tt := range tests {
+		if got := r.Match(tt.file); got != tt.want {
+			t.Errorf("%s: matched %q, want %q", tt.file, got, tt.want)
+		}
+	}
+
+	if _, err := r.Render(context.Background(), Source{File: "stacks.json"}); err == nil || !strings.Contains(err.Error(), "no renderer for stacks.json") {
+		t.Errorf("unmatched file: %v", err)
+	}
+}
+
+func TestTemplateRenderer(t *testing.T) {
+	datadir := t.TempDir()
+	writeFiles(t, datadir, map[string]string{
+		"vars.json": `{"replicas": 3, "tags": ["a", "b"], "owner": ""}`,
+		"ops/web/prod/{{.APP}}-stacks.json.tmpl": `{"env": "{{.ENV}}", "path": "{{.PATH}}", "replicas": {{.replicas}},` +
+			` "tags": {{json .tags}}, "joined": "{{join "," .tags}}", "owner": "{{default "ops" .owner}}"}`,
+		"ops/web/prod/missing.json.tmpl": `{"region": "{{.region}}"}`,
+		"ops/web/prod/invalid.json.tmpl": `{"env": {{.ENV}}}`,
+		"ops/web/prod/syntax.json.tmpl":  `{"env": "{{.ENV}"}`,
+	})
+	c := DefaultConfig()
+	c.Render.VarFiles = []string{"vars.json"}
+	r := TemplateRenderer{Config: c, DataDir: datadir, Ext: ".tmpl", OutDir: "out"}
+
+	tests := []struct {
+		name    string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name: "{{.APP}}-stacks.json.tmpl",
+			want: map[string]string{"web-stacks.json": `{"env": "prod", "path": "ops/web/prod/{{.APP}}-stacks.json.tmpl", "replicas": 3, "tags": ["a","b"], "joined": "a,b", "owner": "ops"}`},
+		},
+		{name: "missing.json.tmpl", wantErr: `map has no entry for key "region"`},
+		{name: "invalid.json.tmpl", wantErr: "did not render valid JSON"},
+		{name: "syntax.json.tmpl", wantErr: "unable to parse template"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(datadir, "ops/web/prod", tt.name)
+			files, err := r.Render(context.Background(), c.Hierarchy.Source(datadir, file))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range files {
+				if filepath.Dir(f) != filepath.Join(datadir, "ops/web/prod/out") {
+					t.Errorf("%s not written to the output directory", f)
+				}
+			}
+			if got := readFiles(t, files); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPassthroughRenderer(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"web-stacks.src.yaml": "stacks:\n  - name: web\n    replicas: 3\n",
+		"web-dbs.src.json":    `{"dbs": []}`,
+		"bad.src.json":        `{"dbs": [}`,
+		"bad.src.yaml":        "stacks: [\n",
+	})
+	tests := []struct {
+		file    string
+		ext     string
+		want    map[string]string
+		wantErr string
+	}{
+		{file: "web-stacks.src.yaml", ext: ".src.yaml", want: map[string]string{"web-stacks.json": "{\n   \"stacks\": [\n      {\n         \"name\": \"web\",\n         \"replicas\": 3\n      }\n   ]\n}\n"}},
+		{file: "web-dbs.src.json", ext: ".src.json", want: map[string]string{"web-dbs.json": `{"dbs": []}`}},
+		{file: "web-dbs.src.json", ext: ".json", want: map[string]string{"web-dbs.src.json": `{"dbs": []}`}},
+		{file: "bad.src.json", ext: ".src.json", wantErr: "invalid JSON"},
+		{file: "bad.src.yaml", ext: ".src.yaml", wantErr: "unable to parse"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file+" "+tt.ext, func(t *testing.T) {
+			r := PassthroughRenderer{Ext: tt.ext, OutDir: filepath.Join(t.TempDir(), "out")}
+			files, err := r.Render(context.Background(), Source{File: filepath.Join(dir, tt.file)})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readFiles(t, files); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExecRenderer(t *testing.T) {
+	datadir := t.TempDir()
+	writeFiles(t, datadir, map[string]string{
+		"vars.json":            `{"replicas": 3}`,
+		"ops/web/prod/web.cue": "",
+	})
+	c := DefaultConfig()
+	c.Render.VarFiles = []string{"vars.json"}
+	src := c.Hierarchy.Source(datadir, filepath.Join(datadir, "ops/web/prod/web.cue"))
+	dir := filepath.Join(datadir, "ops/web/prod")
+
+	// the command prints its arguments and environment as a JSON document
+	printArgs := `printf '{"args": "%s", "env": "%s", "replicas": "%s", "vars": %s}' "$*" "$MURMUR_VAR_ENV" "$MURMUR_VAR_replicas" "$MURMUR_VARS"`
+
+	tests := []struct {
+		name    string
+		command []string
+		output  string
+		want    map[string]string
+		wantErr string
+	}{
+		{
+			name:    "stdout",
+			command: []string{"sh", "-c", printArgs, "sh", "{file}", "{outdir}", "{path}"},
+			output:  "stdout",
+			want: map[string]string{"web.json": `{"args": "web.cue out ops/web/prod/web.cue", "env": "prod", "replicas": "3", ` +
+				`"vars": {"APP":"web","ENV":"prod","PATH":"ops/web/prod/web.cue","TEAM":"ops","replicas":3}}`},
+		},
+		{
+			name:    "files",
+			command: []string{"sh", "-c", `echo '{"a": 1}' > {outdir}/a.json && echo {outdir}/a.json && echo "$PWD/{outdir}/b.json" && echo '{}' > {outdir}/b.json`},
+			want:    map[string]string{"a.json": "{\"a\": 1}\n", "b.json": "{}\n"},
+		},
+		{
+			name:    "multi",
+			command: []string{"sh", "-c", `echo '{"a.json": {"a": 1}, "b": []}'`},
+			output:  "multi",
+			want:    map[string]string{"a.json": "{\n   \"a\": 1\n}\n", "b": "[]\n"},
+		},
+		{name: "not a file", command: []string{"echo", "missing.json"}, wantErr: "output " + filepath.Join(dir, "missing.json") + " of " + src.File + " is not a file"},
+		{name: "invalid stdout", command: []string{"echo", "{"}, output: "stdout", wantErr: "invalid JSON output"},
+		{name: "invalid multi", command: []string{"echo", "[]"}, output: "multi", wantErr: "invalid multi-file output"},
+		{name: "multi path", command: []string{"echo", `{"../a.json": {}}`}, output: "multi", wantErr: `invalid output file name "../a.json"`},
+		{name: "failure", command: []string{"sh", "-c", "echo broken >&2; exit 1"}, wantErr: "exit status 1: broken"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.RemoveAll(filepath.Join(dir, "out"))
+			r := ExecRenderer{Config: c, DataDir: datadir, Ext: ".cue", Command: tt.command, Output: tt.output, OutDir: "out"}
+			files, err := r.Render(context.Background(), src)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range files {
+				if filepath.Dir(f) != filepath.Join(dir, "out") {
+					t.Errorf("%s not written to the output directory", f)
+				}
+			}
+			got := readFiles(t, files)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			for name, content := range got {
+				if !json.Valid([]byte(content)) {
+					t.Errorf("%s is not valid JSON", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package murmur
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// RepoPolicyFile is the file, committed at the root of a repo, that declares
+// what murmur may write to the repo
+const RepoPolicyFile = ".murmur-policy"
+
+// RepoPolicy restricts the branches and paths murmur may write to a repo, and
+// the sources that may write each path. A repo without a policy file is not
+// restricted.
+//
+//	{
+//	  "branches": ["main", "release/*"],  // branches murmur may write, [] for all
+//	  "paths": [                          // path prefixes murmur may write, [] for all
+//	    {"prefix": "deploy/web", "sources": ["ops/web"]},  // sources that may
+//	    {"prefix": "deploy", "sources": ["ops"]}           // write it: team,
+//	  ]                                                    // team/app, ... [] for all
+//	}
+type RepoPolicy struct {
+	Branches []string         `json:"branches"`
+	Paths    []RepoPolicyPath `json:"paths"`
+}
+
+// RepoPolicyPath is a path prefix murmur may write, and the sources that may
+// write it
+type RepoPolicyPath struct {
+	Prefix  string   `json:"prefix"`
+	Sources []string `json:"sources"`
+}
+
+// ReadRepoPolicy reads the policy file committed at HEAD of a clone. nil is
+// returned if the repo has no policy file.
+func ReadRepoPolicy(cloneDir string) (*RepoPolicy, error) {
+	// the committed policy is read, not the one in the worktree
+	if _, err := GitOutput(cloneDir, "cat-file", "-e", "HEAD:"+RepoPolicyFile); err != nil {
+		return nil, nil
+	}
+	content, err := GitOutput(cloneDir, "show", "HEAD:"+RepoPolicyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var p RepoPolicy
+	if err = json.Unmarshal([]byte(content), &p); err != nil {
+		return nil, fmt.Errorf("invalid %s, %w", RepoPolicyFile, err)
+	}
+	for _, b := range p.Branches {
+		if _, err = path.Match(b, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s: branch %q, %w", RepoPolicyFile, b, err)
+		}
+	}
+	for _, rule := range p.Paths {
+		if rule.Prefix == "" {
+			return nil, fmt.Errorf("invalid %s: a path has no prefix", RepoPolicyFile)
+		}
+		for _, s := range rule.Sources {
+			if _, err = path.Match(s, ""); err != nil {
+				return nil, fmt.Errorf("invalid %s: source %q, %w", RepoPolicyFile, s, err)
+			}
+		}
+	}
+	return &p, nil
+}
+
+// Check returns an error if the policy does not allow the sources to write
+// the target path of a branch. The path must be under a prefix of the policy,
+// and the most specific prefix it is under decides which sources may write it.
+func (p *RepoPolicy) Check(branch, targetPath string, sources []string) error {
+	if len(p.Branches) > 0 && !matchAny(p.Branches, branch) {
+		return fmt.Errorf("branch %s is not allowed by %s (branches: %s)", branch, RepoPolicyFile, strings.Join(p.Branches, ", "))
+	}
+	if len(p.Paths) == 0 {
+		return nil
+	}
+
+	clean := path.Clean(filepath.ToSlash(targetPath))
+	if clean == ".." || strings.HasPrefix(clean, "../") || path.IsAbs(clean) {
+		return fmt.Errorf("path %s is outside of the repo", targetPath)
+	}
+
+	var rule *RepoPolicyPath
+	longest := -1
+	for i, r := range p.Paths {
+		prefix := path.Clean(strings.TrimPrefix(r.Prefix, "/"))
+		if prefix != "." && clean != prefix && !strings.HasPrefix(clean, prefix+"/") {
+			continue
+		}
+		if len(prefix) > longest {
+			rule, longest = &p.Paths[i], len(prefix)
+		}
+	}
+	if rule == nil {
+		var prefixes []string
+		for _, r := range p.Paths {
+			prefixes = append(prefixes, r.Prefix)
+		}
+		return fmt.Errorf("path %s is not allowed by %s (paths: %s)", targetPath, RepoPolicyFile, strings.Join(prefixes, ", "))
+	}
+
+	if len(rule.Sources) == 0 {
+		return nil
+	}
+	for _, source := range sources {
+		for _, pattern := range rule.Sources {
+			if matchSourcePrefix(pattern, source) {
+				return nil
+			}
+		}
+	}
+	if len(sources) == 0 {
+		sources = []string{"an unknown source"}
+	}
+	return fmt.Errorf("%s may not write %s: %s allows only %s to write %s", strings.Join(sources, ", "), targetPath, RepoPolicyFile, strings.Join(rule.Sources, ", "), rule.Prefix)
+}
+
+// matchAny reports whether s matches any of the globs
+func matchAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSourcePrefix reports whether the leading hierarchy values of a source
+// match a pattern: "ops" and "ops/web" match the source ops/web/prod
+func matchSourcePrefix(pattern, source string) bool {
+	pe, se := strings.Split(strings.Trim(pattern, "/"), "/"), strings.Split(source, "/")
+	if len(pe) > len(se) {
+		return false
+	}
+	for i := range pe {
+		if ok, _ := path.Match(pe[i], se[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckRepoPolicies checks the targets against the policy file of their
+// clones. Each target the policy of its repo does not allow (or whose repo
+// has an invalid policy) is logged and returned as a policy Failure, joined.
+func (w *GitWriter) CheckRepoPolicies(targets []Target) error {
+	log := logger(w.Logger)
+
+	var errs []error
+	for _, group := range RepoGroups(targets) {
+		target := group[0]
+		policy, err := ReadRepoPolicy(w.cloneDir(target))
+		if err != nil {
+			log.Error("unable to read repo policy", "repo", target.Repo, "branch", target.Branch, "error", err)
+			errs = append(errs, Fail(PhasePolicy, target.Repo+":"+target.Branch, err))
+			continue
+		}
+		if policy == nil {
+			continue
+		}
+
+		for _, t := range group {
+			sources := w.Config.TargetSources(w.DataDir, []Target{t})
+			if err = policy.Check(t.Branch, t.Path, sources); err != nil {
+				log.Error("repo policy violation", "repo", t.Repo, "branch", t.Branch, "path", t.Path, "msg", err)
+				errs = append(errs, Fail(PhasePolicy, t.Repo+":"+t.Branch+"/"+t.Path, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,116 @@
+package murmur
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRepoPolicyCheck(t *testing.T) {
+	policy := &RepoPolicy{
+		Branches: []string{"main", "release/*"},
+		Paths: []RepoPolicyPath{
+			{Prefix: "deploy/web", Sources: []string{"ops/web"}},
+			{Prefix: "/deploy", Sources: []string{"ops"}},
+			{Prefix: "shared"},
+			{Prefix: "team", Sources: []string{"*/api/prod"}},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		policy  *RepoPolicy
+		branch  string
+		path    string
+		sources []string
+		err     string // a substring of the error, "" for none
+	}{
+		{name: "no restrictions", policy: &RepoPolicy{}, branch: "dev", path: "../x"},
+		{name: "branch", branch: "main", path: "shared"},
+		{name: "branch glob", branch: "release/1.2", path: "shared"},
+		{name: "branch not allowed", branch: "dev", path: "shared", err: "branch dev is not allowed by .murmur-policy (branches: main, release/*)"},
+		{name: "branch glob does not cross /", branch: "release/1/2", path: "shared", err: "branch release/1/2 is not allowed"},
+		{name: "any branch", policy: &RepoPolicy{Paths: policy.Paths}, branch: "dev", path: "shared"},
+		{name: "path not allowed", branch: "main", path: "other", err: "path other is not allowed by .murmur-policy (paths: deploy/web, /deploy, shared, team)"},
+		{name: "prefix is a directory", branch: "main", path: "deployment", err: "path deployment is not allowed"},
+		{name: "path outside the repo", branch: "main", path: "deploy/../../x", err: "path deploy/../../x is outside of the repo"},
+		{name: "path is cleaned", branch: "main", path: "./shared/../shared/x"},
+		{name: "any source", branch: "main", path: "shared/x"},
+		{name: "source", branch: "main", path: "deploy/db", sources: []string{"ops/db/prod"}},
+		{name: "source not allowed", branch: "main", path: "deploy/db", sources: []string{"dev/db/prod"}, err: "dev/db/prod may not write deploy/db: .murmur-policy allows only ops to write /deploy"},
+		{name: "most specific prefix", branch: "main", path: "deploy/web/x", sources: []string{"ops/web/prod"}},
+		{name: "most specific prefix decides", branch: "main", path: "deploy/web", sources: []string{"ops/db/prod"}, err: "ops/db/prod may not write deploy/web: .murmur-policy allows only ops/web to write deploy/web"},
+		{name: "one of the sources", branch: "main", path: "deploy/web", sources: []string{"ops/db/prod", "ops/web/dev"}},
+		{name: "source glob", branch: "main", path: "team", sources: []string{"core/api/prod"}},
+		{name: "source glob not matched", branch: "main", path: "team", sources: []string{"core/api/dev"}, err: "may not write team"},
+		{name: "source shorter than the pattern", branch: "main", path: "deploy/web", sources: []string{"ops"}, err: "ops may not write"},
+		{name: "unknown source", branch: "main", path: "deploy", err: "an unknown source may not write deploy"},
+		{name: "root prefix", policy: &RepoPolicy{Paths: []RepoPolicyPath{{Prefix: "/", Sources: []string{"ops"}}}}, branch: "dev", path: "x", sources: []string{"ops/web/prod"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.policy
+			if p == nil {
+				p = policy
+			}
+			err := p.Check(tt.branch, tt.path, tt.sources)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadRepoPolicy(t *testing.T) {
+	dir := t.TempDir()
+	git := func(args ...string) {
+		t.Helper()
+		if _, err := GitOutput(dir, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit := func(policy string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, RepoPolicyFile), []byte(policy), 0644); err != nil {
+			t.Fatal(err)
+		}
+		git("add", RepoPolicyFile)
+		git("-c", "user.name=t", "-c", "user.email=t@example.com", "commit", "--quiet", "--allow-empty", "-m", "policy")
+	}
+	git("init", "--quiet")
+	git("-c", "user.name=t", "-c", "user.email=t@example.com", "commit", "--quiet", "--allow-empty", "-m", "init")
+
+	// a repo without a policy is not restricted
+	if p, err := ReadRepoPolicy(dir); p != nil || err != nil {
+		t.Fatalf("policy %v, error %v", p, err)
+	}
+
+	commit(`{"branches": ["main"], "paths": [{"prefix": "deploy", "sources": ["ops"]}]}`)
+	// the committed policy is read, not the one in the worktree
+	if err := os.WriteFile(filepath.Join(dir, RepoPolicyFile), []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := ReadRepoPolicy(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Branches) != 1 || len(p.Paths) != 1 || p.Paths[0].Sources[0] != "ops" {
+		t.Errorf("policy %+v", p)
+	}
+
+	for policy, want := range map[string]string{
+		`{"branches": [`:                                 "invalid .murmur-policy,",
+		`{"branches": ["["]}`:                            `invalid .murmur-policy: branch "["`,
+		`{"paths": [{"sources": ["ops"]}]}`:              "invalid .murmur-policy: a path has no prefix",
+		`{"paths": [{"prefix": "x", "sources": ["["]}]}`: `invalid .murmur-policy: source "["`,
+	} {
+		commit(policy)
+		if _, err = ReadRepoPolicy(dir); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error %v, want %q", policy, err, want)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package murmur
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/santhosh-tekuri/jsonschema/v6/kind"
+)
+
+// SchemaRegistry maps output types (i.e. stacks, integrations) to compiled
+// JSON Schema documents
+type SchemaRegistry struct {
+	schemas map[string]*jsonschema.Schema
+}
+
+// Violation is a single validation failure of a rendered file. Path is a JSON
+// pointer to the failing value ("" is the whole document).
+type Violation struct {
+	File    string `json:"file"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// NewSchemaRegistry compiles the schema files for each type
+func NewSchemaRegistry(schemas map[string]string) (*SchemaRegistry, error) {
+	r := &SchemaRegistry{schemas: make(map[string]*jsonschema.Schema)}
+
+	c := jsonschema.NewCompiler()
+	for t, file := range schemas {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+		s, err := c.Compile(abs)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compile schema for type %s, %w", t, err)
+		}
+		r.schemas[t] = s
+	}
+	return r, nil
+}
+
+// Has reports whether a schema is registered for a type
+func (r *SchemaRegistry) Has(t string) bool {
+	_, ok := r.schemas[t]
+	return ok
+}
+
+// Validate validates a rendered file against the schema for its type. Files
+// of types without a schema are not validated.
+func (r *SchemaRegistry) Validate(t, file string) ([]Violation, error) {
+	s, ok := r.schemas[t]
+	if !ok {
+		return nil, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	doc, err := jsonschema.UnmarshalJSON(f)
+	if err != nil {
+		return []Violation{{File: file, Message: fmt.Sprintf("invalid JSON: %s", err)}}, nil
+	}
+
+	err = s.Validate(doc)
+	if err == nil {
+		return nil, nil
+	}
+	ve, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return nil, err
+	}
+
+	var violations []Violation
+	for _, e := range ve.BasicOutput().Errors {
+		if e.Error == nil {
+			continue
+		}
+		// a group only says that the value has the failures that follow
+		if _, ok := e.Error.Kind.(*kind.Group); ok {
+			continue
+		}
+		violations = append(violations, Violation{
+			File:    file,
+			Path:    e.InstanceLocation,
+			Message: e.Error.String(),
+		})
+	}
+	// report the most specific (deepest) failures first
+	slices.SortStableFunc(violations, func(a, b Violation) int {
+		return strings.Count(b.Path, "/") - strings.Count(a.Path, "/")
+	})
+	return violations, nil
+}
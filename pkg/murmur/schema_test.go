@@ -0,0 +1,128 @@
+package murmur
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const stacksSchema = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "type": "object",
+  "required": ["stacks"],
+  "properties": {
+    "stacks": {
+      "type": "array",
+      "items": {
+        "type": "object",
+        "required": ["name"],
+        "properties": {
+          "name": {"type": "string"},
+          "replicas": {"type": "integer", "minimum": 1}
+        }
+      }
+    }
+  }
+}`
+
+func TestSchemaRegistryValidate(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		t.Helper()
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	r, err := NewSchemaRegistry(map[string]string{"stacks": write("stacks.schema.json", stacksSchema)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Has("stacks") || r.Has("dbs") {
+		t.Error("Has")
+	}
+
+	tests := []struct {
+		name  string
+		typ   string
+		doc   string
+		paths []string // of the violations, in order
+		msg   string   // in the message of the first violation
+	}{
+		{name: "valid", typ: "stacks", doc: `{"stacks": [{"name": "web", "replicas": 2}]}`},
+		{name: "no schema", typ: "dbs", doc: `{"anything": true}`},
+		{name: "no schema, invalid JSON", typ: "dbs", doc: `{`},
+		{name: "missing property", typ: "stacks", doc: `{}`, paths: []string{""}, msg: "stacks"},
+		{name: "wrong type", typ: "stacks", doc: `{"stacks": [{"name": "web"}, {"name": 1}]}`, paths: []string{"/stacks/1/name"}, msg: "string"},
+		{
+			name:  "deepest first",
+			typ:   "stacks",
+			doc:   `{"stacks": [{"replicas": 0}, {"name": "db", "replicas": "2"}]}`,
+			paths: []string{"/stacks/0/replicas", "/stacks/1/replicas", "/stacks/0"},
+			msg:   "minimum",
+		},
+		{
+			name:  "not an array",
+			typ:   "stacks",
+			doc:   `{"stacks": "web"}`,
+			paths: []string{"/stacks"},
+			msg:   "want array",
+		},
+		{name: "invalid JSON", typ: "stacks", doc: `{"stacks": [}`, paths: []string{""}, msg: "invalid JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := write("doc.json", tt.doc)
+			violations, err := r.Validate(tt.typ, file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var paths []string
+			for _, v := range violations {
+				paths = append(paths, v.Path)
+				if v.File != file {
+					t.Errorf("file %q, want %q", v.File, file)
+				}
+			}
+			if strings.Join(paths, ",") != strings.Join(tt.paths, ",") {
+				t.Fatalf("paths %q, want %q: %+v", paths, tt.paths, violations)
+			}
+			if tt.msg != "" && !strings.Contains(violations[0].Message, tt.msg) {
+				t.Errorf("message %q, want %q", violations[0].Message, tt.msg)
+			}
+		})
+	}
+
+	if _, err := r.Validate("stacks", filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("missing file: no error")
+	}
+}
+
+func TestNewSchemaRegistry(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		schema  string // "" for a missing file
+		wantErr string
+	}{
+		{name: "invalid JSON", schema: `{"type": `, wantErr: "unable to compile schema for type stacks"},
+		{name: "invalid schema", schema: `{"type": "objekt"}`, wantErr: "unable to compile schema for type stacks"},
+		{name: "missing file", wantErr: "unable to compile schema for type stacks"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", "-")+".json")
+			if tt.schema != "" {
+				if err := os.WriteFile(file, []byte(tt.schema), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := NewSchemaRegistry(map[string]string{"stacks": file})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
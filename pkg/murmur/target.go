@@ -1,17 +1,24 @@
 package murmur
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 )
 
 // Target is a struct that represents a target.json file
 // target = {
 //   _type:: 'target',
 //   name: ''   // repo name, i.e. ets-cloudops-infrastrcuture
-//   repo: '',  // full repo name, i.e. cfacorp/ets-cloudops-infrastructure
+//   repo: '',  // full repo name, i.e. cfacorp/ets-cloudops-infrastructure,
+//              // optionally prefixed by a host: git.example.com/team/repo
 //   path: '',  // top level destination to write outputs
 //   branch: 'master',  // git branch name
 //   types: [],  // types of outputs ("datasources", "connections", etc)
@@ -60,3 +67,245 @@ func (t Target) CloneDir() string {
 		return fmt.Sprintf("%s:%s", t.Name, t.Branch)
 	}
 }
+
+// Validate checks that the clone directory, path and types of a target, which
+// are joined to make the destination of its files, are relative paths that
+// stay inside the repo dir and the clone, and outside of its git directory
+func (t Target) Validate() error {
+	if t.Repo != "." && !filepath.IsLocal(t.CloneDir()) {
+		return fmt.Errorf("invalid name / branch %q: must be a relative path without '..'", t.CloneDir())
+	}
+	if t.Path != "" && !filepath.IsLocal(t.Path) {
+		return fmt.Errorf("invalid path %q: must be a relative path inside the repo", t.Path)
+	}
+	if hasGitDir(t.Path) {
+		return fmt.Errorf("invalid path %q: must not be inside the .git directory", t.Path)
+	}
+	for _, typ := range t.Types {
+		if typ == "" || typ == "." || typ == ".." || strings.ContainsAny(typ, `/\`) {
+			return fmt.Errorf("invalid type %q: must be a name, without '/' or '..'", typ)
+		}
+		if hasGitDir(typ) {
+			return fmt.Errorf("invalid type %q: must not be .git", typ)
+		}
+	}
+	return nil
+}
+
+// hasGitDir reports whether an element of a path is .git. Case is ignored:
+// the file systems of macOS and Windows are case-insensitive.
+func hasGitDir(p string) bool {
+	for _, elem := range strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if strings.EqualFold(elem, ".git") {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultGitHost is the host of repos that do not name one
+const DefaultGitHost = "github.com"
+
+// Host returns the git host of the repo: the first element of a repo with
+// three or more elements (i.e. git.example.com/org/name), or DefaultGitHost
+func (t Target) Host() string {
+	if host, _, ok := t.splitHost(); ok {
+		return host
+	}
+	return DefaultGitHost
+}
+
+// RepoPath returns the repo without its host, i.e. org/name
+func (t Target) RepoPath() string {
+	if _, path, ok := t.splitHost(); ok {
+		return path
+	}
+	return t.Repo
+}
+
+func (t Target) splitHost() (string, string, bool) {
+	host, path, ok := strings.Cut(t.Repo, "/")
+	if !ok || strings.Count(path, "/") == 0 || !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return "", "", false
+	}
+	return host, path, true
+}
+
+// TypeFiles returns the rendered files of a type for a target. Files are
+// named <prefix>-<type>.json and located in the same directory as the target
+// file.
+func (t Target) TypeFiles(typ string) ([]string, error) {
+	glob := filepath.Join(t.Dir, fmt.Sprintf("%s-%s.json", t.Prefix, typ))
+	files, err := filepath.Glob(glob)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read files, %w", err)
+	}
+	return files, nil
+}
+
+// DestFilename returns the name of a rendered file in the target repository.
+// The dest filename is the same as the source filename, minus the <app>. For
+// instance, for the app "pyrenees", filename ==
+// "ets-cloudops-infrastructure-pyrenees-datasources.json" and dest_filename ==
+// "ets-cloudops-infrastructure-datasources.json"
+func (t Target) DestFilename(file string) string {
+	filename := filepath.Base(file)
+	// remove -app- from the dest_filename
+	return strings.Replace(filename, fmt.Sprintf("-%s-", t.App), "-", 1)
+}
+
+// TargetLoader loads the targets to write to
+type TargetLoader interface {
+	LoadTargets(ctx context.Context) ([]Target, error)
+}
+
+// FileTargetLoader loads targets from target files: Files, or the files named
+// *targets.json found in Dir. Branch overrides (repo_name:branch) replace the
+// branch of every target of the named repo.
+type FileTargetLoader struct {
+	Files           []string
+	Dir             string
+	BranchOverrides []string
+	Logger          *slog.Logger
+}
+
+func (l FileTargetLoader) LoadTargets(ctx context.Context) ([]Target, error) {
+	log := logger(l.Logger)
+
+	files := l.Files
+	if len(files) == 0 && l.Dir != "" {
+		var err error
+		files, err = FindFiles(l.Dir, "targets.json")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var targets []Target
+	var errs []error
+	for _, file := range files {
+		t, err := NewTargetsFromFile(file)
+		if err != nil {
+			log.Error("unable to read target file", "file", file, "error", err)
+			errs = append(errs, Fail(PhaseConfig, file, err))
+			continue
+		}
+		targets = append(targets, t...)
+	}
+
+	ApplyBranchOverrides(log, targets, l.BranchOverrides)
+
+	// targets whose files would be written outside of their clone are
+	// rejected before anything is cloned
+	valid := targets[:0]
+	for _, t := range targets {
+		if err := t.Validate(); err != nil {
+			file := filepath.Join(t.Dir, t.Filename)
+			log.Error("invalid target", "file", file, "repo", t.Repo, "error", err)
+			errs = append(errs, Fail(PhaseValidation, file, fmt.Errorf("target %s: %w", t.Repo, err)))
+			continue
+		}
+		valid = append(valid, t)
+	}
+	return valid, errors.Join(errs...)
+}
+
+// ApplyBranchOverrides applies branch overrides (in format repo_name:branch)
+// to all targets where the repo name matches
+func ApplyBranchOverrides(log *slog.Logger, targets []Target, overrides []string) {
+	for _, override := range overrides {
+		repoName, branch, ok := strings.Cut(override, ":")
+		if !ok {
+			log.Warn("invalid branch override format", "override", override, "format", "repo_name:branch")
+			continue
+		}
+
+		log.Debug("branch override", "repoName", repoName, "branch", branch)
+
+		for i := range targets {
+			if targets[i].Name == repoName {
+				log.Info("overriding branch for repo", "repo", targets[i].Name, "original_branch", targets[i].Branch, "new_branch", branch)
+				targets[i].Branch = branch
+			}
+		}
+	}
+}
+
+// FindFiles searches recursively for files in a directory that have any of
+// the suffixes
+func FindFiles(dir string, suffixes ...string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if slices.ContainsFunc(suffixes, func(s string) bool { return strings.HasSuffix(d.Name(), s) }) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to search for files: %w", err)
+	}
+	return files, nil
+}
+
+// RepoGroups groups targets by repository and branch, in the order they are
+// first seen. Targets with Repo == "." are skipped.
+func RepoGroups(targets []Target) [][]Target {
+	var groups [][]Target
+	index := make(map[string]int)
+	for _, target := range targets {
+		if target.Repo == "." {
+			continue
+		}
+		key := target.Name + ":" + target.Branch
+		if i, ok := index[key]; ok {
+			groups[i] = append(groups[i], target)
+			continue
+		}
+		index[key] = len(groups)
+		groups = append(groups, []Target{target})
+	}
+	return groups
+}
+
+// TargetPaths returns the unique destination paths of targets
+func TargetPaths(targets []Target) []string {
+	var paths []string
+	for _, t := range targets {
+		p := filepath.Clean(t.Path)
+		if !slices.Contains(paths, p) {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// ManagedFiles returns the files, relative to the clone directory, that murmur
+// writes for the targets of a single repository, with their manifests
+func ManagedFiles(targets []Target) ([]string, error) {
+	var managed []string
+	for _, target := range targets {
+		manifest := filepath.Join(target.Path, ManifestFilename)
+		if !slices.Contains(managed, manifest) {
+			managed = append(managed, manifest)
+		}
+		for _, t := range target.Types {
+			files, err := target.TypeFiles(t)
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range files {
+				rel := filepath.Join(target.Path, t, target.DestFilename(file))
+				if !slices.Contains(managed, rel) {
+					managed = append(managed, rel)
+				}
+			}
+		}
+	}
+	return managed, nil
+}
@@ -0,0 +1,45 @@
+package murmur
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTargetValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		target Target
+		err    string // a substring of the error, "" for none
+	}{
+		{name: "valid", target: Target{Name: "x", Branch: "main", Path: "deploy/prod", Types: []string{"stacks"}}},
+		{name: "no path", target: Target{Name: "x", Branch: "main", Types: []string{"stacks"}}},
+		{name: "datadir", target: Target{Repo: ".", Path: "out"}},
+		{name: "absolute name", target: Target{Name: "/x", Branch: "main"}, err: "invalid name / branch"},
+		{name: "branch outside the repo dir", target: Target{Name: "x", Branch: "../../../y"}, err: "invalid name / branch"},
+		{name: "absolute path", target: Target{Name: "x", Branch: "main", Path: "/etc"}, err: `invalid path "/etc"`},
+		{name: "path outside the clone", target: Target{Name: "x", Branch: "main", Path: "deploy/../.."}, err: "must be a relative path inside the repo"},
+		{name: "git dir", target: Target{Name: "x", Branch: "main", Path: ".git"}, err: `invalid path ".git": must not be inside the .git directory`},
+		{name: "inside the git dir", target: Target{Name: "x", Branch: "main", Path: ".git/hooks"}, err: "must not be inside the .git directory"},
+		{name: "inside the git dir, cleaned", target: Target{Name: "x", Branch: "main", Path: "deploy/../.git/hooks"}, err: "must not be inside the .git directory"},
+		{name: "git dir of a submodule", target: Target{Name: "x", Branch: "main", Path: "deploy/.git"}, err: "must not be inside the .git directory"},
+		{name: "git dir in another case", target: Target{Name: "x", Branch: "main", Path: ".GIT/hooks"}, err: "must not be inside the .git directory"},
+		{name: "git dir with backslashes", target: Target{Name: "x", Branch: "main", Path: `deploy\.git\hooks`}, err: "must not be inside the .git directory"},
+		{name: "name like the git dir", target: Target{Name: "x", Branch: "main", Path: ".github/workflows", Types: []string{".gitignored"}}},
+		{name: "empty type", target: Target{Name: "x", Branch: "main", Types: []string{""}}, err: `invalid type ""`},
+		{name: "type outside the path", target: Target{Name: "x", Branch: "main", Types: []string{".."}}, err: `invalid type ".."`},
+		{name: "type with a separator", target: Target{Name: "x", Branch: "main", Types: []string{"a/b"}}, err: `invalid type "a/b"`},
+		{name: "git dir type", target: Target{Name: "x", Branch: "main", Types: []string{"stacks", ".git"}}, err: `invalid type ".git": must not be .git`},
+		{name: "git dir type in another case", target: Target{Name: "x", Branch: "main", Types: []string{".Git"}}, err: "must not be .git"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.target.Validate()
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
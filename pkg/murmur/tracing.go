@@ -0,0 +1,208 @@
+package murmur
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tracer records the events of a run as OpenTelemetry spans, and exports them
+// to a collector with OTLP over HTTP (JSON encoding). The run is the root span
+// of the trace. Each event is a span under it: the write of a target under the
+// write of all targets, and the commit and push of a repo under its publish.
+type Tracer struct {
+	Endpoint    string            // i.e. http://localhost:4318, /v1/traces is added unless it has a path
+	Headers     map[string]string // i.e. for authentication to the collector
+	ServiceName string            // [default: murmur]
+	Client      *http.Client
+
+	mu     sync.Mutex
+	events []Event
+}
+
+// Observe records an event, i.e. as the Observer of a Pipeline
+func (t *Tracer) Observe(e Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(t.events, e)
+}
+
+// Export sends the spans of a run to the collector. The run, named after the
+// command, started at start and failed if runErr is set.
+func (t *Tracer) Export(ctx context.Context, name string, start time.Time, runErr error) error {
+	body, err := json.Marshal(t.traces(name, start, time.Now(), runErr))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.Headers {
+		req.Header.Set(k, v)
+	}
+
+	client := t.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to export spans, %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unable to export spans: %s %s", req.URL, resp.Status)
+	}
+	return nil
+}
+
+// url returns the traces URL of the endpoint
+func (t *Tracer) url() string {
+	endpoint := strings.TrimRight(t.Endpoint, "/")
+	if i := strings.Index(endpoint, "://"); i >= 0 && strings.Contains(endpoint[i+3:], "/") {
+		return endpoint
+	}
+	return endpoint + "/v1/traces"
+}
+
+// otlpSpan is a span of an OTLP/JSON trace export request
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes,omitempty"`
+	Status       *otlpStatus     `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 is an error
+	Message string `json:"message,omitempty"`
+}
+
+// traces returns the OTLP/JSON export request of the spans of a run
+func (t *Tracer) traces(name string, start, end time.Time, err error) map[string]any {
+	t.mu.Lock()
+	events := append([]Event(nil), t.events...)
+	t.mu.Unlock()
+
+	traceID := randomID(16)
+	root := otlpSpan{
+		TraceID: traceID,
+		SpanID:  randomID(8),
+		Name:    name,
+		Kind:    1, // internal
+		Start:   unixNano(start),
+		End:     unixNano(end),
+		Status:  spanStatus(err),
+	}
+
+	spans := make([]otlpSpan, len(events))
+	for i, e := range events {
+		spans[i] = otlpSpan{
+			TraceID:      traceID,
+			SpanID:       randomID(8),
+			ParentSpanID: root.SpanID,
+			Name:         string(e.Kind),
+			Kind:         1,
+			Start:        unixNano(e.Start),
+			End:          unixNano(e.Start.Add(e.Duration)),
+			Attributes:   eventAttributes(e),
+			Status:       spanStatus(e.Err),
+		}
+	}
+
+	// the steps of a write or publish are under it: the parent is the event
+	// of the same repo (any repo, for a write) that contains the step
+	parentKind := map[EventKind]EventKind{EventTarget: EventWrite, EventCommit: EventPublish, EventPush: EventPublish}
+	for i, e := range events {
+		kind, ok := parentKind[e.Kind]
+		if !ok {
+			continue
+		}
+		for j, p := range events {
+			if p.Kind != kind || (kind == EventPublish && (p.Repo != e.Repo || p.Branch != e.Branch)) {
+				continue
+			}
+			if !e.Start.Before(p.Start) && !e.Start.Add(e.Duration).After(p.Start.Add(p.Duration)) {
+				spans[i].ParentSpanID = spans[j].SpanID
+				break
+			}
+		}
+	}
+
+	serviceName := t.ServiceName
+	if serviceName == "" {
+		serviceName = "murmur"
+	}
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttribute{stringAttribute("service.name", serviceName)},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "github.com/jswank/murmur"},
+				"spans": append([]otlpSpan{root}, spans...),
+			}},
+		}},
+	}
+}
+
+// eventAttributes returns the span attributes of an event
+func eventAttributes(e Event) []otlpAttribute {
+	var attrs []otlpAttribute
+	for _, a := range [][2]string{{"murmur.file", e.File}, {"murmur.repo", e.Repo}, {"murmur.branch", e.Branch}, {"murmur.path", e.Path}, {"murmur.commit", e.Commit}} {
+		if a[1] != "" {
+			attrs = append(attrs, stringAttribute(a[0], a[1]))
+		}
+	}
+	attrs = append(attrs, otlpAttribute{Key: "murmur.files", Value: map[string]any{"intValue": strconv.Itoa(len(e.Files))}})
+	if e.Kind == EventPublish {
+		attrs = append(attrs, otlpAttribute{Key: "murmur.changed", Value: map[string]any{"boolValue": e.Changed}})
+	}
+	return attrs
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: map[string]any{"stringValue": value}}
+}
+
+// spanStatus returns the error status of a span, nil if err is nil
+func spanStatus(err error) *otlpStatus {
+	if err == nil {
+		return nil
+	}
+	return &otlpStatus{Code: 2, Message: Scrub(err.Error())}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// randomID returns n random bytes, hex encoded, as trace and span IDs are
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
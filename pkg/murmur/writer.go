@@ -0,0 +1,643 @@
+package murmur
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Writer writes rendered files to the destinations of targets
+type Writer interface {
+	// Prepare makes the destination of the targets of a single repo / branch
+	// ready to be written, i.e. clones it
+	Prepare(ctx context.Context, targets []Target) error
+
+	// Write writes the rendered files of targets and returns the files written
+	Write(ctx context.Context, targets []Target) ([]string, error)
+}
+
+// GitWriter clones the repos of targets into RepoDir and writes rendered files
+// to the clones. Before anything is written, the rendered files are validated
+// against the schemas and checked against the policies of the configuration.
+// Targets with Repo == "." are written relative to the current directory.
+type GitWriter struct {
+	Config    *Config
+	RepoDir   string
+	DataDir   string // the directory of the rendered files, for their origin
+	Overwrite bool   // replace existing clones with fresh clones
+	Sparse    bool   // partial clones that check out only the target paths
+	Retry     RetryOptions
+	Auth      *GitAuth
+	Observer  Observer // called as each target is written
+	Logger    *slog.Logger
+
+	// SourceDir is the datadir of the sources, for the commit recorded in
+	// the manifests [default: DataDir]
+	SourceDir string
+	// RefuseDrift fails the targets that would overwrite files changed since
+	// murmur wrote them
+	RefuseDrift bool
+
+	commitOnce sync.Once
+	commit     string
+	dirty      bool
+}
+
+// Prepare clones the repo of a repo / branch group of targets. An existing
+// clone is an error unless Overwrite is set.
+func (w *GitWriter) Prepare(ctx context.Context, targets []Target) error {
+	target := targets[0]
+	return Fail(PhaseGit, target.Repo+":"+target.Branch, w.prepare(ctx, targets))
+}
+
+func (w *GitWriter) prepare(ctx context.Context, targets []Target) error {
+	log := logger(w.Logger)
+	target := targets[0]
+	cloneDir := filepath.Join(w.RepoDir, target.CloneDir())
+
+	if w.RepoDir != "" {
+		if err := os.MkdirAll(w.RepoDir, 0755); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(cloneDir); err == nil {
+		log.Warn("repository directory already exists", "repo", target.Name, "branch", target.Branch, "dir", cloneDir)
+		if !w.Overwrite {
+			return fmt.Errorf("repository will not be overwritten: specify --overwrite to overwrite existing repos")
+		}
+		log.Debug("removing existing repository directory", "repo", target.Name, "branch", target.Branch, "dir", cloneDir)
+		if err = os.RemoveAll(cloneDir); err != nil {
+			return fmt.Errorf("unable to remove existing repo, %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// sparse clones check out only the paths murmur writes to
+	var paths []string
+	if w.Sparse {
+		paths = TargetPaths(targets)
+	}
+	return w.clone(ctx, target, paths)
+}
+
+// clone a single repository from a target. If paths are given, a blobless
+// partial clone is made and only the paths are checked out.
+func (w *GitWriter) clone(ctx context.Context, target Target, paths []string) error {
+	log := logger(w.Logger)
+
+	url := w.Config.RemoteURL(target)
+	log.Debug("remote url", "url", url)
+
+	if w.Auth != nil {
+		if err := w.Auth.Configure([]Target{target}); err != nil {
+			return err
+		}
+	}
+
+	// a target path of the repo root needs the full tree
+	if slices.Contains(paths, ".") {
+		log.Info("target path is the repo root: cloning the full tree", "repo", target.Repo, "branch", target.Branch)
+		paths = nil
+	}
+
+	args := []string{"clone", "--depth", "1", "--branch", target.Branch}
+	if len(paths) > 0 {
+		args = append(args, "--filter=blob:none", "--sparse")
+	}
+
+	repoDir := w.RepoDir
+	if repoDir == "" {
+		repoDir = "."
+	}
+
+	log.Info("cloning repository", "repo", target.Repo, "branch", target.Branch, "dir", filepath.Join(w.RepoDir, target.CloneDir()), "sparse", len(paths) > 0)
+	err := withRetry(ctx, log, w.Retry, "clone "+target.Repo, func() error {
+		return runGit(w.Auth.Command(gitCmd(ctx, repoDir, append(args, url, target.CloneDir())...)))
+	})
+	if err != nil {
+		return fmt.Errorf("unable to clone repository %s, %w", target.Repo, err)
+	}
+
+	if len(paths) == 0 {
+		return nil
+	}
+
+	// check out only the target paths. The missing blobs are fetched here.
+	cloneDir := filepath.Join(w.RepoDir, target.CloneDir())
+	log.Info("setting sparse checkout", "repo", target.Repo, "branch", target.Branch, "dir", cloneDir, "paths", paths)
+	err = withRetry(ctx, log, w.Retry, "sparse-checkout "+target.Repo, func() error {
+		return runGit(w.Auth.Command(gitCmd(ctx, cloneDir, append([]string{"sparse-checkout", "set", "--"}, paths...)...)))
+	})
+	if err != nil {
+		return fmt.Errorf("unable to set sparse checkout of %s, %w", target.Repo, err)
+	}
+
+	return nil
+}
+
+// Write validates and checks every rendered file of the targets and its
+// destination, and checks the targets against the policy file of their repo,
+// then writes them to the target repositories. If any file is invalid or denied, or any target is not
+// allowed by its repo, nothing is written and the failures of the checks are
+// returned, joined.
+func (w *GitWriter) Write(ctx context.Context, targets []Target) ([]string, error) {
+	checks := []error{w.Validate(targets), w.CheckDestinations(targets), w.CheckPolicies(targets), w.CheckRepoPolicies(targets)}
+	if w.RefuseDrift {
+		checks = append(checks, w.CheckDrift(targets))
+	}
+	if err := errors.Join(checks...); err != nil {
+		return nil, err
+	}
+	return w.WriteFiles(targets)
+}
+
+// WriteFiles writes the rendered files of targets to the target repositories,
+// without validation. The targets of a repo / branch are written all or
+// nothing: if one of them fails, the files already written to the repo are
+// rolled back, so that its clone is either fully updated or untouched. A repo
+// that fails does not stop the others: the failures are returned, joined.
+func (w *GitWriter) WriteFiles(targets []Target) ([]string, error) {
+	// the targets written relative to the current directory are a group of
+	// their own
+	groups := RepoGroups(targets)
+	var local []Target
+	for _, target := range targets {
+		if target.Repo == "." {
+			local = append(local, target)
+		}
+	}
+	if len(local) > 0 {
+		groups = append(groups, local)
+	}
+
+	var written []string
+	var errs []error
+	for _, group := range groups {
+		files, err := w.writeRepo(group)
+		written = append(written, files...)
+		errs = append(errs, err)
+	}
+	return written, errors.Join(errs...)
+}
+
+// writeRepo writes the targets of a repo / branch. If a target fails, the
+// others are still written so that all the failures are reported, then the
+// changes to the clone are rolled back. The events of the targets are sent
+// once the outcome of the repo is known.
+func (w *GitWriter) writeRepo(targets []Target) ([]string, error) {
+	log := logger(w.Logger)
+	repo := targets[0].Repo + ":" + targets[0].Branch
+
+	// the marker flags the clone as partially written until the writes are
+	// done or rolled back, i.e. if murmur is killed
+	marker := writeMarkerFile(w.cloneDir(targets[0]))
+	if marker != "" {
+		if err := os.WriteFile(marker, nil, 0644); err != nil {
+			return nil, Fail(PhaseWrite, repo, err)
+		}
+	}
+
+	type result struct {
+		files []string
+		err   error
+		start time.Time
+	}
+	tx := &writeTx{}
+	results := make([]result, len(targets))
+	failed := false
+	managed := make(map[string]map[string]managedFile)
+	writtenTargets := make(map[string]bool) // the target files written
+	for i, target := range targets {
+		start := time.Now()
+		files, err := w.writeTarget(tx, target, managed)
+		results[i] = result{files, err, start}
+		failed = failed || err != nil
+		writtenTargets[w.targetFile(target)] = true
+	}
+
+	// the manifest of each destination is rebuilt once all the targets
+	// written to it are
+	var errs []error
+	if !failed {
+		for destDir, files := range managed {
+			if err := w.updateManifest(tx, destDir, files, writtenTargets); err != nil {
+				log.Error("unable to write manifest", "dest_dir", destDir, "error", err)
+				errs = append(errs, Fail(PhaseWrite, repo, fmt.Errorf("unable to write manifest of %s, %w", destDir, err)))
+				failed = true
+			}
+		}
+	}
+
+	if failed {
+		log.Warn("rolling back the changes to the repo", "repo", targets[0].Repo, "branch", targets[0].Branch)
+		if err := tx.rollback(); err != nil {
+			// the marker is kept: the clone is partially written
+			log.Error("unable to roll back the changes to the repo", "repo", targets[0].Repo, "branch", targets[0].Branch, "error", err)
+			errs = append(errs, Fail(PhaseWrite, repo, fmt.Errorf("unable to roll back, %w", err)))
+			marker = ""
+		}
+	} else {
+		tx.close()
+	}
+	if marker != "" {
+		os.Remove(marker)
+	}
+
+	var written []string
+	for i, target := range targets {
+		r := results[i]
+		if failed && r.err == nil {
+			r.files, r.err = nil, fmt.Errorf("rolled back, another target of %s failed", repo)
+			w.emitTarget(target, r.files, r.err, r.start)
+			continue
+		}
+		w.emitTarget(target, r.files, r.err, r.start)
+		if !failed {
+			written = append(written, r.files...)
+		}
+		errs = append(errs, Fail(PhaseWrite, repo+"/"+target.Path, r.err))
+	}
+	return written, errors.Join(errs...)
+}
+
+// cloneDir returns the clone of the repo of a target. Targets with Repo ==
+// "." are in the current directory.
+func (w *GitWriter) cloneDir(target Target) string {
+	if target.Repo == "." {
+		return "."
+	}
+	return filepath.Join(w.RepoDir, target.CloneDir())
+}
+
+// emitTarget sends the event of the write of a target to the observer
+func (w *GitWriter) emitTarget(target Target, files []string, err error, start time.Time) {
+	if w.Observer == nil {
+		return
+	}
+	w.Observer.emit(Event{
+		Kind:    EventTarget,
+		Files:   files,
+		Repo:    target.Repo,
+		Branch:  target.Branch,
+		Path:    target.Path,
+		Dir:     w.cloneDir(target),
+		Sources: w.Config.TargetSources(w.DataDir, []Target{target}),
+		Err:     err,
+		Start:   start,
+	})
+}
+
+// writeTarget writes the rendered files of a target, and adds the files it
+// manages to those of its destination in managed
+func (w *GitWriter) writeTarget(tx *writeTx, target Target, managed map[string]map[string]managedFile) ([]string, error) {
+	log := logger(w.Logger)
+
+	log.Debug("processing target", "repo", target.Repo, "branch", target.Branch, "CloneDir", target.CloneDir())
+
+	var written []string
+	targetRepoDir := w.RepoDir
+	if target.Repo == "." {
+		log.Debug("overriding repo_dir with current working directory for Repo == '.'", "repo_dir", w.RepoDir)
+		targetRepoDir = "."
+	}
+
+	destDir := filepath.Join(targetRepoDir, target.CloneDir(), target.Path)
+	log.Debug("dest_dir for this target is set", "dest_dir", destDir)
+
+	// The toplevel directory (data directory) should already exist.  Return an error if it does not.
+	root := w.cloneDir(target)
+	if err := target.Validate(); err != nil {
+		return written, err
+	}
+	if err := insideDir(root, destDir); err != nil {
+		return written, err
+	}
+	if _, err := os.Stat(destDir); err != nil {
+		log.Error("destination directory does not exist", "dest_dir", destDir, "error", err)
+		return written, err
+	}
+	log.Info("destination directory exists", "dest_dir", destDir)
+
+	if err := checkDestination(root, filepath.Join(destDir, ManifestFilename)); err != nil {
+		return written, err
+	}
+	// the managed files of the destination, relative to it
+	destFiles := managed[destDir]
+	if destFiles == nil {
+		destFiles = make(map[string]managedFile)
+		managed[destDir] = destFiles
+	}
+	targetFile := w.targetFile(target)
+
+	for _, t := range target.Types {
+		// BUG: if there are multiple targets and app-type-specific files in the same
+		// directory, all the matching files will be copied to the target directory
+		log.Debug("processing target type", "type", t)
+		files, err := target.TypeFiles(t)
+		if err != nil {
+			return written, err
+		}
+
+		typeDestDir := filepath.Join(destDir, t)
+		if err = insideDir(root, typeDestDir); err != nil {
+			return written, err
+		}
+		err = tx.mkdirAll(typeDestDir)
+		if err != nil {
+			return written, fmt.Errorf("unable to create directory, %w", err)
+		}
+
+		log.Info("writing files to repository", "src", target.Dir, "dest", typeDestDir, "type", t)
+
+		for _, file := range files {
+			dest := filepath.Join(typeDestDir, target.DestFilename(file))
+			log.Debug("copying file", "file", file, "dest", dest)
+			if err = checkDestination(root, dest); err != nil {
+				return written, err
+			}
+			content, unchanged, err := w.output(t, file, dest)
+			if err != nil {
+				log.Error("unable to format file", "file", file, "error", err)
+				return written, err
+			}
+			destFiles[t+"/"+target.DestFilename(file)] = managedFile{src: file, target: targetFile}
+			if unchanged {
+				log.Debug("file is unchanged, not writing it", "file", file, "dest", dest)
+				continue
+			}
+			err = tx.writeFile(dest, content)
+			if err != nil {
+				log.Error("unable to copy file", "file", file, "dest", dest, "error", err)
+				return written, err
+			}
+			written = append(written, dest)
+		}
+	}
+
+	return written, nil
+}
+
+// output returns the content of a rendered file of a type to write to dest:
+// JSON files are re-serialized in the format of their type, if it has one.
+// unchanged is true if dest already has the content: byte for byte if it is
+// formatted, so that files not in the canonical style yet are rewritten in it,
+// and otherwise as parsed JSON for JSON files.
+func (w *GitWriter) output(t, file, dest string) (content []byte, unchanged bool, err error) {
+	content, err = os.ReadFile(file)
+	if err != nil {
+		return nil, false, err
+	}
+
+	formatted := false
+	if isJSON(file) {
+		if format, ok := w.Config.FormatFor(t); ok {
+			if content, err = format.Canonical(content); err != nil {
+				return nil, false, fmt.Errorf("%s: invalid JSON, %w", file, err)
+			}
+			formatted = true
+		}
+	}
+
+	existing, err := os.ReadFile(dest)
+	if err != nil {
+		// the file is new (or cannot be read, and is replaced)
+		return content, false, nil
+	}
+	if bytes.Equal(existing, content) {
+		return content, true, nil
+	}
+	return content, isJSON(file) && !formatted && SameJSON(existing, content), nil
+}
+
+// Validate validates the rendered files of each target against the JSON
+// Schema registered for their type. Each violation is logged and returned as
+// a validation Failure, joined.
+func (w *GitWriter) Validate(targets []Target) error {
+	log := logger(w.Logger)
+	if len(w.Config.Schemas) == 0 {
+		return nil
+	}
+
+	registry, err := NewSchemaRegistry(w.Config.SchemaFiles())
+	if err != nil {
+		return Fail(PhaseConfig, "schemas", err)
+	}
+
+	validated := make(map[string]bool)
+	var violations []Violation
+	var errs []error
+
+	for _, target := range targets {
+		for _, t := range target.Types {
+			if !registry.Has(t) {
+				log.Debug("no schema for type", "type", t)
+				continue
+			}
+			files, err := target.TypeFiles(t)
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				if validated[file] {
+					continue
+				}
+				validated[file] = true
+				log.Debug("validating file", "file", file, "type", t)
+				v, err := registry.Validate(t, file)
+				if err != nil {
+					errs = append(errs, Fail(PhaseValidation, file, fmt.Errorf("unable to validate, %w", err)))
+					continue
+				}
+				violations = append(violations, v...)
+			}
+		}
+	}
+
+	for _, v := range violations {
+		log.Error("schema validation failed", "file", v.File, "path", v.Path, "msg", v.Message)
+		errs = append(errs, Fail(PhaseValidation, v.File, fmt.Errorf("%s: %s", pointer(v.Path), v.Message)))
+	}
+
+	return errors.Join(errs...)
+}
+
+// CheckDestinations checks that the destination of each rendered file of the
+// targets stays inside the clone of its repo once symlinks are resolved, and
+// is not a symlink. Each target with a destination outside of its clone is
+// logged and returned as a validation Failure, joined.
+func (w *GitWriter) CheckDestinations(targets []Target) error {
+	log := logger(w.Logger)
+
+	var errs []error
+	for _, target := range targets {
+		if err := w.checkDestinations(target); err != nil {
+			log.Error("unsafe destination", "repo", target.Repo, "branch", target.Branch, "path", target.Path, "error", err)
+			errs = append(errs, Fail(PhaseValidation, target.Repo+":"+target.Branch+"/"+target.Path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkDestinations checks the destinations of the files of a target
+func (w *GitWriter) checkDestinations(target Target) error {
+	if err := target.Validate(); err != nil {
+		return err
+	}
+	root := w.cloneDir(target)
+	for _, t := range target.Types {
+		files, err := target.TypeFiles(t)
+		if err != nil {
+			return err
+		}
+		dir := filepath.Join(root, target.Path, t)
+		if err = insideDir(root, dir); err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err = checkDestination(root, filepath.Join(dir, target.DestFilename(file))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkDestination returns an error if a file is a symlink, which would be
+// written through, or is outside of root once symlinks are resolved
+func checkDestination(root, file string) error {
+	if fi, err := os.Lstat(file); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("destination %s is a symlink", file)
+	}
+	return insideDir(root, file)
+}
+
+// insideDir returns an error if p is not inside root, or is inside its .git
+// directory, once the symlinks of both are resolved. The part of p that does
+// not exist yet is resolved from its deepest existing parent.
+func insideDir(root, p string) error {
+	realRoot, err := realPath(root)
+	if err != nil {
+		return err
+	}
+	real, err := realPath(p)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(realRoot, real)
+	if err != nil || !filepath.IsLocal(rel) {
+		return fmt.Errorf("destination %s resolves to %s, outside of %s", p, real, root)
+	}
+	if hasGitDir(rel) {
+		return fmt.Errorf("destination %s resolves to %s, inside the .git directory of %s", p, real, root)
+	}
+	return nil
+}
+
+// realPath returns the absolute path of p with its symlinks resolved. The
+// part of p that does not exist is appended to its deepest existing parent.
+func realPath(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	existing, rest := abs, ""
+	for {
+		if _, err = os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(real, rest), nil
+}
+
+// CheckPolicies evaluates the configured policies against the rendered files
+// of each target. Warnings are logged; each violation of a deny policy is
+// logged and returned as a policy Failure, joined.
+func (w *GitWriter) CheckPolicies(targets []Target) error {
+	log := logger(w.Logger)
+	if len(w.Config.Policies) == 0 {
+		return nil
+	}
+
+	policies, err := NewPolicySet(w.Config.Policies)
+	if err != nil {
+		return Fail(PhaseConfig, "policies", fmt.Errorf("invalid policies, %w", err))
+	}
+
+	var errs []error
+	for _, target := range targets {
+		for _, t := range target.Types {
+			files, err := target.TypeFiles(t)
+			if err != nil {
+				return err
+			}
+			for _, file := range files {
+				content, err := os.ReadFile(file)
+				if err != nil {
+					return err
+				}
+				var doc any
+				if err = json.Unmarshal(content, &doc); err != nil {
+					errs = append(errs, Fail(PhaseValidation, file, fmt.Errorf("unable to parse, %w", err)))
+					continue
+				}
+
+				origin, err := w.Config.Hierarchy.FileOrigin(w.DataDir, file)
+				if err != nil {
+					log.Warn("unable to read render index", "dir", filepath.Dir(file), "msg", err)
+				}
+				meta := map[string]string{
+					"repo":   target.Repo,
+					"name":   target.Name,
+					"branch": target.Branch,
+					"path":   target.Path,
+					"app":    target.App,
+					"type":   t,
+					"file":   filepath.Base(file),
+				}
+				for _, level := range w.Config.Hierarchy {
+					meta[level] = origin.Selection.Get(level)
+				}
+
+				log.Debug("checking policies", "file", file, "target", meta)
+				for _, r := range policies.Evaluate(file, t, doc, meta) {
+					if r.Action == "warn" {
+						log.Warn("policy violation", "policy", r.Policy, "file", r.File, "path", r.Path, "msg", r.Message)
+						continue
+					}
+					log.Error("policy violation", "policy", r.Policy, "file", r.File, "path", r.Path, "msg", r.Message)
+					errs = append(errs, Fail(PhasePolicy, r.File, fmt.Errorf("%s: %s: %s", r.Policy, pointer(r.Path), r.Message)))
+				}
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// pointer returns a JSON pointer for display: "/" for the whole document
+func pointer(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
@@ -0,0 +1,188 @@
+package murmur
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestInsideDir(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "x:main")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "deploy"), filepath.Join(root, ".git", "hooks"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, dest := range map[string]string{
+		"in":       "deploy",                          // a relative link inside the clone
+		"out":      outside,                           // a link outside of the clone
+		"up":       "..",                              // a relative link outside of the clone
+		"hooks":    ".git/hooks",                      // a link to the git directory
+		"deploy/x": "../deploy",                       // a link back inside
+		"root":     root,                              // the clone itself
+		"dangling": filepath.Join(outside, "missing"), // a link to a missing file
+	} {
+		if err := os.Symlink(dest, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the root itself may be reached through a symlink
+	if err := os.Symlink(root, filepath.Join(base, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		root string
+		path string
+		err  string // a substring of the error, "" for none
+	}{
+		{name: "file", path: "deploy/a.json"},
+		{name: "missing directories", path: "deploy/a/b/c.json"},
+		{name: "root", path: "."},
+		{name: "link inside", path: "in/a.json"},
+		{name: "link back inside", path: "deploy/x/a.json"},
+		{name: "link to the root", path: "root/a.json"},
+		{name: "root through a link", root: filepath.Join(base, "link"), path: "deploy/a.json"},
+		{name: "path through a link to the root", root: root, path: filepath.Join(base, "link", "deploy")},
+		{name: "parent", path: "..", err: "outside of"},
+		{name: "sibling", path: "../outside/a.json", err: "outside of"},
+		{name: "link outside", path: "out/a.json", err: "outside of"},
+		{name: "relative link outside", path: "up/outside", err: "outside of"},
+		{name: "dangling link", path: "dangling", err: "no such file"},
+		{name: "git dir", path: ".git/config", err: "inside the .git directory"},
+		{name: "link to the git dir", path: "hooks/pre-commit", err: "inside the .git directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.root
+			if r == "" {
+				r = root
+			}
+			p := tt.path
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(r, p)
+			}
+			err := insideDir(r, p)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("unexpected error %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRealPath(t *testing.T) {
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(filepath.Join(base, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Symlink("dir", filepath.Join(base, "link")); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	realWd, err := filepath.EvalSymlinks(wd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{filepath.Join(base, "dir"), filepath.Join(base, "dir")},
+		{filepath.Join(base, "link"), filepath.Join(base, "dir")},
+		{filepath.Join(base, "link", "a", "b.json"), filepath.Join(base, "dir", "a", "b.json")},
+		{filepath.Join(base, "missing", "..", "link"), filepath.Join(base, "dir")},
+		{"missing/a.json", filepath.Join(realWd, "missing", "a.json")},
+	}
+	for _, tt := range tests {
+		got, err := realPath(tt.path)
+		if err != nil {
+			t.Errorf("%s: %v", tt.path, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestWriteFilesGroups(t *testing.T) {
+	datadir, repodir, workdir := t.TempDir(), t.TempDir(), t.TempDir()
+	for _, f := range []string{"web-targets.json", "web-stacks.json", "web-dbs.json"} {
+		if err := os.MkdirAll(filepath.Join(datadir, "ops", "web"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(datadir, "ops", "web", f), []byte(`{"file": "`+f+`"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(repodir, "x:main", "deploy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	target := func(repo, path string, types ...string) Target {
+		return Target{
+			Dir: filepath.Join(datadir, "ops", "web"), Filename: "web-targets.json", Prefix: "web", App: "web",
+			Name: "x", Repo: repo, Branch: "main", Path: path, Types: types,
+		}
+	}
+	// the targets of a file name the same repo in two ways: they share the
+	// clone, and its manifest
+	targets := []Target{
+		target("o/x", "deploy", "stacks"),
+		target(".", "local", "stacks"),
+		target("github.com/o/x", "deploy", "dbs"),
+	}
+
+	// targets of repo "." are written relative to the current directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(workdir); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir("local", 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	w := &GitWriter{Config: DefaultConfig(), RepoDir: repodir, DataDir: datadir}
+	written, err := w.WriteFiles(targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{
+		filepath.Join(repodir, "x:main", "deploy", "stacks", "web-stacks.json"),
+		filepath.Join(repodir, "x:main", "deploy", "dbs", "web-dbs.json"),
+		filepath.Join("local", "stacks", "web-stacks.json"),
+	} {
+		if !slices.Contains(written, f) {
+			t.Errorf("%s not written: %q", f, written)
+		}
+		if _, err := os.Stat(f); err != nil {
+			t.Error(err)
+		}
+	}
+
+	m, err := ReadManifest(filepath.Join(repodir, "x:main", "deploy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m["stacks/web-stacks.json"]; !ok || len(m) != 2 {
+		t.Errorf("manifest %v, want the files of both targets", m)
+	}
+}